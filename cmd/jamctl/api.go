@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// api talks to the admin API of a running server
+type api struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newAPI(baseURL string, token string) *api {
+	return &api{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends body as JSON and decodes the reply into out (when not nil)
+func (a *api) do(method string, path string, body any, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, a.baseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%v %v: %v", method, path, apiErr.Error)
+		}
+		return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func userPath(login string, rest ...string) string {
+	return "/api/users/" + strings.Join(append([]string{url.PathEscape(login)}, rest...), "/")
+}
+
+func (a *api) ListUsers() ([]user, error) {
+	var list []user
+	err := a.do(http.MethodGet, "/api/users", nil, &list)
+	return list, err
+}
+
+func (a *api) GetUser(login string) (user, error) {
+	var u user
+	err := a.do(http.MethodGet, userPath(login), nil, &u)
+	return u, err
+}
+
+func (a *api) AddUser(login string, password string, groups []string) error {
+	body := map[string]any{"login": login, "password": password, "groups": groups}
+	return a.do(http.MethodPost, "/api/users", body, nil)
+}
+
+func (a *api) RemoveUser(login string) error {
+	return a.do(http.MethodDelete, userPath(login), nil, nil)
+}
+
+func (a *api) SetDisabled(login string, disabled bool) error {
+	return a.do(http.MethodPut, userPath(login, "disabled"), map[string]any{"disabled": disabled}, nil)
+}
+
+func (a *api) SetPassword(login string, password string) error {
+	return a.do(http.MethodPut, userPath(login, "password"), map[string]any{"password": password}, nil)
+}
+
+func (a *api) Sessions() ([]session, error) {
+	var sessions []session
+	err := a.do(http.MethodGet, "/api/sessions", nil, &sessions)
+	return sessions, err
+}
+
+func (a *api) Approve(login string) error {
+	return a.do(http.MethodPost, userPath(login, "approve"), nil, nil)
+}
+
+func (a *api) ResetTOTP(login string) error {
+	return a.do(http.MethodDelete, userPath(login, "totp"), nil, nil)
+}
+
+func (a *api) SetCertificates(login string, certificates []string) error {
+	return a.do(http.MethodPut, userPath(login, "certificates"), map[string]any{"certificates": certificates}, nil)
+}
+
+func (a *api) SetAccess(login string, access users.Access) error {
+	return a.do(http.MethodPut, userPath(login, "access"), access, nil)
+}
+
+func (a *api) Invites() ([]users.Invite, error) {
+	var invites []users.Invite
+	err := a.do(http.MethodGet, "/api/invites", nil, &invites)
+	return invites, err
+}
+
+// the API takes whole hours, anything shorter rounds up to one
+func (a *api) CreateInvite(groups []string, valid time.Duration) (users.Invite, error) {
+	hours := int((valid + time.Hour - 1) / time.Hour)
+	var invite users.Invite
+	err := a.do(http.MethodPost, "/api/invites", map[string]any{"groups": groups, "valid_hours": hours}, &invite)
+	return invite, err
+}
+
+func (a *api) DeleteInvite(code string) error {
+	return a.do(http.MethodDelete, "/api/invites/"+url.PathEscape(code), nil, nil)
+}
+
+func (a *api) ACLs() (map[string][]jfs.ACLEntry, error) {
+	var lists map[string][]jfs.ACLEntry
+	err := a.do(http.MethodGet, "/api/acls", nil, &lists)
+	return lists, err
+}
+
+func (a *api) SetACL(dir string, entries []jfs.ACLEntry) error {
+	if entries == nil {
+		entries = []jfs.ACLEntry{}
+	}
+	dirPath := (&url.URL{Path: strings.TrimPrefix(path.Clean("/"+dir), "/")}).EscapedPath()
+	return a.do(http.MethodPut, "/api/acls/"+dirPath, map[string]any{"entries": entries}, nil)
+}
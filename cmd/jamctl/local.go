@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"time"
+)
+
+// local works on db.json directly, a running server picks the changes up on
+// the next login but its sessions are left alone
+type local struct {
+	store   *users.Store
+	invites *users.InviteStore
+	index   *jfs.Index
+}
+
+func newLocal(path string, invitesPath string, index *jfs.Index) *local {
+	return &local{store: users.NewStore(path), invites: users.NewInviteStore(invitesPath), index: index}
+}
+
+func (l *local) ListUsers() ([]user, error) {
+	all, err := l.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]user, 0, len(all))
+	for _, u := range all {
+		list = append(list, toUser(u))
+	}
+	return list, nil
+}
+
+func toUser(u users.Credentials) user {
+	return user{
+		Login:        u.Login,
+		Groups:       u.Groups,
+		Disabled:     u.Disabled,
+		Pending:      u.Pending,
+		Certificates: u.Certificates,
+		TOTP:         u.SecondFactor(),
+		Access:       u.Access,
+	}
+}
+
+func (l *local) GetUser(login string) (user, error) {
+	u, err := l.store.Get(login)
+	if err != nil {
+		return user{}, err
+	}
+	return toUser(u), nil
+}
+
+// AddUser leaves the password policy to the administrator, local mode doesn't
+// read the server's config and is the way in while the server is down. With
+// -api the server applies it. Store.Add refuses the anonymous logins.
+func (l *local) AddUser(login string, password string, groups []string) error {
+	hash, err := users.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return l.store.Add(users.Credentials{Login: login, Password: hash, Groups: groups})
+}
+
+func (l *local) RemoveUser(login string) error {
+	return l.store.Delete(login)
+}
+
+func (l *local) SetDisabled(login string, disabled bool) error {
+	return l.store.Update(login, func(u *users.Credentials) error {
+		u.Disabled = disabled
+		return nil
+	})
+}
+
+// SetPassword skips the password policy like AddUser
+func (l *local) SetPassword(login string, password string) error {
+	hash, err := users.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return l.store.Update(login, func(u *users.Credentials) error {
+		u.Password = hash
+		return nil
+	})
+}
+
+func (l *local) Sessions() ([]session, error) {
+	return nil, errors.New("sessions live in the server, use -api")
+}
+
+func (l *local) Approve(login string) error {
+	return l.store.Update(login, func(u *users.Credentials) error {
+		u.Pending = false
+		return nil
+	})
+}
+
+func (l *local) ResetTOTP(login string) error {
+	return l.store.DisableTOTP(login, "")
+}
+
+func (l *local) SetCertificates(login string, certificates []string) error {
+	return l.store.Update(login, func(u *users.Credentials) error {
+		u.Certificates = certificates
+		return nil
+	})
+}
+
+func (l *local) SetAccess(login string, access users.Access) error {
+	access, err := access.Clean()
+	if err != nil {
+		return err
+	}
+	return l.store.Update(login, func(u *users.Credentials) error {
+		u.Access = access
+		return nil
+	})
+}
+
+func (l *local) Invites() ([]users.Invite, error) {
+	return l.invites.List()
+}
+
+func (l *local) CreateInvite(groups []string, valid time.Duration) (users.Invite, error) {
+	return l.invites.Create(groups, valid)
+}
+
+func (l *local) DeleteInvite(code string) error {
+	return l.invites.Delete(code)
+}
+
+func (l *local) ACLs() (map[string][]jfs.ACLEntry, error) {
+	return l.index.ACLs()
+}
+
+func (l *local) SetACL(dir string, entries []jfs.ACLEntry) error {
+	return l.index.SetACL(dir, entries)
+}
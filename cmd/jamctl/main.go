@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"jamserver/internal/config"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// NOTE: jamctl manages users, sessions and files of a jamserver, either the
+// local app/ files directly or a running server through its admin API
+
+const usage = `usage: jamctl [flags] <command> [args]
+
+commands:
+  user list
+  user add <login> [group...]    password is read from stdin
+  user remove <login>
+  user disable <login>           also kicks its sessions (API only)
+  user enable <login>
+  user passwd <login>            password is read from stdin
+  user approve <login>           activates an account registered in approval mode
+  user resettotp <login>         turns the second factor off (lost device and recovery codes)
+  user certs <login>             lists tls client certificate entries
+  user addcert <login> <entry>   entry is a PEM file, sha256:<fingerprint> or "subject:<DN>"
+  user delcert <login> <entry>
+  user access <login>            shows permissions, home directory and expiry
+  user perms <login> <perm,...>  any of list,read,write,delete,rename,mkdir,chmod or all
+  user home <login> <dir>        directory the user is locked into, / is the root
+  user expire <login> <date>     YYYY-MM-DD (end of that day) or never
+  invite list
+  invite create [group...]       prints the code for rgsr, see -valid
+  invite delete <code>
+  acl list                       directories with an access list
+  acl set <dir> <who=op,...>...  who is a login, @group or *, see -noinherit
+  acl clear <dir>
+  sessions                       needs -api
+  fs rebuild                     rescans the file system into its metadata file
+  fs owner <path>                shows owner, group and mode
+  fs chown <path> <user[:group]> also for files nobody owns yet
+  fs chmod <path> <mode>         octal like 640, the path needs an owner
+  fs gc                          deletes the blobs no file points at (with -blobs)
+  config check [path]            parses and validates a config file
+
+flags:
+`
+
+type user struct {
+	Login    string   `json:"login"`
+	Groups   []string `json:"groups"`
+	Disabled bool     `json:"disabled"`
+	Pending  bool     `json:"pending"`
+
+	Certificates []string `json:"certificates"`
+	TOTP         bool     `json:"totp"`
+
+	users.Access
+}
+
+type session struct {
+	ID            int       `json:"id"`
+	User          string    `json:"user"`
+	Authenticated bool      `json:"authenticated"`
+	Remote        string    `json:"remote"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	WorkDir       string    `json:"cwd"`
+	Transfer      *struct {
+		Command string    `json:"command"`
+		File    string    `json:"file"`
+		Bytes   int64     `json:"bytes"`
+		Started time.Time `json:"started"`
+	} `json:"transfer"`
+}
+
+// backend is where user changes go, the local db.json or the admin API
+type backend interface {
+	ListUsers() ([]user, error)
+	GetUser(login string) (user, error)
+	AddUser(login string, password string, groups []string) error
+	RemoveUser(login string) error
+	SetDisabled(login string, disabled bool) error
+	SetPassword(login string, password string) error
+	Approve(login string) error
+	ResetTOTP(login string) error
+	SetCertificates(login string, certificates []string) error
+	SetAccess(login string, access users.Access) error
+	Sessions() ([]session, error)
+	Invites() ([]users.Invite, error)
+	CreateInvite(groups []string, valid time.Duration) (users.Invite, error)
+	DeleteInvite(code string) error
+	ACLs() (map[string][]jfs.ACLEntry, error)
+	SetACL(dir string, entries []jfs.ACLEntry) error
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	apiURL := flag.String("api", os.Getenv("JAMCTL_API"), "admin API base URL, e.g. http://127.0.0.1:9122 (default: work on local files)")
+	token := flag.String("token", os.Getenv("JAMCTL_TOKEN"), "admin API token")
+	dbPath := flag.String("db", users.DefaultPath, "user database for local mode")
+	fsRoot := flag.String("root", jfs.DefaultBasePath, "file system root for fs commands and local acls")
+	fsMetadata := flag.String("metadata", jfs.MetadataPath, "metadata file for fs commands and local acls")
+	fsBlobs := flag.String("blobs", "", "blob directory of a dedup storage, used instead of -root")
+	invitesPath := flag.String("invites", users.DefaultInvitesPath, "invite file for local mode")
+	valid := flag.Duration("valid", 72*time.Hour, "how long a new invite can be used, 0 = forever")
+	noInherit := flag.Bool("noinherit", false, "acl set: entries apply to the directory only, not its subdirectories")
+	flag.Parse()
+
+	var fsBackend jfs.Backend = jfs.NewLocalBackend(*fsRoot)
+	var dedup *jfs.DedupBackend
+	if *fsBlobs != "" {
+		dedup = jfs.NewDedupBackend(*fsBlobs)
+		fsBackend = dedup
+	}
+	index := jfs.NewIndex(fsBackend, *fsMetadata)
+
+	var b backend = newLocal(*dbPath, *invitesPath, index)
+	if *apiURL != "" {
+		if *token == "" {
+			fail(errors.New("-token (or JAMCTL_TOKEN) is required with -api"))
+		}
+		b = newAPI(*apiURL, *token)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "user":
+		err = userCommand(b, args[1:])
+	case "sessions":
+		err = listSessions(b)
+	case "invite":
+		err = inviteCommand(b, args[1:], *valid)
+	case "acl":
+		err = aclCommand(b, args[1:], !*noInherit)
+	case "fs":
+		err = fsCommand(index, dedup, args[1:], *fsMetadata)
+	case "config":
+		err = configCommand(args[1:])
+	default:
+		err = errUsage
+	}
+
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "jamctl: %v\n", err)
+	os.Exit(1)
+}
+
+func userCommand(b backend, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if args[0] == "list" {
+		return listUsers(b)
+	}
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	login := args[1]
+	switch args[0] {
+	case "certs", "addcert", "delcert":
+		return credentialCommand(b, args)
+	case "access", "perms", "home", "expire":
+		return accessCommand(b, args)
+	}
+	if args[0] != "add" && len(args) != 2 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := b.AddUser(login, password, args[2:]); err != nil {
+			return err
+		}
+		fmt.Printf("user %v added\n", login)
+	case "remove":
+		if err := b.RemoveUser(login); err != nil {
+			return err
+		}
+		fmt.Printf("user %v removed\n", login)
+	case "disable", "enable":
+		if err := b.SetDisabled(login, args[0] == "disable"); err != nil {
+			return err
+		}
+		fmt.Printf("user %v %vd\n", login, args[0])
+	case "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := b.SetPassword(login, password); err != nil {
+			return err
+		}
+		fmt.Printf("password of %v changed\n", login)
+	case "approve":
+		if err := b.Approve(login); err != nil {
+			return err
+		}
+		fmt.Printf("user %v approved\n", login)
+	case "resettotp":
+		if err := b.ResetTOTP(login); err != nil {
+			return err
+		}
+		fmt.Printf("TOTP of %v turned off\n", login)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// credentialCommand manages the tls certificates of a user, the whole list is
+// read, changed and written back
+func credentialCommand(b backend, args []string) error {
+	verb, login := args[0], args[1]
+	if (verb == "certs") != (len(args) == 2) || len(args) > 3 {
+		return errUsage
+	}
+
+	u, err := b.GetUser(login)
+	if err != nil {
+		return err
+	}
+
+	switch verb {
+	case "certs":
+		for _, entry := range u.Certificates {
+			fmt.Println(entry)
+		}
+		return nil
+	case "addcert":
+		value := args[2]
+		if data, err := os.ReadFile(value); err == nil {
+			value = string(data)
+		}
+		entry, err := users.ParseCertificateEntry(value)
+		if err != nil {
+			return err
+		}
+		if err := b.SetCertificates(login, append(u.Certificates, entry)); err != nil {
+			return err
+		}
+		fmt.Printf("%v added to %v\n", entry, login)
+	case "delcert":
+		certificates := slices.DeleteFunc(slices.Clone(u.Certificates), func(entry string) bool { return entry == args[2] })
+		if len(certificates) == len(u.Certificates) {
+			return fmt.Errorf("%v has no certificate %v", login, args[2])
+		}
+		if err := b.SetCertificates(login, certificates); err != nil {
+			return err
+		}
+		fmt.Printf("%v removed from %v\n", args[2], login)
+	}
+	return nil
+}
+
+// accessCommand shows or changes one part of the access of a user, the rest
+// is written back as it was
+func accessCommand(b backend, args []string) error {
+	verb, login := args[0], args[1]
+	if (verb == "access") != (len(args) == 2) || len(args) > 3 {
+		return errUsage
+	}
+
+	u, err := b.GetUser(login)
+	if err != nil {
+		return err
+	}
+	access := u.Access
+
+	switch verb {
+	case "access":
+		permissions := "all"
+		if len(access.Permissions) > 0 {
+			names := make([]string, 0, len(access.Permissions))
+			for _, p := range access.Permissions {
+				names = append(names, string(p))
+			}
+			permissions = strings.Join(names, ",")
+		}
+		expires := "never"
+		if !access.Expires.IsZero() {
+			expires = access.Expires.Local().Format(time.DateTime)
+		}
+		fmt.Printf("permissions: %v\nhome: /%v\nexpires: %v\n", permissions, access.Home, expires)
+		return nil
+	case "perms":
+		permissions, err := users.ParsePermissions(strings.Split(args[2], ","))
+		if err != nil {
+			return err
+		}
+		access.Permissions = permissions
+	case "home":
+		access.Home = users.CleanHome(args[2])
+	case "expire":
+		access.Expires = time.Time{}
+		if args[2] != "never" {
+			day, err := time.ParseInLocation(time.DateOnly, args[2], time.Local)
+			if err != nil {
+				return fmt.Errorf("invalid date %q, use YYYY-MM-DD or never", args[2])
+			}
+			access.Expires = day.AddDate(0, 0, 1).Add(-time.Second)
+		}
+	}
+
+	if err := b.SetAccess(login, access); err != nil {
+		return err
+	}
+	fmt.Printf("access of %v changed\n", login)
+	return nil
+}
+
+func inviteCommand(b backend, args []string, valid time.Duration) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		invites, err := b.Invites()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CODE\tGROUPS\tEXPIRES")
+		for _, invite := range invites {
+			expires := "never"
+			if !invite.Expires.IsZero() {
+				expires = invite.Expires.Local().Format(time.DateTime)
+			}
+			if invite.Expired(time.Now()) {
+				expires += " (expired)"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", invite.Code, strings.Join(invite.Groups, ","), expires)
+		}
+		return tw.Flush()
+	case "create":
+		invite, err := b.CreateInvite(args[1:], valid)
+		if err != nil {
+			return err
+		}
+		fmt.Println(invite.Code)
+	case "delete":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := b.DeleteInvite(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("invite %v deleted\n", args[1])
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func aclCommand(b backend, args []string, inherit bool) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		lists, err := b.ACLs()
+		if err != nil {
+			return err
+		}
+		dirs := make([]string, 0, len(lists))
+		for dir := range lists {
+			dirs = append(dirs, dir)
+		}
+		slices.Sort(dirs)
+		for _, dir := range dirs {
+			fmt.Printf("/%v\n", dir)
+			for _, entry := range lists[dir] {
+				fmt.Printf("  %v\n", entry)
+			}
+		}
+	case "set":
+		if len(args) < 3 {
+			return errUsage
+		}
+		entries := make([]jfs.ACLEntry, 0, len(args)-2)
+		for _, value := range args[2:] {
+			entry, err := jfs.ParseACLEntry(value, inherit)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		if err := b.SetACL(args[1], entries); err != nil {
+			return err
+		}
+		fmt.Printf("acl of %v set\n", args[1])
+	case "clear":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if err := b.SetACL(args[1], nil); err != nil {
+			return err
+		}
+		fmt.Printf("acl of %v removed\n", args[1])
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// fsCommand works on the metadata file directly, a running server reads the
+// changes on the next check. dedup is nil unless the storage is one.
+func fsCommand(index *jfs.Index, dedup *jfs.DedupBackend, args []string, metadata string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "rebuild":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if err := index.Reconcile(); err != nil {
+			return err
+		}
+		fmt.Printf("%v rebuilt\n", metadata)
+	case "owner":
+		if len(args) != 2 {
+			return errUsage
+		}
+		attrs, found, err := index.Attributes(args[1])
+		if err != nil {
+			return err
+		}
+		if !found {
+			fmt.Printf("%v has no owner\n", args[1])
+			return nil
+		}
+		fmt.Printf("%v:%v %03o\n", attrs.Owner, attrs.Group, attrs.Mode)
+	case "chown":
+		if len(args) != 3 {
+			return errUsage
+		}
+		attrs, found, err := index.Attributes(args[1])
+		if err != nil {
+			return err
+		}
+		owner, group, withGroup := strings.Cut(args[2], ":")
+		if owner == "" {
+			return errors.New("chown needs a user")
+		}
+		attrs.Owner = owner
+		if withGroup {
+			attrs.Group = group
+		}
+		if !found {
+			attrs.Mode = 0644
+			if info, err := index.Stat(args[1]); err == nil && info.IsDir() {
+				attrs.Mode = 0755
+			}
+		}
+		if err := index.SetAttributes(args[1], attrs); err != nil {
+			return err
+		}
+		fmt.Printf("owner of %v set to %v:%v\n", args[1], attrs.Owner, attrs.Group)
+	case "chmod":
+		if len(args) != 3 {
+			return errUsage
+		}
+		mode, err := jfs.ParseMode(args[2])
+		if err != nil {
+			return err
+		}
+		attrs, found, err := index.Attributes(args[1])
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%v has no owner, set one with fs chown first", args[1])
+		}
+		attrs.Mode = mode
+		if err := index.SetAttributes(args[1], attrs); err != nil {
+			return err
+		}
+		fmt.Printf("mode of %v set to %03o\n", args[1], mode)
+	case "gc":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if dedup == nil {
+			return errors.New("fs gc needs the blob directory, -blobs")
+		}
+		blobs, bytes, err := dedup.Collect()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d unreferenced blobs deleted, %d bytes\n", blobs, bytes)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// readPassword takes the first line of stdin, so it works both typed in and piped
+func readPassword() (string, error) {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "password: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password error: %w", err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+func listUsers(b backend) error {
+	all, err := b.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOGIN\tGROUPS\tSTATUS\t2FA")
+	for _, u := range all {
+		status := "active"
+		if u.Pending {
+			status = "pending"
+		}
+		if u.Disabled {
+			status = "disabled"
+		}
+		twoFactor := "-"
+		if u.TOTP {
+			twoFactor = "totp"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", u.Login, strings.Join(u.Groups, ","), status, twoFactor)
+	}
+	return tw.Flush()
+}
+
+func listSessions(b backend) error {
+	sessions, err := b.Sessions()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tREMOTE\tCONNECTED\tCWD\tTRANSFER")
+	for _, s := range sessions {
+		name := s.User
+		if !s.Authenticated {
+			name = "-"
+		}
+		transfer := "-"
+		if t := s.Transfer; t != nil {
+			transfer = fmt.Sprintf("%v %v (%v bytes)", t.Command, t.File, t.Bytes)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", s.ID, name, s.Remote,
+			time.Since(s.ConnectedAt).Truncate(time.Second), s.WorkDir, transfer)
+	}
+	return tw.Flush()
+}
+
+// configCommand checks a config the way the server loads it, but also
+// rejects unknown keys since those are most likely typos
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		return errUsage
+	}
+	path := config.DefaultPath
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cfg := config.Default()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing config %v error: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config %v: %w", path, err)
+	}
+
+	fmt.Printf("%v is valid\n", path)
+	return nil
+}
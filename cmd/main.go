@@ -2,11 +2,13 @@ package main
 
 import (
 	"jamserver/internal/server"
-	"log"
+	"log/slog"
+	"os"
 )
 
 func main() {
 	if err := server.Run(); err != nil {
-		log.Fatalf("Server failed %v", err)
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
 	}
 }
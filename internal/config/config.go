@@ -0,0 +1,421 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const DefaultPath = "app/config.json"
+
+type Config struct {
+	Throttle Throttle `json:"throttle"`
+	Limits   Limits   `json:"limits"`
+	Login    Login    `json:"login"`
+	Timeouts Timeouts `json:"timeouts"`
+	Log      Log      `json:"log"`
+	Xferlog  Xferlog  `json:"xferlog"`
+	Metrics  Metrics  `json:"metrics"`
+	Admin    Admin    `json:"admin"`
+
+	Registration Registration `json:"registration"`
+	TLS          TLS          `json:"tls"`
+	Anonymous    Anonymous    `json:"anonymous"`
+	Files        Files        `json:"files"`
+	Quotas       Quotas       `json:"quotas"`
+	Storage      Storage      `json:"storage"`
+}
+
+// Throttle limits are in bytes per second, 0 (or missing) means unlimited.
+// A transfer is held to every limit that applies to it: global, the user's
+// own one and one for each of the user's groups.
+type Throttle struct {
+	Global int64            `json:"global,omitempty"`
+	Users  map[string]int64 `json:"users,omitempty"`
+	Groups map[string]int64 `json:"groups,omitempty"`
+}
+
+// Limits on control connections, 0 (or missing) means unlimited. Clients over
+// the limit get 421 and are disconnected.
+type Limits struct {
+	MaxSessions          int `json:"max_sessions,omitempty"`
+	MaxSessionsPerIP     int `json:"max_sessions_per_ip,omitempty"`
+	MaxSessionsPerUser   int `json:"max_sessions_per_user,omitempty"`
+	ConnectionsPerMinute int `json:"connections_per_minute,omitempty"` // new connections per source IP
+
+	MaxAnonymousSessions      int `json:"max_anonymous_sessions,omitempty"`
+	MaxAnonymousSessionsPerIP int `json:"max_anonymous_sessions_per_ip,omitempty"`
+}
+
+// Login is the brute force protection for USER/PASS. Failures are counted per
+// connection, per source IP and per account, counters for IP and account
+// reset after FailureWindowSeconds without failures, without a window after a
+// day. 0 turns a check off.
+type Login struct {
+	MaxFailuresPerConnection int    `json:"max_failures_per_connection"`
+	MaxFailuresPerIP         int    `json:"max_failures_per_ip"`
+	MaxFailuresPerUser       int    `json:"max_failures_per_user"`
+	FailureWindowSeconds     int    `json:"failure_window_seconds"`
+	LockoutSeconds           int    `json:"lockout_seconds"`
+	DelayStepMillis          int    `json:"delay_step_ms"` // added to the 530 reply for every failure so far
+	MaxDelayMillis           int    `json:"max_delay_ms"`
+	BanList                  string `json:"ban_list"`
+
+	EndSessionsOnPasswordChange bool `json:"end_sessions_on_password_change"` // kick the account's other sessions
+}
+
+// Timeouts in seconds, 0 turns one off. Login is counted from connecting
+// until PASS succeeds, idle from the last command (a running transfer keeps
+// the session alive), data covers waiting for the client to connect after
+// PASV and a stalled data connection during a transfer.
+type Timeouts struct {
+	LoginSeconds int `json:"login_seconds"`
+	IdleSeconds  int `json:"idle_seconds"`
+	DataSeconds  int `json:"data_seconds"`
+}
+
+// Log level is debug, info, warn or error, format text or json. Empty file
+// logs to stdout.
+type Log struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	File   string `json:"file,omitempty"`
+}
+
+// Xferlog is the wu-ftpd style transfer log, empty file turns it off. The
+// file is rotated at MaxSizeMB keeping Keep old files.
+type Xferlog struct {
+	File      string `json:"file,omitempty"`
+	MaxSizeMB int    `json:"max_size_mb"`
+	Keep      int    `json:"keep"`
+}
+
+// Metrics serves prometheus metrics over http on Address (e.g.
+// "127.0.0.1:9121"), empty turns it off. Read at startup only.
+type Metrics struct {
+	Address string `json:"address,omitempty"`
+	Path    string `json:"path"`
+}
+
+// Admin is the REST API for operators, keep Address on localhost (e.g.
+// "127.0.0.1:9122"), empty turns it off. Read at startup only.
+type Admin struct {
+	Address string `json:"address,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// Registration controls RGSR: "disabled", "open", "invite" (RGSR needs a code
+// from Invites) or "approval" (accounts stay pending until an admin approves
+// them). Password applies to every new password.
+type Registration struct {
+	Mode     string         `json:"mode"`
+	Invites  string         `json:"invites"`
+	Password PasswordPolicy `json:"password"`
+}
+
+// PasswordPolicy, MinClasses counts lower case, upper case, digits and
+// everything else. BreachedList is a file with one known password per line,
+// plain or as the upper case SHA-1 hex (":count" suffix allowed), empty is off.
+type PasswordPolicy struct {
+	MinLength    int    `json:"min_length"`
+	MinClasses   int    `json:"min_classes"`
+	BreachedList string `json:"breached_list,omitempty"`
+}
+
+// TLS enables AUTH TLS with CertFile and KeyFile (PEM), empty CertFile turns
+// it off. ClientCA is the PEM bundle client certificates are verified against
+// for "subject:" entries of users, pinned "sha256:" entries work without it.
+type TLS struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	ClientCA string `json:"client_ca,omitempty"`
+}
+
+// Anonymous is the classic "anonymous"/"ftp" login with an email address as
+// password, off unless Enabled. Root is served read-only, uploads go to
+// Incoming (empty turns them off) where they can't be listed or downloaded.
+type Anonymous struct {
+	Enabled  bool   `json:"enabled"`
+	Root     string `json:"root"`
+	Incoming string `json:"incoming,omitempty"`
+}
+
+// Files are the settings for files users create. Umask is octal like the
+// shell's, the bits it has are cleared from the mode of new files (0666) and
+// directories (0777). The metadata of the file system is written back every
+// MetadataFlushSeconds. Changes made on disk by others are picked up through
+// inotify on linux, without it the tree is rescanned every RescanSeconds.
+type Files struct {
+	Umask                string `json:"umask"`
+	MetadataFlushSeconds int    `json:"metadata_flush_seconds"`
+	RescanSeconds        int    `json:"rescan_seconds"`
+}
+
+// UmaskMode is Umask as a mode, Validate made sure it parses
+func (f Files) UmaskMode() os.FileMode {
+	umask, _ := strconv.ParseUint(f.Umask, 8, 32)
+	return os.FileMode(umask)
+}
+
+// Storage is where the files live: "local" keeps them in Root on disk,
+// "memory" keeps them in memory and loses them on exit, "s3" in a bucket,
+// "dedup" stores every content once on disk. Read at startup only.
+type Storage struct {
+	Backend  string `json:"backend"`
+	Root     string `json:"root,omitempty"`
+	S3       S3     `json:"s3,omitempty"`
+	Dedup    Dedup  `json:"dedup,omitempty"`
+	Metadata string `json:"metadata"` // file of the index, one per backend
+}
+
+// Dedup keeps the contents as blobs named by their SHA-256 in Blobs, the
+// names are only in the metadata file. Blobs no file points at any more are
+// deleted every GCSeconds, 0 turns that off.
+type Dedup struct {
+	Blobs     string `json:"blobs"`
+	GCSeconds int    `json:"gc_seconds"`
+}
+
+// S3 is a bucket of AWS S3 or an S3-compatible store (MinIO, ...) reached
+// at Endpoint, the files go below Prefix. Without AccessKey and SecretKey
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are used. Changes made in the
+// bucket by others are picked up every RescanSeconds, 0 (the default) only
+// on startup: listing a big bucket costs.
+type S3 struct {
+	Endpoint      string `json:"endpoint"`
+	Region        string `json:"region,omitempty"`
+	Bucket        string `json:"bucket"`
+	Prefix        string `json:"prefix,omitempty"`
+	AccessKey     string `json:"access_key,omitempty"`
+	SecretKey     string `json:"secret_key,omitempty"`
+	RescanSeconds int    `json:"rescan_seconds,omitempty"`
+}
+
+// Quotas cap what the files of a user (Users, Default for everyone else) and
+// of a group take up. Files count for their owner and their group, like unix
+// quotas, anonymous uploads and files nobody owns count for nobody until a
+// user uploads over one.
+type Quotas struct {
+	Default Quota            `json:"default,omitempty"`
+	Users   map[string]Quota `json:"users,omitempty"`
+	Groups  map[string]Quota `json:"groups,omitempty"`
+}
+
+// Quota limits, 0 (or missing) means unlimited
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int64 `json:"max_files,omitempty"`
+}
+
+// User is the quota of a login
+func (q Quotas) User(login string) Quota {
+	if quota, ok := q.Users[login]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func Default() *Config {
+	return &Config{
+		Login: Login{
+			MaxFailuresPerConnection: 3,
+			MaxFailuresPerIP:         10,
+			MaxFailuresPerUser:       10,
+			FailureWindowSeconds:     900,
+			LockoutSeconds:           900,
+			DelayStepMillis:          1000,
+			MaxDelayMillis:           10000,
+			BanList:                  "app/bans.json",
+
+			EndSessionsOnPasswordChange: true,
+		},
+		Timeouts: Timeouts{
+			LoginSeconds: 60,
+			IdleSeconds:  300,
+			DataSeconds:  120,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Xferlog: Xferlog{
+			MaxSizeMB: 10,
+			Keep:      5,
+		},
+		Metrics: Metrics{
+			Path: "/metrics",
+		},
+		Anonymous: Anonymous{
+			Root: "app/public",
+		},
+		Files: Files{
+			Umask:                "022",
+			MetadataFlushSeconds: 5,
+			RescanSeconds:        60,
+		},
+		Storage: Storage{
+			Backend: "local",
+			Root:    "app/jam_filesystem",
+			Dedup: Dedup{
+				Blobs:     "app/blobs",
+				GCSeconds: 3600,
+			},
+			Metadata: "app/filesystem.json",
+		},
+		Registration: Registration{
+			Mode:    "invite",
+			Invites: "app/invites.json",
+			Password: PasswordPolicy{
+				MinLength: 8,
+			},
+		},
+	}
+}
+
+// Load reads the config file on top of the defaults, a missing file gives the defaults
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config %v error: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %v error: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	if c.Throttle.Global < 0 {
+		return fmt.Errorf("throttle.global must not be negative")
+	}
+	for login, rate := range c.Throttle.Users {
+		if rate < 0 {
+			return fmt.Errorf("throttle.users.%v must not be negative", login)
+		}
+	}
+	for group, rate := range c.Throttle.Groups {
+		if rate < 0 {
+			return fmt.Errorf("throttle.groups.%v must not be negative", group)
+		}
+	}
+	if c.Limits.MaxSessions < 0 || c.Limits.MaxSessionsPerIP < 0 || c.Limits.MaxSessionsPerUser < 0 || c.Limits.ConnectionsPerMinute < 0 ||
+		c.Limits.MaxAnonymousSessions < 0 || c.Limits.MaxAnonymousSessionsPerIP < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	login := c.Login
+	if login.MaxFailuresPerConnection < 0 || login.MaxFailuresPerIP < 0 || login.MaxFailuresPerUser < 0 ||
+		login.FailureWindowSeconds < 0 || login.LockoutSeconds < 0 || login.DelayStepMillis < 0 || login.MaxDelayMillis < 0 {
+		return fmt.Errorf("login settings must not be negative")
+	}
+	if login.BanList == "" {
+		return fmt.Errorf("login.ban_list must be set")
+	}
+	if c.Timeouts.LoginSeconds < 0 || c.Timeouts.IdleSeconds < 0 || c.Timeouts.DataSeconds < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level must be debug, info, warn or error")
+	}
+	if c.Xferlog.MaxSizeMB < 0 || c.Xferlog.Keep < 0 {
+		return fmt.Errorf("xferlog settings must not be negative")
+	}
+	if !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("metrics.path must start with /")
+	}
+	if c.Admin.Address != "" && len(c.Admin.Token) < 16 {
+		return fmt.Errorf("admin.token of at least 16 characters is required when admin.address is set")
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "text", "json":
+	default:
+		return fmt.Errorf("log.format must be text or json")
+	}
+	c.Registration.Mode = strings.ToLower(strings.TrimSpace(c.Registration.Mode))
+	switch c.Registration.Mode {
+	case "disabled", "open", "invite", "approval":
+	default:
+		return fmt.Errorf("registration.mode must be disabled, open, invite or approval")
+	}
+	if c.Anonymous.Enabled && c.Anonymous.Root == "" {
+		return fmt.Errorf("anonymous.root must be set when anonymous is enabled")
+	}
+	if c.Anonymous.Incoming != "" {
+		// inside the root the drop box could be downloaded, which it must not
+		if rel, err := filepath.Rel(c.Anonymous.Root, c.Anonymous.Incoming); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("anonymous.incoming must not be inside anonymous.root")
+		}
+	}
+	if q := c.Quotas.Default; q.MaxBytes < 0 || q.MaxFiles < 0 {
+		return fmt.Errorf("quotas.default must not be negative")
+	}
+	for login, q := range c.Quotas.Users {
+		if q.MaxBytes < 0 || q.MaxFiles < 0 {
+			return fmt.Errorf("quotas.users.%v must not be negative", login)
+		}
+	}
+	for group, q := range c.Quotas.Groups {
+		if q.MaxBytes < 0 || q.MaxFiles < 0 {
+			return fmt.Errorf("quotas.groups.%v must not be negative", group)
+		}
+	}
+	if umask, err := strconv.ParseUint(c.Files.Umask, 8, 32); err != nil || umask > 0777 {
+		return fmt.Errorf("files.umask must be octal between 000 and 777")
+	}
+	if c.Files.MetadataFlushSeconds < 1 {
+		return fmt.Errorf("files.metadata_flush_seconds must be at least 1")
+	}
+	if c.Files.RescanSeconds < 0 {
+		return fmt.Errorf("files.rescan_seconds must not be negative")
+	}
+	switch c.Storage.Backend {
+	case "local":
+		if c.Storage.Root == "" {
+			return fmt.Errorf("storage.root must be set for the local backend")
+		}
+	case "memory":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return fmt.Errorf("storage.s3.endpoint and storage.s3.bucket must be set for the s3 backend")
+		}
+		if c.Storage.S3.RescanSeconds < 0 {
+			return fmt.Errorf("storage.s3.rescan_seconds must not be negative")
+		}
+	case "dedup":
+		if c.Storage.Dedup.Blobs == "" {
+			return fmt.Errorf("storage.dedup.blobs must be set for the dedup backend")
+		}
+		if c.Storage.Dedup.GCSeconds < 0 {
+			return fmt.Errorf("storage.dedup.gc_seconds must not be negative")
+		}
+	default:
+		return fmt.Errorf("storage.backend must be local, memory, s3 or dedup")
+	}
+	if c.Storage.Metadata == "" {
+		return fmt.Errorf("storage.metadata must be set")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file go together")
+	}
+	if c.Registration.Mode == "invite" && c.Registration.Invites == "" {
+		return fmt.Errorf("registration.invites must be set for invite mode")
+	}
+	if policy := c.Registration.Password; policy.MinLength < 0 || policy.MinLength > 72 || policy.MinClasses < 0 || policy.MinClasses > 4 {
+		return fmt.Errorf("registration.password needs min_length 0-72 (bcrypt limit) and min_classes 0-4")
+	}
+	return nil
+}
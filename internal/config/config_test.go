@@ -0,0 +1,41 @@
+package config
+
+import "testing"
+
+func TestRegistrationMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		invites string
+		want    string // mode after Validate, "" when it fails
+	}{
+		{"invite", "app/invites.json", "invite"},
+		{"Invite", "app/invites.json", "invite"},
+		{" OPEN ", "", "open"},
+		{"Invite", "", ""},
+		{"closed", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.Registration.Mode, cfg.Registration.Invites = tt.mode, tt.invites
+		err := cfg.Validate()
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("mode %q with invites %q passed", tt.mode, tt.invites)
+		case tt.want != "" && err != nil:
+			t.Errorf("mode %q: %v", tt.mode, err)
+		case tt.want != "" && cfg.Registration.Mode != tt.want:
+			t.Errorf("mode %q became %q, want %q", tt.mode, cfg.Registration.Mode, tt.want)
+		}
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	cfg := Default()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Registration.Mode == "open" {
+		t.Error("anyone can register by default")
+	}
+}
@@ -0,0 +1,93 @@
+package dtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// block header: descriptor byte followed by 16 bit byte count
+const maxBlockSize = 1<<16 - 1
+
+type blockWriter struct {
+	w io.Writer
+}
+
+func (b *blockWriter) writeBlock(descriptor byte, data []byte) error {
+	header := []byte{descriptor, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(len(data)))
+	if _, err := b.w.Write(header); err != nil {
+		return err
+	}
+	_, err := b.w.Write(data)
+	return err
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := min(len(p), maxBlockSize)
+		if err := b.writeBlock(0, p[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		p = p[size:]
+	}
+	return written, nil
+}
+
+func (b *blockWriter) Mark(marker string) error {
+	return b.writeBlock(descRestart, []byte(marker))
+}
+
+func (b *blockWriter) Close() error {
+	return b.writeBlock(descEOF, nil)
+}
+
+type blockReader struct {
+	r       io.Reader
+	reader  *Reader
+	pending int // data bytes left in the current block
+	last    bool
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for b.pending == 0 {
+		if b.last {
+			return 0, io.EOF
+		}
+
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(b.r, header); err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		descriptor := header[0]
+		count := int(binary.BigEndian.Uint16(header[1:]))
+		b.last = descriptor&descEOF != 0
+
+		if descriptor&descRestart != 0 {
+			marker := make([]byte, count)
+			if _, err := io.ReadFull(b.r, marker); err != nil {
+				return 0, fmt.Errorf("reading restart marker: %w", err)
+			}
+			b.reader.mark(string(marker))
+			continue
+		}
+		b.pending = count
+	}
+
+	if len(p) > b.pending {
+		p = p[:b.pending]
+	}
+	n, err := b.r.Read(p)
+	b.pending -= n
+	if err == io.EOF && b.pending > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
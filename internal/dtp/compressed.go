@@ -0,0 +1,176 @@
+package dtp
+
+import (
+	"fmt"
+	"io"
+)
+
+// compressed mode records, rfc 959 section 3.4.3:
+//
+//	0nnnnnnn            n bytes of data follow (n > 0)
+//	10nnnnnn d          byte d repeated n times
+//	11nnnnnn            filler byte repeated n times
+//	00000000 descriptor escape, descriptor has block mode meaning
+const (
+	maxLiteral   = 127
+	maxRun       = 63
+	replicateTag = 0x80
+	fillerTag    = 0xC0
+	// there is no TYPE A/E yet, everything goes as image so filler is zero
+	fillerByte byte = 0
+)
+
+type compressedWriter struct {
+	w io.Writer
+}
+
+func (c *compressedWriter) Write(p []byte) (int, error) {
+	var out []byte
+	literalStart := 0
+
+	flushLiteral := func(end int) {
+		for literalStart < end {
+			size := min(end-literalStart, maxLiteral)
+			out = append(out, byte(size))
+			out = append(out, p[literalStart:literalStart+size]...)
+			literalStart += size
+		}
+	}
+
+	for i := 0; i < len(p); {
+		run := 1
+		for i+run < len(p) && p[i+run] == p[i] && run < maxRun {
+			run++
+		}
+
+		// runs shorter than 3 bytes are cheaper as literal data
+		if run < 3 {
+			i += run
+			continue
+		}
+
+		flushLiteral(i)
+		if p[i] == fillerByte {
+			out = append(out, fillerTag|byte(run))
+		} else {
+			out = append(out, replicateTag|byte(run), p[i])
+		}
+		i += run
+		literalStart = i
+	}
+	flushLiteral(len(p))
+
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// marker goes as escape sequence followed by the marker as a data record
+func (c *compressedWriter) Mark(marker string) error {
+	if len(marker) == 0 || len(marker) > maxLiteral {
+		return fmt.Errorf("invalid restart marker length: %d", len(marker))
+	}
+	record := append([]byte{0, descRestart, byte(len(marker))}, marker...)
+	_, err := c.w.Write(record)
+	return err
+}
+
+func (c *compressedWriter) Close() error {
+	_, err := c.w.Write([]byte{0, descEOF})
+	return err
+}
+
+type compressedReader struct {
+	r      io.Reader
+	reader *Reader
+	buf    []byte // decoded bytes not handed out yet
+	done   bool
+}
+
+func (c *compressedReader) readByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (c *compressedReader) readLiteral(count int) ([]byte, error) {
+	data := make([]byte, count)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// decode a single record into c.buf
+func (c *compressedReader) next() error {
+	tag, err := c.readByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tag == 0:
+		descriptor, err := c.readByte()
+		if err != nil {
+			return err
+		}
+		if descriptor&descRestart != 0 {
+			count, err := c.readByte()
+			if err != nil {
+				return err
+			}
+			marker, err := c.readLiteral(int(count))
+			if err != nil {
+				return fmt.Errorf("reading restart marker: %w", err)
+			}
+			c.reader.mark(string(marker))
+		}
+		if descriptor&descEOF != 0 {
+			c.done = true
+		}
+	case tag&0x80 == 0:
+		data, err := c.readLiteral(int(tag))
+		if err != nil {
+			return err
+		}
+		c.buf = data
+	case tag&fillerTag == fillerTag:
+		c.buf = repeat(fillerByte, int(tag&maxRun))
+	default:
+		value, err := c.readByte()
+		if err != nil {
+			return err
+		}
+		c.buf = repeat(value, int(tag&maxRun))
+	}
+	return nil
+}
+
+func (c *compressedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func repeat(value byte, count int) []byte {
+	data := make([]byte, count)
+	for i := range data {
+		data[i] = value
+	}
+	return data
+}
@@ -1,19 +1,50 @@
 package dtp
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
 	"net"
+	"time"
 )
 
-func SendData(conn net.Conn, data string) error {
+func SendData(conn net.Conn, data string, limiters ...*Limiter) error {
 	defer conn.Close()
 
-	_, err := conn.Write([]byte(data))
+	w := NewThrottledWriter(context.Background(), conn, limiters...)
+	_, err := w.Write([]byte(data))
 	if err != nil {
-		fmt.Printf("Error sending data over DTP connection: %v\n", err)
+		slog.Warn("sending data over DTP connection failed", "remote", conn.RemoteAddr().String(), "error", err)
 		return err
 	}
 
-	fmt.Println("Data sent succesfully over DTP")
+	slog.Debug("data sent over DTP connection", "remote", conn.RemoteAddr().String(), "bytes", len(data))
 	return nil
 }
+
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// NewTimeoutConn fails Read and Write on conn once the peer stalls for
+// timeout, unlike a plain deadline it does not limit the whole transfer
+func NewTimeoutConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{Conn: conn, timeout: timeout}
+}
+
+func (t *timeoutConn) Read(p []byte) (int, error) {
+	if err := t.Conn.SetReadDeadline(time.Now().Add(t.timeout)); err != nil {
+		return 0, err
+	}
+	return t.Conn.Read(p)
+}
+
+func (t *timeoutConn) Write(p []byte) (int, error) {
+	if err := t.Conn.SetWriteDeadline(time.Now().Add(t.timeout)); err != nil {
+		return 0, err
+	}
+	return t.Conn.Write(p)
+}
@@ -0,0 +1,156 @@
+package dtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NOTE: transmission modes, rfc 959 section 3.4
+
+type Mode byte
+
+const (
+	ModeStream     Mode = 'S'
+	ModeBlock      Mode = 'B'
+	ModeCompressed Mode = 'C'
+)
+
+// block mode descriptor codes, also used by compressed mode escape sequences
+const (
+	descEOR     byte = 128
+	descEOF     byte = 64
+	descErrors  byte = 32
+	descRestart byte = 16
+)
+
+// how often the sender puts a restart marker into the data stream
+const MarkInterval = 1 << 20
+
+func ParseMode(value string) (Mode, error) {
+	switch strings.ToUpper(value) {
+	case "S":
+		return ModeStream, nil
+	case "B":
+		return ModeBlock, nil
+	case "C":
+		return ModeCompressed, nil
+	}
+	return 0, fmt.Errorf("unsupported transfer mode: %q", value)
+}
+
+func (m Mode) String() string {
+	switch m {
+	case ModeBlock:
+		return "B"
+	case ModeCompressed:
+		return "C"
+	}
+	return "S"
+}
+
+// Writer encodes data for the data connection according to the transfer mode.
+// Close writes the end of file marker (if the mode has one), it does not close
+// the underlying connection.
+type Writer interface {
+	io.Writer
+	Mark(marker string) error
+	Close() error
+}
+
+// Reader decodes data received over the data connection, restart markers sent
+// by the other side are passed to OnMark.
+type Reader struct {
+	src    io.Reader
+	OnMark func(marker string)
+}
+
+func NewWriter(w io.Writer, mode Mode) Writer {
+	switch mode {
+	case ModeBlock:
+		return &blockWriter{w: w}
+	case ModeCompressed:
+		return &compressedWriter{w: w}
+	}
+	return &streamWriter{w: w}
+}
+
+func NewReader(r io.Reader, mode Mode) *Reader {
+	reader := &Reader{}
+	switch mode {
+	case ModeBlock:
+		reader.src = &blockReader{r: r, reader: reader}
+	case ModeCompressed:
+		reader.src = &compressedReader{r: r, reader: reader}
+	default:
+		reader.src = r
+	}
+	return reader
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.src.Read(p)
+}
+
+func (r *Reader) mark(marker string) {
+	if r.OnMark != nil {
+		r.OnMark(marker)
+	}
+}
+
+// Send copies src to w, putting a restart marker every MarkInterval bytes.
+// Markers hold the absolute byte offset in the file, so they can be handed
+// straight back to REST. offset is where src starts within the file.
+// Cancelling ctx (ABOR) stops the copy between chunks.
+func Send(ctx context.Context, w Writer, src io.Reader, offset int64) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	nextMark := offset + MarkInterval
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return total, writeErr
+			}
+			total += int64(n)
+
+			if offset+total >= nextMark {
+				if markErr := w.Mark(strconv.FormatInt(offset+total, 10)); markErr != nil {
+					return total, markErr
+				}
+				nextMark = offset + total + MarkInterval
+			}
+		}
+		if err == io.EOF {
+			return total, w.Close()
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+type streamWriter struct {
+	w io.Writer
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// stream mode has no restart markers, REST uses plain byte offsets instead
+func (s *streamWriter) Mark(string) error {
+	return nil
+}
+
+// in stream mode closing the connection is the end of file
+func (s *streamWriter) Close() error {
+	return nil
+}
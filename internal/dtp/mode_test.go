@@ -0,0 +1,146 @@
+package dtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Mode
+		err   bool
+	}{
+		{"S", ModeStream, false},
+		{"b", ModeBlock, false},
+		{"C", ModeCompressed, false},
+		{"Z", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMode(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseMode(%q) = %v, %v, want %v (error %v)", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"empty":        nil,
+		"text":         []byte("hello, world\n"),
+		"runs":         []byte("aaaaaaaabcccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccd"),
+		"zeros":        make([]byte, 1000),
+		"short runs":   []byte("aabbaabbcc"),
+		"long literal": bytes.Repeat([]byte("0123456789"), 50),
+		"big":          bytes.Repeat([]byte("jam\x00\x00\x00\x00server"), 20000),
+	}
+
+	for _, mode := range []Mode{ModeStream, ModeBlock, ModeCompressed} {
+		for name, payload := range payloads {
+			var wire bytes.Buffer
+			w := NewWriter(&wire, mode)
+			if _, err := w.Write(payload); err != nil {
+				t.Fatalf("%v/%v: write: %v", mode, name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%v/%v: close: %v", mode, name, err)
+			}
+
+			got, err := io.ReadAll(NewReader(&wire, mode))
+			if err != nil {
+				t.Fatalf("%v/%v: read: %v", mode, name, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("%v/%v: got %d bytes back, want %d", mode, name, len(got), len(payload))
+			}
+		}
+	}
+}
+
+func TestCompressedIsSmaller(t *testing.T) {
+	var wire bytes.Buffer
+	w := NewWriter(&wire, ModeCompressed)
+	w.Write(make([]byte, 4096))
+	w.Close()
+	if wire.Len() > 4096/maxRun+8 {
+		t.Errorf("4096 zero bytes took %d bytes compressed", wire.Len())
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	for _, mode := range []Mode{ModeBlock, ModeCompressed} {
+		var wire bytes.Buffer
+		w := NewWriter(&wire, mode)
+		w.Write([]byte("first"))
+		w.Mark("5")
+		w.Write([]byte("second"))
+		w.Mark("11")
+		w.Close()
+
+		var marks []string
+		r := NewReader(&wire, mode)
+		r.OnMark = func(marker string) { marks = append(marks, marker) }
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%v: read: %v", mode, err)
+		}
+		if string(got) != "firstsecond" {
+			t.Errorf("%v: data %q, markers leaked into it", mode, got)
+		}
+		if !slices.Equal(marks, []string{"5", "11"}) {
+			t.Errorf("%v: markers %q", mode, marks)
+		}
+	}
+}
+
+func TestSendMarksOffsets(t *testing.T) {
+	size := 2*MarkInterval + 100
+	offset := int64(MarkInterval / 2)
+
+	var wire bytes.Buffer
+	n, err := Send(context.Background(), NewWriter(&wire, ModeBlock), bytes.NewReader(make([]byte, size)), offset)
+	if err != nil || n != int64(size) {
+		t.Fatalf("Send = %d, %v", n, err)
+	}
+
+	var marks []string
+	r := NewReader(&wire, ModeBlock)
+	r.OnMark = func(marker string) { marks = append(marks, marker) }
+	io.Copy(io.Discard, r)
+
+	// markers are file offsets, the first one a whole interval after offset
+	want := []string{"1572864", "2621440"}
+	if !slices.Equal(marks, want) {
+		t.Errorf("markers %q, want %q", marks, want)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, mode := range []Mode{ModeBlock, ModeCompressed} {
+		var wire bytes.Buffer
+		w := NewWriter(&wire, mode)
+		w.Write([]byte(strings.Repeat("x", 100) + "yz"))
+		// no Close, the end of file marker is missing
+
+		_, err := io.ReadAll(NewReader(&wire, mode))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%v: error %v for a transfer without end of file", mode, err)
+		}
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var wire bytes.Buffer
+	n, err := Send(ctx, NewWriter(&wire, ModeStream), bytes.NewReader(make([]byte, 1000)), 0)
+	if err != context.Canceled || n != 0 || wire.Len() != 0 {
+		t.Errorf("Send after ABOR = %d, %v with %d bytes sent", n, err, wire.Len())
+	}
+}
@@ -0,0 +1,165 @@
+package dtp
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttled connections move data in chunks this big so rate changes kick in quickly
+const throttleChunk = 16 * 1024
+
+// Limiter is a token bucket shared by every transfer it applies to, rate is
+// in bytes per second and 0 means unlimited. Bursts are capped at one
+// second worth of data.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time // time.Now, tests move a clock of their own
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return newLimiter(rate, time.Now)
+}
+
+func newLimiter(rate int64, now func() time.Time) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: now(), now: now}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit for all transfers using the limiter, running ones included
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(l.now())
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	l.last = now
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// the caller has to wait before the tokens are really there
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill(l.now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	return wait(ctx, l.reserve(n))
+}
+
+// waitAll takes n tokens from every limiter at once and waits for the one
+// furthest in debt
+func waitAll(ctx context.Context, limiters []*Limiter, n int) error {
+	return wait(ctx, reserveAll(limiters, n))
+}
+
+// reserveAll is reserve on every limiter, the delays don't add up
+func reserveAll(limiters []*Limiter, n int) time.Duration {
+	var delay time.Duration
+	for _, limiter := range limiters {
+		delay = max(delay, limiter.reserve(n))
+	}
+	return delay
+}
+
+func wait(ctx context.Context, delay time.Duration) error {
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewThrottledWriter holds writes to w to every one of the limiters
+func NewThrottledWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := min(len(p), throttleChunk)
+		if err := waitAll(t.ctx, t.limiters, size); err != nil {
+			return written, err
+		}
+
+		n, err := t.w.Write(p[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[size:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewThrottledReader holds reads from r to every one of the limiters
+func NewThrottledReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		// pay after the read, the sender is held back by tcp flow control meanwhile
+		if waitErr := waitAll(t.ctx, t.limiters, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+package dtp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// clock is the time of a test limiter, moved by hand
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func testLimiter(rate int64) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return newLimiter(rate, c.now), c
+}
+
+func TestReserve(t *testing.T) {
+	type take struct {
+		after time.Duration // clock moved before the take
+		n     int
+	}
+	tests := []struct {
+		name  string
+		rate  int64
+		takes []take
+		want  time.Duration // delay of the last take
+	}{
+		{"unlimited", 0, []take{{0, 1 << 30}}, 0},
+		{"within the burst", 1000, []take{{0, 400}, {0, 600}}, 0},
+		{"into debt", 1000, []take{{0, 1000}, {0, 500}}, 500 * time.Millisecond},
+		{"debt adds up", 1000, []take{{0, 1500}, {0, 500}}, time.Second},
+		{"one big take", 100, []take{{0, 300}}, 2 * time.Second},
+		{"paid off while waiting", 1000, []take{{0, 1500}, {500 * time.Millisecond, 100}}, 100 * time.Millisecond},
+		{"burst refills", 1000, []take{{0, 1000}, {time.Second, 1000}}, 0},
+		{"burst is capped", 1000, []take{{0, 0}, {time.Hour, 1500}}, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		l, c := testLimiter(tt.rate)
+		var got time.Duration
+		for _, take := range tt.takes {
+			c.advance(take.after)
+			got = l.reserve(take.n)
+		}
+		if got != tt.want {
+			t.Errorf("%v: delay %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l, _ := testLimiter(1000)
+	l.SetRate(100)
+	if l.Rate() != 100 {
+		t.Fatalf("rate %d after SetRate(100)", l.Rate())
+	}
+	// the burst shrinks with the rate
+	if got := l.reserve(200); got != time.Second {
+		t.Errorf("delay %v, want 1s", got)
+	}
+
+	l.SetRate(0)
+	if got := l.reserve(1 << 20); got != 0 {
+		t.Errorf("delay %v without a limit", got)
+	}
+}
+
+func TestReserveAllTakesLongest(t *testing.T) {
+	slow, _ := testLimiter(1000)
+	fast, _ := testLimiter(10000)
+	slow.reserve(1000)
+	fast.reserve(10000)
+
+	// 100ms for slow and 10ms for fast, not both
+	if got := reserveAll([]*Limiter{slow, fast}, 100); got != 100*time.Millisecond {
+		t.Errorf("delay %v, want 100ms", got)
+	}
+	// both were charged
+	if got := fast.reserve(0); got != 10*time.Millisecond {
+		t.Errorf("fast limiter %v in debt, want 10ms", got)
+	}
+	if got := slow.reserve(0); got != 100*time.Millisecond {
+		t.Errorf("slow limiter %v in debt, want 100ms", got)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	l := NewLimiter(1000)
+	l.reserve(1000)
+
+	started := time.Now()
+	if err := waitAll(context.Background(), []*Limiter{l}, 50); err != nil {
+		t.Fatal(err)
+	}
+	// a loaded machine only makes it later
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Errorf("waited %v, want about 50ms", elapsed)
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	l := NewLimiter(10)
+	l.reserve(1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 1); err != context.Canceled {
+		t.Errorf("WaitN after cancel = %v", err)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	l := NewLimiter(64 * 1024)
+	var out bytes.Buffer
+	w := NewThrottledWriter(context.Background(), &out, l)
+
+	started := time.Now()
+	n, err := w.Write(make([]byte, 96*1024))
+	if err != nil || n != 96*1024 || out.Len() != n {
+		t.Fatalf("Write = %d, %v with %d bytes out", n, err, out.Len())
+	}
+	// the first 64 KiB are the burst, the rest takes half a second
+	if elapsed := time.Since(started); elapsed < 450*time.Millisecond {
+		t.Errorf("96 KiB at 64 KiB/s took %v", elapsed)
+	}
+}
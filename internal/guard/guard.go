@@ -0,0 +1,228 @@
+package guard
+
+import (
+	"errors"
+	"fmt"
+	"jamserver/internal/config"
+	"jamserver/pkg/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	KindIP   = "ip"
+	KindUser = "user"
+)
+
+// keptFailures is how long failures are remembered without a window
+const keptFailures = 24 * time.Hour
+
+// Ban blocks logins from an IP or to an account, zero Until means until
+// an admin lifts it
+type Ban struct {
+	Kind     string    `json:"kind"`
+	Target   string    `json:"target"`
+	Until    time.Time `json:"until,omitempty"`
+	Reason   string    `json:"reason"`
+	Failures int       `json:"failures,omitempty"`
+}
+
+func (b Ban) Expired(now time.Time) bool {
+	return !b.Until.IsZero() && now.After(b.Until)
+}
+
+type failures struct {
+	count int
+	last  time.Time
+}
+
+// Guard counts failed logins per IP and per account and keeps the ban list,
+// bans are saved to disk so they survive restarts
+type Guard struct {
+	mu        sync.Mutex
+	path      string
+	failures  map[string]*failures // kind + ":" + target
+	lastPrune time.Time
+	bans      map[string]Ban
+}
+
+func key(kind string, target string) string {
+	return kind + ":" + target
+}
+
+// Load reads the ban list, a missing file is an empty list
+func Load(path string) (*Guard, error) {
+	g := &Guard{
+		path:     path,
+		failures: make(map[string]*failures),
+		bans:     make(map[string]Ban),
+	}
+
+	bans, err := utils.LoadJSON[[]Ban](path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading ban list error: %w", err)
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		if !ban.Expired(now) {
+			g.bans[key(ban.Kind, ban.Target)] = ban
+		}
+	}
+	return g, nil
+}
+
+// caller holds mu
+func (g *Guard) save() error {
+	bans := make([]Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		bans = append(bans, ban)
+	}
+	return utils.SaveJSON(g.path, bans)
+}
+
+// caller holds mu
+func (g *Guard) banned(kind string, target string, now time.Time) (Ban, bool) {
+	ban, ok := g.bans[key(kind, target)]
+	if !ok {
+		return Ban{}, false
+	}
+	if ban.Expired(now) {
+		delete(g.bans, key(kind, target))
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// Banned reports an active ban for the IP or the login, login can be empty
+func (g *Guard) Banned(ip string, login string) (Ban, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if ban, ok := g.banned(KindIP, ip, now); ok {
+		return ban, true
+	}
+	if login == "" {
+		return Ban{}, false
+	}
+	return g.banned(KindUser, login, now)
+}
+
+// prune drops the failures outside the window, a spray from many addresses
+// would grow the map without end. Caller holds mu.
+func (g *Guard) prune(window time.Duration, now time.Time) {
+	if window <= 0 {
+		window = keptFailures
+	}
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	for k, f := range g.failures {
+		if now.Sub(f.last) > window {
+			delete(g.failures, k)
+		}
+	}
+	g.lastPrune = now
+}
+
+// caller holds mu
+func (g *Guard) count(kind string, target string, window time.Duration, now time.Time) int {
+	k := key(kind, target)
+	f, ok := g.failures[k]
+	if !ok || (window > 0 && now.Sub(f.last) > window) {
+		f = &failures{}
+		g.failures[k] = f
+	}
+	f.count++
+	f.last = now
+	return f.count
+}
+
+// Failure records a failed login and returns how long to hold back the
+// reply, and the ban if this failure crossed a limit
+func (g *Guard) Failure(ip string, login string, policy config.Login) (time.Duration, *Ban, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	window := time.Duration(policy.FailureWindowSeconds) * time.Second
+	g.prune(window, now)
+
+	ipFailures := g.count(KindIP, ip, window, now)
+	worst := ipFailures
+	userFailures := 0
+	if login != "" {
+		userFailures = g.count(KindUser, login, window, now)
+		worst = max(worst, userFailures)
+	}
+
+	delay := min(time.Duration(policy.DelayStepMillis*worst)*time.Millisecond, time.Duration(policy.MaxDelayMillis)*time.Millisecond)
+
+	var ban *Ban
+	until := now.Add(time.Duration(policy.LockoutSeconds) * time.Second)
+	switch {
+	case policy.MaxFailuresPerIP > 0 && ipFailures >= policy.MaxFailuresPerIP:
+		ban = &Ban{Kind: KindIP, Target: ip, Until: until, Reason: "too many failed logins", Failures: ipFailures}
+	case policy.MaxFailuresPerUser > 0 && userFailures >= policy.MaxFailuresPerUser:
+		ban = &Ban{Kind: KindUser, Target: login, Until: until, Reason: "too many failed logins", Failures: userFailures}
+	}
+
+	if ban == nil || policy.LockoutSeconds == 0 {
+		return delay, nil, nil
+	}
+
+	g.bans[key(ban.Kind, ban.Target)] = *ban
+	delete(g.failures, key(ban.Kind, ban.Target))
+	return delay, ban, g.save()
+}
+
+// Success clears the failure counters of the IP and the account
+func (g *Guard) Success(ip string, login string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.failures, key(KindIP, ip))
+	delete(g.failures, key(KindUser, login))
+}
+
+// Bans lists active bans
+func (g *Guard) Bans() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+func (g *Guard) Ban(ban Ban) error {
+	if ban.Kind != KindIP && ban.Kind != KindUser {
+		return fmt.Errorf("unknown ban kind: %q", ban.Kind)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.bans[key(ban.Kind, ban.Target)] = ban
+	return g.save()
+}
+
+// Unban lifts a ban and forgets the failures, false if there was no such ban
+func (g *Guard) Unban(kind string, target string) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.failures, key(kind, target))
+	if _, ok := g.bans[key(kind, target)]; !ok {
+		return false, nil
+	}
+	delete(g.bans, key(kind, target))
+	return true, g.save()
+}
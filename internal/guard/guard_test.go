@@ -0,0 +1,162 @@
+package guard
+
+import (
+	"jamserver/internal/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newGuard(t *testing.T) *Guard {
+	g, err := Load(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestFailureLockout(t *testing.T) {
+	policy := config.Login{
+		MaxFailuresPerIP:     4,
+		MaxFailuresPerUser:   3,
+		FailureWindowSeconds: 60,
+		LockoutSeconds:       600,
+		DelayStepMillis:      100,
+		MaxDelayMillis:       250,
+	}
+
+	tests := []struct {
+		name      string
+		ip, login string
+		wantDelay time.Duration
+		wantBan   string // kind of the ban this failure brings, "" for none
+	}{
+		{"first", "10.0.0.1", "alice", 100 * time.Millisecond, ""},
+		{"second", "10.0.0.2", "alice", 200 * time.Millisecond, ""},
+		{"delay capped, user locked", "10.0.0.3", "alice", 250 * time.Millisecond, KindUser},
+		{"other user, ip counts on", "10.0.0.1", "bob", 200 * time.Millisecond, ""},
+		{"no login", "10.0.0.1", "", 250 * time.Millisecond, ""},
+		{"ip locked", "10.0.0.1", "carol", 250 * time.Millisecond, KindIP},
+	}
+
+	g := newGuard(t)
+	for _, tt := range tests {
+		delay, ban, err := g.Failure(tt.ip, tt.login, policy)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if delay != tt.wantDelay {
+			t.Errorf("%v: delay %v, want %v", tt.name, delay, tt.wantDelay)
+		}
+		switch {
+		case tt.wantBan == "" && ban != nil:
+			t.Errorf("%v: unexpected ban %+v", tt.name, *ban)
+		case tt.wantBan != "" && (ban == nil || ban.Kind != tt.wantBan):
+			t.Errorf("%v: ban %+v, want a %v ban", tt.name, ban, tt.wantBan)
+		}
+	}
+
+	if _, banned := g.Banned("10.0.0.9", "alice"); !banned {
+		t.Error("alice is not banned")
+	}
+	if _, banned := g.Banned("10.0.0.1", ""); !banned {
+		t.Error("10.0.0.1 is not banned")
+	}
+	if _, banned := g.Banned("10.0.0.2", "bob"); banned {
+		t.Error("bob is banned")
+	}
+
+	// the ban list survives a restart
+	reloaded, err := Load(g.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Bans()) != 2 {
+		t.Errorf("%d bans after reload, want 2", len(reloaded.Bans()))
+	}
+}
+
+func TestNoLockout(t *testing.T) {
+	g := newGuard(t)
+	policy := config.Login{MaxFailuresPerUser: 1}
+	for range 3 {
+		if _, ban, _ := g.Failure("10.0.0.1", "alice", policy); ban != nil {
+			t.Fatalf("ban %+v with lockout_seconds 0", *ban)
+		}
+	}
+	if _, banned := g.Banned("10.0.0.1", "alice"); banned {
+		t.Error("alice banned with lockout_seconds 0")
+	}
+}
+
+func TestWindowAndSuccess(t *testing.T) {
+	g := newGuard(t)
+	policy := config.Login{MaxFailuresPerUser: 2, FailureWindowSeconds: 60, LockoutSeconds: 60}
+
+	g.Failure("10.0.0.1", "alice", policy)
+	g.failures[key(KindUser, "alice")].last = time.Now().Add(-2 * time.Minute)
+	if _, ban, _ := g.Failure("10.0.0.1", "alice", policy); ban != nil {
+		t.Error("a failure outside the window counted")
+	}
+
+	g.Success("10.0.0.1", "alice")
+	if _, ban, _ := g.Failure("10.0.0.1", "alice", policy); ban != nil {
+		t.Error("failures before a successful login counted")
+	}
+}
+
+func TestExpiredBan(t *testing.T) {
+	g := newGuard(t)
+	g.Ban(Ban{Kind: KindIP, Target: "10.0.0.1", Until: time.Now().Add(-time.Second)})
+	g.Ban(Ban{Kind: KindUser, Target: "alice"}) // until lifted
+
+	if _, banned := g.Banned("10.0.0.1", ""); banned {
+		t.Error("expired ban still holds")
+	}
+	if _, banned := g.Banned("10.0.0.2", "alice"); !banned {
+		t.Error("permanent ban does not hold")
+	}
+
+	if lifted, err := g.Unban(KindUser, "alice"); !lifted || err != nil {
+		t.Errorf("Unban = %v, %v", lifted, err)
+	}
+	if lifted, _ := g.Unban(KindUser, "alice"); lifted {
+		t.Error("lifted a ban twice")
+	}
+	if err := g.Ban(Ban{Kind: "host", Target: "x"}); err == nil {
+		t.Error("ban of unknown kind accepted")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		window int
+		age    time.Duration
+		kept   bool
+	}{
+		{"within the window", 60, 30 * time.Second, true},
+		{"past the window", 60, 2 * time.Minute, false},
+		{"no window, recent", 0, time.Hour, true},
+		{"no window, a day old", 0, keptFailures + time.Minute, false},
+	}
+	for _, tt := range tests {
+		g := newGuard(t)
+		policy := config.Login{FailureWindowSeconds: tt.window}
+		g.Failure("10.0.0.1", "", policy)
+		g.failures[key(KindIP, "10.0.0.1")].last = time.Now().Add(-tt.age)
+
+		// a failure from somewhere else within a minute leaves them
+		g.Failure("10.0.0.2", "", policy)
+		if _, kept := g.failures[key(KindIP, "10.0.0.1")]; !kept {
+			t.Errorf("%v: swept twice within a minute", tt.name)
+		}
+		// and sweeps the old ones out once it's over
+		g.lastPrune = g.lastPrune.Add(-time.Minute)
+		g.Failure("10.0.0.2", "", policy)
+		if _, kept := g.failures[key(KindIP, "10.0.0.1")]; kept != tt.kept {
+			t.Errorf("%v: kept %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+
+}
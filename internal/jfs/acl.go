@@ -0,0 +1,193 @@
+package jfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// NOTE: directory access lists, kept as "acl" on the directory entries of
+// filesystem.json
+
+// Operation is what an ACL entry allows, the names match the user permissions
+type Operation string
+
+const (
+	OpList   Operation = "list"
+	OpRead   Operation = "read"
+	OpWrite  Operation = "write"
+	OpDelete Operation = "delete"
+	OpRename Operation = "rename"
+	OpMkdir  Operation = "mkdir"
+	OpChmod  Operation = "chmod"
+)
+
+var Operations = []Operation{OpList, OpRead, OpWrite, OpDelete, OpRename, OpMkdir, OpChmod}
+
+var ErrDenied = errors.New("access denied")
+
+// ACLEntry allows operations in a directory to a login, a "@group" or "*" for
+// everyone, subdirectories inherit it unless NoInherit is set
+type ACLEntry struct {
+	Who       string      `json:"who"`
+	Allow     []Operation `json:"allow"`
+	NoInherit bool        `json:"no_inherit,omitempty"`
+}
+
+// ParseACLEntry reads "who=op,op", an empty op list allows nothing
+func ParseACLEntry(value string, inherit bool) (ACLEntry, error) {
+	who, ops, found := strings.Cut(value, "=")
+	who = strings.TrimSpace(who)
+	if !found || who == "" || who == "@" {
+		return ACLEntry{}, fmt.Errorf("invalid acl entry %q, use who=op,op", value)
+	}
+
+	entry := ACLEntry{Who: who, Allow: []Operation{}, NoInherit: !inherit}
+	for _, op := range strings.Split(ops, ",") {
+		op = strings.ToLower(strings.TrimSpace(op))
+		switch {
+		case op == "":
+		case op == "all":
+			entry.Allow = slices.Clone(Operations)
+		case slices.Contains(Operations, Operation(op)):
+			if !slices.Contains(entry.Allow, Operation(op)) {
+				entry.Allow = append(entry.Allow, Operation(op))
+			}
+		default:
+			return ACLEntry{}, fmt.Errorf("unknown operation %q in acl entry %q", op, value)
+		}
+	}
+	return entry, nil
+}
+
+func (e ACLEntry) Validate() error {
+	if e.Who == "" || e.Who == "@" {
+		return errors.New("acl entry without who")
+	}
+	for _, op := range e.Allow {
+		if !slices.Contains(Operations, op) {
+			return fmt.Errorf("unknown operation %q in acl entry for %v", op, e.Who)
+		}
+	}
+	return nil
+}
+
+func (e ACLEntry) String() string {
+	ops := make([]string, 0, len(e.Allow))
+	for _, op := range e.Allow {
+		ops = append(ops, string(op))
+	}
+	s := e.Who + "=" + strings.Join(ops, ",")
+	if e.NoInherit {
+		s += " (this directory only)"
+	}
+	return s
+}
+
+// ACLs returns every directory with an access list
+func (x *Index) ACLs() (map[string][]ACLEntry, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	lists := make(map[string][]ACLEntry)
+	collectACLs(x.tree, "", lists)
+	return lists, nil
+}
+
+func collectACLs(node *FileMetadata, name string, lists map[string][]ACLEntry) {
+	if len(node.ACL) > 0 {
+		lists[name] = node.ACL
+	}
+	for childName, child := range node.Children {
+		collectACLs(child, path.Join(name, childName), lists)
+	}
+}
+
+// Allowed decides op in dir (a backend name) for a user. The closest directory
+// with an entry for the user decides, the directory itself or a parent with an
+// inherited entry. Within it a login entry beats the groups, which beat "*".
+// Without any entry the operation is allowed.
+func (x *Index) Allowed(dir string, login string, groups []string, op Operation) (bool, error) {
+	rel := cleanPath(dir)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return false, err
+	}
+
+	// directories without a node have no entries, they inherit all the same
+	nodes := x.lookup(rel)
+	depth := strings.Count(rel, "/") + 1
+	if rel == "" {
+		depth = 0
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		inherited := i < depth
+		if allow, found := decide(nodes[i].ACL, inherited, login, groups); found {
+			return slices.Contains(allow, op), nil
+		}
+	}
+	return true, nil
+}
+
+// decide picks the entries of one directory that apply to the user
+func decide(entries []ACLEntry, inherited bool, login string, groups []string) ([]Operation, bool) {
+	var user, group, everyone []Operation
+	var userFound, groupFound, everyoneFound bool
+	for _, entry := range entries {
+		if inherited && entry.NoInherit {
+			continue
+		}
+		switch {
+		case entry.Who == login:
+			user, userFound = append(user, entry.Allow...), true
+		case strings.HasPrefix(entry.Who, "@") && slices.Contains(groups, entry.Who[1:]):
+			group, groupFound = append(group, entry.Allow...), true
+		case entry.Who == "*":
+			everyone, everyoneFound = append(everyone, entry.Allow...), true
+		}
+	}
+
+	switch {
+	case userFound:
+		return user, true
+	case groupFound:
+		return group, true
+	}
+	return everyone, everyoneFound
+}
+
+// SetACL replaces the access list of dir (relative to the root), no entries
+// removes it. The directory has to exist.
+func (x *Index) SetACL(dir string, entries []ACLEntry) error {
+	for _, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	dir = cleanPath(dir)
+	info, err := x.backend.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	node := x.ensure(dir, true, info.ModTime())
+	node.ACL = nil
+	if len(entries) > 0 {
+		node.ACL = entries
+	}
+	return x.save()
+}
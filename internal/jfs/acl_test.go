@@ -0,0 +1,129 @@
+package jfs
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseACLEntry(t *testing.T) {
+	tests := []struct {
+		value   string
+		inherit bool
+		want    string
+		err     bool
+	}{
+		{"alice=read,list", true, "alice=read,list", false},
+		{" @staff = Write , write ", true, "@staff=write", false},
+		{"*=", false, "*= (this directory only)", false},
+		{"bob=all", true, "bob=list,read,write,delete,rename,mkdir,chmod", false},
+		{"bob=fly", true, "", true},
+		{"=read", true, "", true},
+		{"@=read", true, "", true},
+		{"alice", true, "", true},
+	}
+	for _, tt := range tests {
+		entry, err := ParseACLEntry(tt.value, tt.inherit)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseACLEntry(%q) error %v", tt.value, err)
+			continue
+		}
+		if err == nil && entry.String() != tt.want {
+			t.Errorf("ParseACLEntry(%q) = %v, want %v", tt.value, entry, tt.want)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	entries := []ACLEntry{
+		{Who: "*", Allow: []Operation{OpList}},
+		{Who: "@staff", Allow: []Operation{OpList, OpRead}},
+		{Who: "@dev", Allow: []Operation{OpWrite}},
+		{Who: "alice", Allow: []Operation{OpDelete}},
+		{Who: "alice", Allow: []Operation{OpRename}, NoInherit: true},
+		{Who: "@staff", Allow: []Operation{OpMkdir}, NoInherit: true},
+	}
+
+	tests := []struct {
+		name      string
+		login     string
+		groups    []string
+		inherited bool
+		want      []Operation
+		found     bool
+	}{
+		{"login beats groups", "alice", []string{"staff"}, false, []Operation{OpDelete, OpRename}, true},
+		{"inherited login", "alice", []string{"staff"}, true, []Operation{OpDelete}, true},
+		{"groups add up", "bob", []string{"staff", "dev"}, false, []Operation{OpList, OpRead, OpWrite, OpMkdir}, true},
+		{"inherited group", "bob", []string{"staff"}, true, []Operation{OpList, OpRead}, true},
+		{"everyone", "carol", nil, false, []Operation{OpList}, true},
+		{"other group", "carol", []string{"guests"}, true, []Operation{OpList}, true},
+	}
+	for _, tt := range tests {
+		got, found := decide(entries, tt.inherited, tt.login, tt.groups)
+		if found != tt.found || !slices.Equal(got, tt.want) {
+			t.Errorf("%v: %v, %v, want %v, %v", tt.name, got, found, tt.want, tt.found)
+		}
+	}
+
+	if _, found := decide(entries[1:4], false, "carol", nil); found {
+		t.Error("entries for others decided for carol")
+	}
+	// a login entry allowing nothing still decides
+	if got, found := decide([]ACLEntry{{Who: "*", Allow: []Operation{OpRead}}, {Who: "carol"}}, false, "carol", nil); !found || len(got) != 0 {
+		t.Errorf("empty entry: %v, %v", got, found)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	backend := NewMemoryBackend()
+	for _, dir := range []string{"pub", "pub/docs", "pub/docs/old", "team", "team/private"} {
+		backend.Mkdir(dir)
+	}
+	x := NewIndex(backend, filepath.Join(t.TempDir(), "filesystem.json"))
+
+	acls := map[string][]ACLEntry{
+		"pub":          {{Who: "*", Allow: []Operation{OpList, OpRead}}, {Who: "@staff", Allow: Operations}},
+		"pub/docs":     {{Who: "alice", Allow: []Operation{OpList}}},
+		"team":         {{Who: "@staff", Allow: Operations}, {Who: "*", Allow: []Operation{OpList}, NoInherit: true}},
+		"team/private": {{Who: "bob", Allow: []Operation{OpList, OpRead}}},
+	}
+	for dir, entries := range acls {
+		if err := x.SetACL(dir, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		dir    string
+		login  string
+		groups []string
+		op     Operation
+		want   bool
+	}{
+		{"", "carol", nil, OpWrite, true},
+		{"pub", "carol", nil, OpRead, true},
+		{"pub", "carol", nil, OpWrite, false},
+		{"pub", "bob", []string{"staff"}, OpWrite, true},
+		{"pub/docs/old", "carol", nil, OpRead, true},
+		{"pub/docs", "alice", []string{"staff"}, OpRead, false},
+		{"pub/docs/old", "alice", []string{"staff"}, OpList, true},
+		{"pub/docs/old", "alice", []string{"staff"}, OpWrite, false},
+		{"pub/docs/new", "bob", []string{"staff"}, OpDelete, true},
+		{"team", "carol", nil, OpList, true},
+		{"team/private", "carol", nil, OpList, true},
+		{"team/private/x", "carol", nil, OpList, true},
+		{"team/private", "bob", []string{"staff"}, OpWrite, false},
+		{"team/private", "dave", []string{"staff"}, OpWrite, true},
+		{"/team/../pub", "carol", nil, OpWrite, false},
+	}
+	for _, tt := range tests {
+		got, err := x.Allowed(tt.dir, tt.login, tt.groups, tt.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%v %v in /%v = %v, want %v", tt.login, tt.op, tt.dir, got, tt.want)
+		}
+	}
+}
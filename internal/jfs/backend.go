@@ -0,0 +1,252 @@
+package jfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NOTE: where the bytes live. FileSystem does permissions, metadata and
+// quotas on top, a Backend only stores files and directories.
+
+// Backend is the storage of a FileSystem. Names are slash separated and
+// relative to the root of the backend, "" is the root itself. A missing file
+// gives an error matching fs.ErrNotExist.
+type Backend interface {
+	Stat(name string) (fs.FileInfo, error)
+	// Open reads a file, seeking lets a transfer start in the middle
+	Open(name string) (io.ReadSeekCloser, error)
+	// Create writes a file from offset on, the first offset bytes of the file
+	// are kept and everything after them is replaced; offset 0 creates the
+	// file or empties it. The content is complete once Close returned nil,
+	// a writer with Abort (aborter) can also give up and leave the file as
+	// it was.
+	Create(name string, offset int64) (io.WriteCloser, error)
+	// Remove deletes a file or an empty directory
+	Remove(name string) error
+	// Rename moves a file or directory, a file at newName is replaced
+	Rename(oldName string, newName string) error
+	// Mkdir creates a directory, the root with its parents
+	Mkdir(name string) error
+	// ReadDir lists a directory sorted by name
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// aborter is a writer of Create which can drop what it was given
+type aborter interface {
+	Abort() error
+}
+
+// mkdirAll creates name and the directories above it
+func mkdirAll(backend Backend, name string) error {
+	name = cleanPath(name)
+	if name != "" {
+		if err := mkdirAll(backend, parentOf(name)); err != nil {
+			return err
+		}
+	}
+	info, err := backend.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", name)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := backend.Mkdir(name); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// LocalBackend keeps the files in a directory on the local disk
+type LocalBackend struct {
+	Root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{Root: root}
+}
+
+func (b *LocalBackend) String() string {
+	return b.Root
+}
+
+// path maps a name into the root, ".." can't climb out
+func (b *LocalBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(cleanPath(name)))
+}
+
+func (b *LocalBackend) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(b.path(name))
+}
+
+func (b *LocalBackend) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(b.path(name))
+}
+
+func (b *LocalBackend) Create(name string, offset int64) (io.WriteCloser, error) {
+	if offset == 0 {
+		return b.createTemp(name)
+	}
+
+	file, err := os.OpenFile(b.path(name), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && offset > info.Size() {
+		err = fmt.Errorf("offset %d is beyond end of file (%d bytes)", offset, info.Size())
+	}
+	if err == nil {
+		err = file.Truncate(offset)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// uploadPrefix starts the names of the files new uploads are written to
+// next to their target, ReadDir leaves them out. Clients can't use it, see
+// reservedName.
+const uploadPrefix = ".jam-upload-"
+
+// reservedName tells if a part of name starts with uploadPrefix, such a file
+// would be hidden from LIST and the watcher and removed behind the index
+func reservedName(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, uploadPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// localWriter writes a new version of a file next to it, Close puts it in
+// place so a failed upload never destroys the old content
+type localWriter struct {
+	*os.File
+	path    string
+	existed bool
+}
+
+func (b *LocalBackend) createTemp(name string) (io.WriteCloser, error) {
+	target := b.path(name)
+	mode := os.FileMode(0644)
+	info, err := os.Stat(target)
+	if err == nil {
+		if info.IsDir() {
+			return nil, &fs.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+		}
+		mode = info.Mode().Perm()
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(target), uploadPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &localWriter{File: file, path: target, existed: info != nil}, nil
+}
+
+func (w *localWriter) Close() error {
+	err := w.File.Close()
+	if err == nil {
+		err = os.Rename(w.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+	}
+	return err
+}
+
+// Abort drops the new version. A file that didn't exist before keeps what
+// arrived, REST can resume it.
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	defer os.Remove(w.Name())
+	if w.existed {
+		return nil
+	}
+	// unlike a rename a link doesn't replace what somebody else stored meanwhile
+	if err := os.Link(w.Name(), w.path); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) Remove(name string) error {
+	return os.Remove(b.path(name))
+}
+
+func (b *LocalBackend) Rename(oldName string, newName string) error {
+	return os.Rename(b.path(oldName), b.path(newName))
+}
+
+func (b *LocalBackend) Mkdir(name string) error {
+	if cleanPath(name) == "" {
+		return os.MkdirAll(b.Root, 0755)
+	}
+	return os.Mkdir(b.path(name), 0755)
+}
+
+// ReadDir leaves out the files of running uploads, the ones a crash left
+// behind are removed after a day
+func (b *LocalBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := os.ReadDir(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		if !strings.HasPrefix(entry.Name(), uploadPrefix) {
+			return false
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleUpload {
+			os.Remove(filepath.Join(b.path(name), entry.Name()))
+		}
+		return true
+	}), nil
+}
+
+func (b *LocalBackend) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(b.path(name), atime, mtime)
+}
+
+// fileInfo is the fs.FileInfo of backends which don't have one of their own
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
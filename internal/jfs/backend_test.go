@@ -0,0 +1,310 @@
+package jfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// every backend has to pass the same tests, the ones needing a server of
+// their own add themselves in their test files
+var testBackends = map[string]func(t *testing.T) Backend{
+	"local":  func(t *testing.T) Backend { return NewLocalBackend(t.TempDir()) },
+	"memory": func(t *testing.T) Backend { return NewMemoryBackend() },
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, b Backend)) {
+	for name, newBackend := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			test(t, newBackend(t))
+		})
+	}
+}
+
+func writeFile(t *testing.T, b Backend, name string, data string) {
+	t.Helper()
+	w, err := b.Create(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, b Backend, name string) string {
+	t.Helper()
+	r, err := b.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBackendCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string // "" for no file
+		offset int64
+		write  string
+		want   string
+		err    bool
+	}{
+		{"new", "", 0, "abc", "abc", false},
+		{"replace", "hello", 0, "j", "j", false},
+		{"empty", "hello", 0, "", "", false},
+		{"restart", "hello", 2, "LP", "heLP", false},
+		{"restart at the end", "hello", 5, "!", "hello!", false},
+		{"restart past the end", "hello", 6, "!", "", true},
+		{"restart a missing file", "", 3, "!", "", true},
+	}
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		for _, tt := range tests {
+			if tt.before != "" {
+				writeFile(t, b, tt.name, tt.before)
+			}
+			w, err := b.Create(tt.name, tt.offset)
+			if tt.err {
+				if err == nil {
+					w.Close()
+					t.Errorf("%v: no error", tt.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			io.WriteString(w, tt.write)
+			if err := w.Close(); err != nil {
+				t.Fatalf("%v: close: %v", tt.name, err)
+			}
+			if got := readFile(t, b, tt.name); got != tt.want {
+				t.Errorf("%v: %q, want %q", tt.name, got, tt.want)
+			}
+			if info, err := b.Stat(tt.name); err != nil || info.Size() != int64(len(tt.want)) || info.IsDir() {
+				t.Errorf("%v: stat %v, %v", tt.name, info, err)
+			}
+		}
+
+		if _, err := b.Create("missing/file", 0); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("create in a missing directory: %v", err)
+		}
+		if _, err := b.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stat of a missing file: %v", err)
+		}
+	})
+}
+
+func TestBackendRename(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		b.Mkdir("a")
+		b.Mkdir("a/b")
+		b.Mkdir("d")
+		writeFile(t, b, "a/x", "x")
+		writeFile(t, b, "a/b/y", "y")
+
+		// directories move with everything below them
+		if err := b.Rename("a", "d/c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Stat("a"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("a still there: %v", err)
+		}
+		if got := readFile(t, b, "d/c/b/y"); got != "y" {
+			t.Errorf("d/c/b/y is %q", got)
+		}
+		if names := dirNames(t, b, "d/c"); !slices.Equal(names, []string{"b", "x"}) {
+			t.Errorf("d/c has %q", names)
+		}
+
+		// a file is replaced
+		writeFile(t, b, "z", "z")
+		if err := b.Rename("d/c/x", "z"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, b, "z"); got != "x" {
+			t.Errorf("z is %q after the rename over it", got)
+		}
+		if err := b.Rename("gone", "there"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("rename of a missing file: %v", err)
+		}
+	})
+}
+
+func dirNames(t *testing.T, b Backend, dir string) []string {
+	t.Helper()
+	entries, err := b.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestBackendReadDir(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		for _, name := range []string{"b", "a1", "C", "a"} {
+			writeFile(t, b, name, name)
+		}
+		b.Mkdir("m")
+		writeFile(t, b, "m/inner", "")
+
+		entries, err := b.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+			if entry.IsDir() != (entry.Name() == "m") {
+				t.Errorf("%v: IsDir %v", entry.Name(), entry.IsDir())
+			}
+		}
+		if want := []string{"C", "a", "a1", "b", "m"}; !slices.Equal(names, want) {
+			t.Errorf("ReadDir = %q, want %q", names, want)
+		}
+		if _, err := b.ReadDir("nothing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadDir of a missing directory: %v", err)
+		}
+	})
+}
+
+func TestBackendRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		b.Mkdir("full")
+		b.Mkdir("empty")
+		writeFile(t, b, "full/file", "data")
+
+		if err := b.Remove("full"); err == nil {
+			t.Error("removed a directory with a file in it")
+		}
+		if got := readFile(t, b, "full/file"); got != "data" {
+			t.Errorf("full/file is %q after the failed remove", got)
+		}
+		for _, name := range []string{"full/file", "full", "empty"} {
+			if err := b.Remove(name); err != nil {
+				t.Errorf("remove %v: %v", name, err)
+			}
+		}
+		if names := dirNames(t, b, ""); len(names) != 0 {
+			t.Errorf("left %q", names)
+		}
+		if err := b.Remove("full"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("remove of a missing file: %v", err)
+		}
+	})
+}
+
+func TestBackendReplace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		writeFile(t, b, "f", "old")
+
+		w, err := b.Create("f", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "new")
+		if got := readFile(t, b, "f"); got != "old" {
+			t.Errorf("f is %q while the upload runs", got)
+		}
+		if err := w.(aborter).Abort(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, b, "f"); got != "old" {
+			t.Errorf("f is %q after the abort", got)
+		}
+		if names := dirNames(t, b, ""); !slices.Equal(names, []string{"f"}) {
+			t.Errorf("left %q", names)
+		}
+
+		writeFile(t, b, "f", "new")
+		if got := readFile(t, b, "f"); got != "new" {
+			t.Errorf("f is %q", got)
+		}
+	})
+}
+
+func TestLocalUploadFiles(t *testing.T) {
+	root := t.TempDir()
+	b := NewLocalBackend(root)
+
+	w, err := b.Create("new", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "part")
+	if names := dirNames(t, b, ""); len(names) != 0 {
+		t.Errorf("the running upload shows up: %q", names)
+	}
+	// a new file keeps what arrived for REST
+	if err := w.(aborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, b, "new"); got != "part" {
+		t.Errorf("new is %q after the abort", got)
+	}
+
+	stale := filepath.Join(root, uploadPrefix+"crashed")
+	os.WriteFile(stale, []byte("x"), 0644)
+	os.Chtimes(stale, time.Now(), time.Now().Add(-staleUpload-time.Hour))
+	fresh := filepath.Join(root, uploadPrefix+"running")
+	os.WriteFile(fresh, []byte("x"), 0644)
+
+	if names := dirNames(t, b, ""); !slices.Equal(names, []string{"new"}) {
+		t.Errorf("ReadDir = %q", names)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("stale upload file kept")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("running upload file removed: %v", err)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+	backend.Mkdir("dir")
+	writeFile(t, backend, "dir/file", "x")
+	fs := &FileSystem{Backend: backend}
+
+	hidden := uploadPrefix + "x"
+	tests := []struct {
+		name string
+		do   func() error
+	}{
+		{"STOR", func() error { return fs.WriteFile(hidden, []byte("x")) }},
+		{"STOR in a subdirectory", func() error { return fs.WriteFile("dir/"+hidden, []byte("x")) }},
+		{"MKD", func() error { return fs.MakeDir(hidden) }},
+		{"STOR below MKD", func() error { return fs.WriteFile(hidden+"/file", []byte("x")) }},
+		{"RNTO", func() error { return fs.Rename("dir/file", "dir/"+hidden) }},
+		{"RNTO a directory", func() error { return fs.Rename("dir", hidden) }},
+	}
+	for _, tt := range tests {
+		if err := tt.do(); !errors.Is(err, ErrDenied) {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+	}
+	if names := dirNames(t, backend, "dir"); !slices.Equal(names, []string{"file"}) {
+		t.Errorf("dir has %q", names)
+	}
+	// a name merely containing the prefix is fine
+	if err := fs.WriteFile("my"+hidden, []byte("x")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,452 @@
+package jfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: content addressed storage. The content of every file is a blob
+// named by its SHA-256 and the index maps names to blobs ("sha256" on the
+// entries of filesystem.json), so the same upload a second time only costs
+// an entry. Blobs are kept in <dir>/<first two hex digits>/<hash>, uploads
+// are written to <dir>/tmp first. Collect deletes the blobs no entry points
+// at any more.
+
+const (
+	// staleUpload is how long an upload can sit in tmp without a write
+	// before Collect takes it for left behind
+	staleUpload = 24 * time.Hour
+	// blobGrace keeps Collect off new blobs, jamctl may collect next to a
+	// server which just linked one in an index jamctl read before
+	blobGrace = time.Hour
+)
+
+var errNoBlob = errors.New("no content stored")
+
+type DedupBackend struct {
+	dir   string
+	index *Index
+
+	mu sync.Mutex // uploads linking their blob against Collect
+
+	// entries per blob, counted again when the index reads a new tree.
+	// Guarded by the index mu.
+	refs    map[string]int
+	counted *FileMetadata
+}
+
+// NewDedupBackend keeps the blobs in dir, the names go into the index made
+// with it
+func NewDedupBackend(dir string) *DedupBackend {
+	return &DedupBackend{dir: dir}
+}
+
+func (b *DedupBackend) String() string {
+	return "dedup " + b.dir
+}
+
+func (b *DedupBackend) attach(x *Index) {
+	b.index = x
+}
+
+func (b *DedupBackend) blobPath(sum string) string {
+	return filepath.Join(b.dir, sum[:2], sum)
+}
+
+func dedupError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// refsOf returns the entries per blob, caller holds the index mu
+func (b *DedupBackend) refsOf() map[string]int {
+	if b.counted != b.index.tree {
+		b.refs = make(map[string]int)
+		countRefs(b.index.tree, b.refs)
+		b.counted = b.index.tree
+	}
+	return b.refs
+}
+
+func countRefs(node *FileMetadata, refs map[string]int) {
+	for _, child := range node.Children {
+		countRefs(child, refs)
+	}
+	if !node.IsDir() && node.Hash != "" {
+		refs[node.Hash]++
+	}
+}
+
+// unref takes node and everything below it out of the counts, caller holds
+// the index mu
+func (b *DedupBackend) unref(node *FileMetadata) {
+	refs := b.refsOf()
+	for _, child := range node.Children {
+		b.unref(child)
+	}
+	if node.IsDir() || node.Hash == "" {
+		return
+	}
+	if refs[node.Hash]--; refs[node.Hash] <= 0 {
+		delete(refs, node.Hash)
+	}
+}
+
+// dropUnhashed removes the files without a blob, left from another backend
+func dropUnhashed(node *FileMetadata) {
+	for name, child := range node.Children {
+		if child.IsDir() {
+			dropUnhashed(child)
+		} else if child.Hash == "" {
+			delete(node.Children, name)
+		}
+	}
+}
+
+func nodeInfo(name string, node *FileMetadata) fileInfo {
+	return fileInfo{name: path.Base("/" + name), size: node.Size, dir: node.IsDir(), modTime: node.LastModified}
+}
+
+func (b *DedupBackend) Stat(name string) (fs.FileInfo, error) {
+	name = cleanPath(name)
+	if name == "" {
+		// without the index, Reconcile holds its mu
+		if _, err := os.Stat(b.dir); err != nil {
+			return nil, err
+		}
+		return fileInfo{name: "/", dir: true}, nil
+	}
+
+	var info fs.FileInfo
+	err := b.index.update(func() error {
+		node := b.index.node(name)
+		if node == nil {
+			return dedupError("stat", name, fs.ErrNotExist)
+		}
+		info = nodeInfo(name, node)
+		return nil
+	})
+	return info, err
+}
+
+func (b *DedupBackend) Open(name string) (io.ReadSeekCloser, error) {
+	name = cleanPath(name)
+	var sum string
+	err := b.index.update(func() error {
+		node := b.index.node(name)
+		switch {
+		case node == nil:
+			return dedupError("open", name, fs.ErrNotExist)
+		case node.IsDir():
+			return dedupError("open", name, errors.New("is a directory"))
+		case node.Hash == "":
+			return dedupError("open", name, errNoBlob)
+		}
+		sum = node.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(b.blobPath(sum))
+}
+
+func (b *DedupBackend) Create(name string, offset int64) (io.WriteCloser, error) {
+	name = cleanPath(name)
+	var base string // the blob with the kept start
+	err := b.index.update(func() error {
+		if parent := b.index.node(parentOf(name)); parent == nil || !parent.IsDir() {
+			return dedupError("create", name, fs.ErrNotExist)
+		}
+		node := b.index.node(name)
+		switch {
+		case node != nil && node.IsDir():
+			return dedupError("create", name, errors.New("is a directory"))
+		case offset == 0:
+		case node == nil:
+			return dedupError("create", name, fs.ErrNotExist)
+		case node.Hash == "":
+			return dedupError("create", name, errNoBlob)
+		case offset > node.Size:
+			return fmt.Errorf("offset %d is beyond end of file (%d bytes)", offset, node.Size)
+		default:
+			base = node.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(filepath.Join(b.dir, "tmp"), "upload-")
+	if err != nil {
+		return nil, err
+	}
+	w := &dedupWriter{backend: b, name: name, file: file, hash: sha256.New()}
+	if offset == 0 {
+		return w, nil
+	}
+
+	// the new content is a new blob, starting with a copy of the kept bytes
+	blob, err := os.Open(b.blobPath(base))
+	if err == nil {
+		_, err = io.CopyN(w, blob, offset)
+		blob.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// dedupWriter hashes the upload while it goes to a temporary file, Close
+// turns that into a blob
+type dedupWriter struct {
+	backend *DedupBackend
+	name    string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *dedupWriter) Close() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return w.backend.link(w.name, w.file.Name(), hex.EncodeToString(w.hash.Sum(nil)), w.size)
+}
+
+// Abort throws the upload away, the file keeps its blob
+func (w *dedupWriter) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// link stores the upload in temp as the blob sum, unless it's there already,
+// and points name at it. The index is the only record of the names, it's
+// saved right away.
+func (b *DedupBackend) link(name string, temp string, sum string, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blob := b.blobPath(sum)
+	if _, err := os.Stat(blob); err == nil {
+		os.Remove(temp)
+		now := time.Now()
+		os.Chtimes(blob, now, now) // new again for blobGrace
+		slog.Debug("content stored already", "file", name, "sha256", sum)
+	} else {
+		err := os.MkdirAll(filepath.Dir(blob), 0755)
+		if err == nil {
+			err = os.Rename(temp, blob)
+		}
+		if err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+
+	return b.index.update(func() error {
+		x := b.index
+		node := x.node(name)
+		if node != nil && node.IsDir() {
+			return dedupError("create", name, errors.New("is a directory"))
+		}
+		if node == nil {
+			node = x.ensure(name, false, time.Now())
+		}
+		b.unref(node)
+		x.account(node, -1)
+		node.Hash, node.Size, node.LastModified = sum, size, time.Now()
+		b.refsOf()[sum]++
+		x.account(node, 1)
+		return x.save()
+	})
+}
+
+func (b *DedupBackend) Remove(name string) error {
+	name = cleanPath(name)
+	return b.index.update(func() error {
+		x := b.index
+		node := x.node(name)
+		switch {
+		case node == nil || name == "":
+			return dedupError("remove", name, fs.ErrNotExist)
+		case len(node.Children) > 0:
+			return dedupError("remove", name, errors.New("directory not empty"))
+		}
+		b.unref(node)
+		x.detach(name)
+		x.account(node, -1)
+		return x.save()
+	})
+}
+
+func (b *DedupBackend) Rename(oldName string, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	return b.index.update(func() error {
+		x := b.index
+		node := x.node(oldName)
+		if node == nil || oldName == "" {
+			return dedupError("rename", oldName, fs.ErrNotExist)
+		}
+		if oldName == newName {
+			return nil
+		}
+		parent := x.node(parentOf(newName))
+		if parent == nil || !parent.IsDir() || newName == "" {
+			return dedupError("rename", newName, fs.ErrNotExist)
+		}
+		if existing := x.node(newName); existing != nil {
+			if existing.IsDir() || node.IsDir() {
+				return dedupError("rename", newName, fs.ErrExist)
+			}
+			b.unref(existing)
+			x.detach(newName)
+			x.account(existing, -1)
+		}
+
+		x.detach(oldName)
+		_, base := splitPath(newName)
+		parent.child(base, node)
+		return x.save()
+	})
+}
+
+func (b *DedupBackend) Mkdir(name string) error {
+	name = cleanPath(name)
+	if name == "" {
+		return os.MkdirAll(filepath.Join(b.dir, "tmp"), 0755)
+	}
+	return b.index.update(func() error {
+		x := b.index
+		if x.node(name) != nil {
+			return dedupError("mkdir", name, fs.ErrExist)
+		}
+		if parent := x.node(parentOf(name)); parent == nil || !parent.IsDir() {
+			return dedupError("mkdir", name, fs.ErrNotExist)
+		}
+		x.ensure(name, true, time.Now())
+		return x.save()
+	})
+}
+
+func (b *DedupBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = cleanPath(name)
+	var entries []fs.DirEntry
+	err := b.index.update(func() error {
+		node := b.index.node(name)
+		if node == nil || !node.IsDir() {
+			return dedupError("readdir", name, fs.ErrNotExist)
+		}
+		for childName, child := range node.Children {
+			entries = append(entries, fs.FileInfoToDirEntry(nodeInfo(path.Join(name, childName), child)))
+		}
+		return nil
+	})
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, err
+}
+
+func (b *DedupBackend) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	name = cleanPath(name)
+	return b.index.update(func() error {
+		node := b.index.node(name)
+		if node == nil {
+			return dedupError("chtimes", name, fs.ErrNotExist)
+		}
+		node.LastModified = mtime
+		b.index.dirty = true
+		return nil
+	})
+}
+
+// Collect deletes the blobs no entry points at and uploads left behind in
+// tmp, it returns how many blobs went and the bytes they took
+func (b *DedupBackend) Collect() (blobs int, bytes int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	live := make(map[string]bool)
+	err = b.index.update(func() error {
+		for sum := range b.refsOf() {
+			live[sum] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = filepath.WalkDir(b.dir, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if filepath.Base(filepath.Dir(fullPath)) == "tmp" {
+			if time.Since(info.ModTime()) > staleUpload {
+				slog.Info("deleting stale upload", "path", fullPath)
+				os.Remove(fullPath)
+			}
+			return nil
+		}
+		if live[entry.Name()] {
+			delete(live, entry.Name())
+			return nil
+		}
+		if time.Since(info.ModTime()) < blobGrace {
+			return nil
+		}
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+		blobs++
+		bytes += info.Size()
+		return nil
+	})
+
+	for sum := range live {
+		slog.Error("blob of a file is missing", "sha256", sum)
+	}
+	return blobs, bytes, err
+}
+
+// CollectGarbage runs Collect every interval, for the lifetime of the server
+func (b *DedupBackend) CollectGarbage(interval time.Duration) {
+	for range time.Tick(interval) {
+		blobs, bytes, err := b.Collect()
+		if err != nil {
+			slog.Error("collecting unreferenced blobs failed", "dir", b.dir, "error", err)
+			continue
+		}
+		if blobs > 0 {
+			slog.Info("unreferenced blobs deleted", "dir", b.dir, "blobs", blobs, "bytes", bytes)
+		}
+	}
+}
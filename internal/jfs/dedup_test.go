@@ -0,0 +1,184 @@
+package jfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	testBackends["dedup"] = func(t *testing.T) Backend {
+		b, _ := newTestDedup(t)
+		return b
+	}
+}
+
+func newTestDedup(t *testing.T) (*DedupBackend, *Index) {
+	dir := t.TempDir()
+	b := NewDedupBackend(filepath.Join(dir, "blobs"))
+	x := NewIndex(b, filepath.Join(dir, "filesystem.json"))
+	if err := b.Mkdir(""); err != nil {
+		t.Fatal(err)
+	}
+	return b, x
+}
+
+func sum(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+// refs returns the entries per blob by content, from the counts kept along
+// and from a fresh count, which have to agree
+func refs(t *testing.T, b *DedupBackend, contents ...string) map[string]int {
+	t.Helper()
+	got := make(map[string]int)
+	b.index.update(func() error {
+		kept := b.refsOf()
+		counted := make(map[string]int)
+		countRefs(b.index.tree, counted)
+		for _, data := range contents {
+			if kept[sum(data)] != counted[sum(data)] {
+				t.Errorf("%q: %d entries counted along, %d in the tree", data, kept[sum(data)], counted[sum(data)])
+			}
+			if n := kept[sum(data)]; n > 0 {
+				got[data] = n
+			}
+		}
+		return nil
+	})
+	return got
+}
+
+func TestDedupRefs(t *testing.T) {
+	b, x := newTestDedup(t)
+	fs := &FileSystem{Backend: b, Index: x}
+
+	tests := []struct {
+		name string
+		do   func() error
+		want map[string]int
+	}{
+		{"upload", func() error { return fs.WriteFile("a", []byte("one")) }, map[string]int{"one": 1}},
+		{"same content", func() error { return fs.WriteFile("b", []byte("one")) }, map[string]int{"one": 2}},
+		{"link", func() error { return fs.WriteFile("c", []byte("one")) }, map[string]int{"one": 3}},
+		{"other content", func() error { return fs.WriteFile("d", []byte("two")) }, map[string]int{"one": 3, "two": 1}},
+		{"remove", func() error { return b.Remove("c") }, map[string]int{"one": 2, "two": 1}},
+		{"rename", func() error { return b.Rename("a", "e") }, map[string]int{"one": 2, "two": 1}},
+		{"rename over", func() error { return b.Rename("d", "b") }, map[string]int{"one": 1, "two": 1}},
+		{"upload over", func() error { return fs.WriteFile("e", []byte("two")) }, map[string]int{"two": 2}},
+		{"upload the same again", func() error { return fs.WriteFile("e", []byte("two")) }, map[string]int{"two": 2}},
+		{"remove the last", func() error { return b.Remove("b") }, map[string]int{"two": 1}},
+	}
+	for _, tt := range tests {
+		if err := tt.do(); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		got := refs(t, b, "one", "two")
+		if len(got) != len(tt.want) || got["one"] != tt.want["one"] || got["two"] != tt.want["two"] {
+			t.Errorf("%v: refs %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// blob writes data as a blob of its own, modified ago
+func blob(t *testing.T, b *DedupBackend, data string, ago time.Duration) string {
+	t.Helper()
+	path := b.blobPath(sum(data))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(-ago))
+	return path
+}
+
+func TestDedupCollect(t *testing.T) {
+	b, _ := newTestDedup(t)
+	writeFile(t, b, "old", "in use")
+	used := b.blobPath(sum("in use"))
+	os.Chtimes(used, time.Now(), time.Now().Add(-2*blobGrace))
+
+	stale := filepath.Join(b.dir, "tmp", "upload-crashed")
+	os.WriteFile(stale, []byte("x"), 0644)
+	os.Chtimes(stale, time.Now(), time.Now().Add(-staleUpload-time.Hour))
+	running := filepath.Join(b.dir, "tmp", "upload-running")
+	os.WriteFile(running, []byte("x"), 0644)
+
+	tests := []struct {
+		path string
+		kept bool
+	}{
+		{used, true},
+		{blob(t, b, "unreferenced", 2*blobGrace), false},
+		{blob(t, b, "just linked", blobGrace/2), true},
+		{stale, false},
+		{running, true},
+	}
+
+	blobs, bytes, err := b.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 1 || bytes != int64(len("unreferenced")) {
+		t.Errorf("Collect = %d blobs, %d bytes", blobs, bytes)
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(tt.path)
+		if kept := err == nil; kept != tt.kept || err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%v: kept %v, want %v (%v)", filepath.Base(tt.path), kept, tt.kept, err)
+		}
+	}
+	if got := readFile(t, b, "old"); got != "in use" {
+		t.Errorf("old is %q after Collect", got)
+	}
+}
+
+func TestDedupResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		write  string
+		want   string
+	}{
+		{"restart", 2, "LP", "heLP"},
+		{"append", 5, "!", "hello!"},
+		{"keep nothing", 0, "new", "new"},
+	}
+	for _, tt := range tests {
+		b, _ := newTestDedup(t)
+		writeFile(t, b, "f", "hello")
+		writeFile(t, b, "copy", "hello")
+
+		w, err := b.Create("f", tt.offset)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		io.WriteString(w, tt.write)
+		if err := w.Close(); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+
+		if got := readFile(t, b, "f"); got != tt.want {
+			t.Errorf("%v: f is %q, want %q", tt.name, got, tt.want)
+		}
+		// a new blob, the one of the other entry stays as it was
+		if got := readFile(t, b, "copy"); got != "hello" {
+			t.Errorf("%v: copy is %q", tt.name, got)
+		}
+		if got := refs(t, b, "hello", tt.want); got["hello"] != 1 || got[tt.want] != 1 {
+			t.Errorf("%v: refs %v", tt.name, got)
+		}
+		if info, err := b.Stat("f"); err != nil || info.Size() != int64(len(tt.want)) {
+			t.Errorf("%v: Stat = %v, %v", tt.name, info, err)
+		}
+	}
+}
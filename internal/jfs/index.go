@@ -0,0 +1,458 @@
+package jfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"jamserver/pkg/utils"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: filesystem.json is the metadata of the file system, what the disk
+// knows (type, size, times) next to what only the server knows (access lists,
+// owner and mode). Index keeps it in memory as the authority: every change
+// made through FileSystem updates it right away, it's written back every few
+// seconds and reconciled with the disk on startup.
+
+// Index is the metadata of one file system tree. Changes to the metadata file
+// by someone else (jamctl) are read in on the next use.
+type Index struct {
+	mu       sync.Mutex
+	backend  Backend // index paths are backend names
+	jsonPath string
+	tree     *FileMetadata
+	usage    map[string]Usage // by owner and "@group", files only
+	dirty    bool             // changed since the last save
+	modTime  time.Time        // of the metadata file as last read or written
+}
+
+func NewIndex(backend Backend, jsonPath string) *Index {
+	x := &Index{backend: backend, jsonPath: jsonPath}
+	if indexed, ok := backend.(indexedBackend); ok {
+		indexed.attach(x)
+	}
+	return x
+}
+
+// indexedBackend keeps its names in the index (DedupBackend), there is
+// nothing to reconcile the index with. Its methods take mu themselves but
+// Stat of the root, Reconcile asks for that with mu held.
+type indexedBackend interface {
+	Backend
+	attach(x *Index)
+}
+
+// Stat asks the backend of the index about name (relative to the root)
+func (x *Index) Stat(name string) (fs.FileInfo, error) {
+	return x.backend.Stat(cleanPath(name))
+}
+
+// update runs f with the index loaded and mu held
+func (x *Index) update(f func() error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	return f()
+}
+
+type metadataFile struct {
+	Backend string        `json:"backend,omitempty"` // what the index was written for
+	Root    *FileMetadata `json:"root"`
+}
+
+// loadMetadata reads the index in jsonPath, it has to be one of backend:
+// reconciled with another one (an empty bucket, a dedup store that keeps
+// its names in there) it would lose every entry
+func loadMetadata(jsonPath string, backend Backend) (*FileMetadata, error) {
+	metadata, err := utils.LoadJSON[metadataFile](jsonPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return newDirectory(time.Time{}), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata from %v error: %w", jsonPath, err)
+	}
+	if metadata.Backend != "" && metadata.Backend != fmt.Sprint(backend) {
+		return nil, fmt.Errorf("metadata in %v is of the backend %v, not %v: give each backend its own storage.metadata", jsonPath, metadata.Backend, backend)
+	}
+	if metadata.Root == nil {
+		return newDirectory(time.Time{}), nil
+	}
+	metadata.Root.Type = TypeDirectory
+	return metadata.Root, nil
+}
+
+// load reads the metadata file when it's new to the index or someone else
+// changed it. Nodes created here since the last save are kept, the disk has
+// the final say on them. Caller holds mu.
+func (x *Index) load() error {
+	info, err := os.Stat(x.jsonPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if x.tree != nil && (err != nil || info.ModTime().Equal(x.modTime)) {
+		return nil
+	}
+
+	tree, loadErr := loadMetadata(x.jsonPath, x.backend)
+	if loadErr != nil {
+		return loadErr
+	}
+	if x.tree != nil && x.dirty {
+		slog.Warn("metadata file changed by someone else, merging", "path", x.jsonPath)
+		graft(tree, x.tree)
+		x.tree = tree
+		if err := x.reconcile(x.tree, ""); err != nil {
+			return err
+		}
+	} else {
+		x.tree = tree
+	}
+	if info != nil {
+		x.modTime = info.ModTime()
+	}
+	x.recount()
+	return nil
+}
+
+// graft copies the nodes of from that to is missing, and the owner where to
+// has none. Everything else to has wins, it's the newer edit.
+func graft(to *FileMetadata, from *FileMetadata) {
+	for name, child := range from.Children {
+		existing, ok := to.Children[name]
+		if !ok {
+			to.child(name, child)
+			continue
+		}
+		if existing.IsDir() != child.IsDir() {
+			continue
+		}
+		if existing.Owner == "" {
+			existing.Owner, existing.Group, existing.Permissions = child.Owner, child.Group, child.Permissions
+		}
+		if existing.Created.IsZero() {
+			existing.Created = child.Created
+		}
+		graft(existing, child)
+	}
+}
+
+// Reconcile brings the index in line with the disk and saves it: files which
+// appeared get an entry, gone ones lose it, sizes and times are refreshed.
+// Access lists, owners and modes of what is still there are kept.
+func (x *Index) Reconcile() error {
+	// the backend is read without mu, walking a bucket can take a while
+	started := time.Now()
+	var tree *scanned
+	if _, ok := x.backend.(indexedBackend); !ok {
+		var err error
+		if tree, err = scan(x.backend, ""); err != nil {
+			return fmt.Errorf("scanning directory error: %w", err)
+		}
+	}
+	rootInfo, rootErr := x.backend.Stat("")
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	if tree == nil {
+		dropUnhashed(x.tree) // files from another backend have no content here
+	} else {
+		merge(x.tree, tree, started)
+	}
+	if rootErr == nil {
+		x.tree.LastModified = rootInfo.ModTime()
+	}
+	x.dirty = true
+	x.recount()
+	return x.save()
+}
+
+// reconcile rescans the directory dir into node, caller holds mu. Only for
+// the rare merge in load, the rest scans before taking mu.
+func (x *Index) reconcile(node *FileMetadata, dir string) error {
+	if _, ok := x.backend.(indexedBackend); ok {
+		dropUnhashed(node)
+		x.dirty = true
+		return nil
+	}
+	started := time.Now()
+	tree, err := scan(x.backend, dir)
+	if err != nil {
+		return err
+	}
+	merge(node, tree, started)
+	x.dirty = true
+	return nil
+}
+
+// scanned is what the backend has in a directory
+type scanned struct {
+	info     fs.FileInfo
+	children map[string]*scanned
+}
+
+// scan reads the tree below dir, the sizes and times come with the listing
+// (no request per file on S3)
+func scan(backend Backend, dir string) (*scanned, error) {
+	entries, err := backend.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &scanned{children: make(map[string]*scanned, len(entries))}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		var info fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			info, err = backend.Stat(name) // where the link points
+		} else {
+			info, err = entry.Info()
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // dangling link or gone since ReadDir
+			}
+			return nil, err
+		}
+
+		child := &scanned{info: info}
+		if info.IsDir() {
+			if child, err = scan(backend, name); err != nil {
+				return nil, err
+			}
+			child.info = info
+		}
+		tree.children[entry.Name()] = child
+	}
+	return tree, nil
+}
+
+// merge brings node in line with the scan of its directory. Entries the
+// server changed since the scan started are newer than it and stay as they
+// are.
+func merge(node *FileMetadata, tree *scanned, started time.Time) {
+	for name, entry := range tree.children {
+		info := entry.info
+		child, ok := node.Children[name]
+		if ok && child.touched.After(started) || !ok && node.touched.After(started) {
+			// changed through the index meanwhile, the next scan picks up the rest
+			continue
+		}
+		if !ok || child.IsDir() != info.IsDir() {
+			child = &FileMetadata{Created: info.ModTime()}
+			node.child(name, child)
+		}
+		// S3 lists directories without a time, the marker has one
+		if !info.ModTime().IsZero() || child.LastModified.IsZero() {
+			child.LastModified = info.ModTime()
+		}
+		if info.IsDir() {
+			child.Type, child.Size = TypeDirectory, 0
+			merge(child, entry, started)
+		} else {
+			child.Type, child.Size, child.Children = TypeFile, info.Size(), nil
+		}
+	}
+
+	for name, child := range node.Children {
+		if _, ok := tree.children[name]; !ok && !child.touched.After(started) {
+			delete(node.Children, name)
+		}
+	}
+}
+
+// Flush writes the index if it changed since the last save
+func (x *Index) Flush() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.dirty {
+		return nil
+	}
+	return x.save()
+}
+
+// Persist flushes the index every interval, for the lifetime of the server
+func (x *Index) Persist(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := x.Flush(); err != nil {
+			slog.Error("saving metadata failed", "path", x.jsonPath, "error", err)
+		}
+	}
+}
+
+// save writes the index, caller holds mu
+func (x *Index) save() error {
+	if err := utils.SaveJSON(x.jsonPath, metadataFile{Backend: fmt.Sprint(x.backend), Root: x.tree}); err != nil {
+		return fmt.Errorf("writing JSON file error: %v", err)
+	}
+	if info, err := os.Stat(x.jsonPath); err == nil {
+		x.modTime = info.ModTime()
+	}
+	x.dirty = false
+	return nil
+}
+
+// cleanPath brings a path relative to the root into index form, "" is the root
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// lookup returns the nodes from the root down to name, shorter when a part
+// of the path has no node. Caller holds mu.
+func (x *Index) lookup(name string) []*FileMetadata {
+	nodes := []*FileMetadata{x.tree}
+	if name == "" {
+		return nodes
+	}
+	node := x.tree
+	for _, part := range strings.Split(name, "/") {
+		child, ok := node.Children[part]
+		if !ok {
+			break
+		}
+		node = child
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// node returns the node of name or nil, caller holds mu
+func (x *Index) node(name string) *FileMetadata {
+	nodes := x.lookup(name)
+	if name == "" {
+		return nodes[0]
+	}
+	if len(nodes) != strings.Count(name, "/")+2 {
+		return nil
+	}
+	return nodes[len(nodes)-1]
+}
+
+// ensure returns the node of name, it and its parent directories are
+// created when missing. Caller holds mu.
+func (x *Index) ensure(name string, isDir bool, created time.Time) *FileMetadata {
+	node := x.tree
+	if name == "" {
+		return node
+	}
+	now := time.Now()
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node.Children[part]
+		if !ok || !child.IsDir() {
+			child = newDirectory(now)
+			child.touched = now
+			node.child(part, child)
+		}
+		node = child
+	}
+
+	last := parts[len(parts)-1]
+	child, ok := node.Children[last]
+	if !ok || child.IsDir() != isDir {
+		child = &FileMetadata{Type: TypeFile, Created: created}
+		if isDir {
+			child = newDirectory(created)
+		}
+		node.child(last, child)
+	}
+	child.touched = now
+	return child
+}
+
+// detach takes the node of name out of the tree, nil when there is none.
+// Caller holds mu.
+func (x *Index) detach(name string) *FileMetadata {
+	if name == "" {
+		return nil
+	}
+	parent := x.tree
+	if dir, _ := splitPath(name); dir != "" {
+		if parent = x.node(dir); parent == nil {
+			return nil
+		}
+	}
+	_, base := splitPath(name)
+	node, ok := parent.Children[base]
+	if !ok {
+		return nil
+	}
+	delete(parent.Children, base)
+	// a scan running now may still list it, see merge
+	parent.touched = time.Now()
+	return node
+}
+
+func splitPath(name string) (dir string, base string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// parentOf is the directory name is in, "" for the root and what's in it
+func parentOf(name string) string {
+	dir, _ := splitPath(name)
+	return dir
+}
+
+// remove drops the node of a deleted file or directory
+func (x *Index) remove(name string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	if node := x.detach(name); node != nil {
+		x.account(node, -1)
+		x.dirty = true
+	}
+	return nil
+}
+
+// rename moves the node of oldName to newName, the usage stays as it is
+func (x *Index) rename(oldName string, newName string, info os.FileInfo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+
+	node := x.detach(oldName)
+	if node == nil {
+		// never indexed (copied in by hand while the server ran) or moved
+		// already, the watcher sees the server's own renames too
+		node = x.ensure(newName, info.IsDir(), info.ModTime())
+		x.account(node, -1)
+		node.LastModified = info.ModTime()
+		if !info.IsDir() {
+			node.Size = info.Size()
+		}
+		x.account(node, 1)
+		x.dirty = true
+		return nil
+	}
+
+	if replaced := x.detach(newName); replaced != nil {
+		x.account(replaced, -1)
+	}
+	dir, base := splitPath(newName)
+	parent := x.tree
+	if dir != "" {
+		parent = x.ensure(dir, true, time.Now())
+	}
+	parent.child(base, node)
+	node.touched = time.Now()
+	x.dirty = true
+	return nil
+}
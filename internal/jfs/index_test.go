@@ -0,0 +1,69 @@
+package jfs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataOfAnotherBackend(t *testing.T) {
+	jsonPath := filepath.Join(t.TempDir(), "filesystem.json")
+	local := NewLocalBackend(t.TempDir())
+	writeFile(t, local, "kept", "data")
+	if err := NewIndex(local, jsonPath).Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty backend would drop every entry, it's refused instead
+	for _, other := range []Backend{NewMemoryBackend(), NewLocalBackend(t.TempDir())} {
+		if err := NewIndex(other, jsonPath).Reconcile(); err == nil {
+			t.Errorf("%v reconciled the metadata of %v", other, local)
+		}
+	}
+
+	x := NewIndex(local, jsonPath)
+	if err := x.Reconcile(); err != nil {
+		t.Fatalf("the backend the metadata is for: %v", err)
+	}
+	if x.node("kept") == nil {
+		t.Error("the entry of kept is gone")
+	}
+}
+
+func TestMergeKeepsNewerEntries(t *testing.T) {
+	backend := NewMemoryBackend()
+	writeFile(t, backend, "old", "old")
+	writeFile(t, backend, "gone", "gone")
+	x := NewIndex(backend, filepath.Join(t.TempDir(), "filesystem.json"))
+	if err := x.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSystem{Backend: backend, Index: x, User: "alice"}
+
+	// the scan runs without mu, the server goes on meanwhile
+	started := time.Now()
+	backend.Remove("gone")
+	tree, err := scan(backend, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("late", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("old", "moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	x.mu.Lock()
+	merge(x.tree, tree, started)
+	x.mu.Unlock()
+
+	for name, want := range map[string]bool{"late": true, "moved": true, "old": false, "gone": false} {
+		if got := x.node(name) != nil; got != want {
+			t.Errorf("%v in the index: %v, want %v", name, got, want)
+		}
+	}
+	if node := x.node("late"); node != nil && node.Owner != "alice" {
+		t.Errorf("late lost its owner: %+v", node)
+	}
+}
@@ -1,87 +1,245 @@
 package jfs
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"jamserver/pkg/utils"
+	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"path"
+	"strings"
 	"time"
 )
 
+const (
+	DefaultBasePath = "app/jam_filesystem"
+	MetadataPath    = "app/filesystem.json"
+)
+
+const (
+	TypeFile      = "file"
+	TypeDirectory = "directory"
+)
+
 // interesting: https://github.com/1pkg/gopium/issues/24
 type FileMetadata struct {
-	Children     map[string]FileMetadata `json:"children,omitempty"`
-	LastModified time.Time               `json:"last_modified,omitempty"`
-	Created      time.Time               `json:"created,omitempty"`
-	Owner        string                  `json:"owner,omitempty"`
-	Type         string                  `json:"type"`
-	Permissions  os.FileMode             `json:"permissions,omitempty"`
+	Children     map[string]*FileMetadata `json:"children,omitempty"`
+	LastModified time.Time                `json:"last_modified,omitempty"`
+	Created      time.Time                `json:"created,omitempty"`
+	Owner        string                   `json:"owner,omitempty"`
+	Group        string                   `json:"group,omitempty"`
+	Type         string                   `json:"type"`
+	Size         int64                    `json:"size,omitempty"` // files only
+	Permissions  os.FileMode              `json:"permissions,omitempty"`
+	ACL          []ACLEntry               `json:"acl,omitempty"`    // directories only
+	Hash         string                   `json:"sha256,omitempty"` // content of files in a DedupBackend
+
+	touched time.Time // last changed through the index, not stored
 }
 
-func UpdateFileSystemMetadata(basePath string, jsonPath string) error {
-	var fileSystem map[string]interface{}
-	fileSystem, err := utils.LoadJSON[map[string]interface{}](jsonPath)
-	if err != nil {
-		return fmt.Errorf("reading JSON file error: %v", err)
-	}
+func newDirectory(created time.Time) *FileMetadata {
+	return &FileMetadata{Type: TypeDirectory, Created: created, LastModified: created}
+}
 
-	root, ok := fileSystem["root"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid JSON structure: missing 'root' key")
+func (m *FileMetadata) IsDir() bool {
+	return m.Type == TypeDirectory
+}
+
+func (m *FileMetadata) child(name string, child *FileMetadata) {
+	if m.Children == nil {
+		m.Children = make(map[string]*FileMetadata)
 	}
+	m.Children[name] = child
+}
 
-	children, ok := root["children"].(map[string]interface{})
-	if !ok {
-		root["children"] = make(map[string]interface{})
-		children = root["children"].(map[string]interface{})
+// fileMetadataJSON is FileMetadata as stored, the times are unix seconds
+type fileMetadataJSON struct {
+	Children     map[string]*FileMetadata `json:"children,omitempty"`
+	LastModified int64                    `json:"last_modified,omitempty"`
+	Created      int64                    `json:"created,omitempty"`
+	Owner        string                   `json:"owner,omitempty"`
+	Group        string                   `json:"group,omitempty"`
+	Type         string                   `json:"type"`
+	Size         int64                    `json:"size,omitempty"`
+	Permissions  os.FileMode              `json:"permissions,omitempty"`
+	ACL          []ACLEntry               `json:"acl,omitempty"`
+	Hash         string                   `json:"sha256,omitempty"`
+}
+
+func (m FileMetadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileMetadataJSON{
+		Children:     m.Children,
+		LastModified: unixSeconds(m.LastModified),
+		Created:      unixSeconds(m.Created),
+		Owner:        m.Owner,
+		Group:        m.Group,
+		Type:         m.Type,
+		Size:         m.Size,
+		Permissions:  m.Permissions,
+		ACL:          m.ACL,
+		Hash:         m.Hash,
+	})
+}
+
+func (m *FileMetadata) UnmarshalJSON(data []byte) error {
+	var stored fileMetadataJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
 	}
+	*m = FileMetadata{
+		Children:     stored.Children,
+		LastModified: fromUnixSeconds(stored.LastModified),
+		Created:      fromUnixSeconds(stored.Created),
+		Owner:        stored.Owner,
+		Group:        stored.Group,
+		Type:         stored.Type,
+		Size:         stored.Size,
+		Permissions:  stored.Permissions,
+		ACL:          stored.ACL,
+		Hash:         stored.Hash,
+	}
+	if m.Type == "" {
+		m.Type = TypeFile
+	}
+	return nil
+}
 
-	// Scan the directory and update children
-	if err := utils.ScanAndUpdateChildren(basePath, children); err != nil {
-		return fmt.Errorf("scanning directory error: %v", err)
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
+	return t.Unix()
+}
 
-	// Save the updated JSON
-	if err := utils.SaveJSON(jsonPath, fileSystem); err != nil {
-		return fmt.Errorf("writing JSON file error: %v", err)
+func fromUnixSeconds(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
 	}
+	return time.Unix(seconds, 0)
+}
 
-	return nil
+// RebuildMetadata reconciles the metadata in jsonPath with the directory
+// basePath, for jamctl while the server is down
+func RebuildMetadata(basePath string, jsonPath string) error {
+	return NewIndex(NewLocalBackend(basePath), jsonPath).Reconcile()
 }
 
 // NOTE: actual file system initialization my friends
-func InitializeFS(basePath string) error {
-	if _, err := os.Stat(basePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(basePath, 0755); err != nil {
-			return fmt.Errorf("creating base path error: %v", err)
-		}
+func InitializeFS(backend Backend, metadataPath string) (*Index, error) {
+	if err := mkdirAll(backend, ""); err != nil {
+		return nil, fmt.Errorf("creating base path error: %v", err)
 	}
 
-	// update the filesystem json with the current directory structure
-	err := UpdateFileSystemMetadata(basePath, "app/filesystem.json")
-	if err != nil {
-		return fmt.Errorf("updating filesystem JSON error: %v", err)
+	// bring the metadata in line with what is stored now
+	index := NewIndex(backend, metadataPath)
+	if err := index.Reconcile(); err != nil {
+		return nil, fmt.Errorf("updating filesystem JSON error: %v", err)
 	}
 
 	// add some immersion
 	time.Sleep(time.Second / 3)
-	fmt.Println("File system metadata initialized successfully.")
+	slog.Info("file system metadata initialized", "path", metadataPath)
 	time.Sleep(time.Second / 2)
-	fmt.Println("File system initialized successfully.")
+	slog.Info("file system initialized", "backend", fmt.Sprint(backend))
 
-	return nil
+	return index, nil
 }
 
+var ErrReadOnly = errors.New("file system is read-only")
+
 type FileSystem struct {
-	BasePath string
+	Backend  Backend
+	Dir      string // the directory of Backend this file system starts in, "" is its root
+	ReadOnly bool   // every write fails with ErrReadOnly, e.g. the anonymous area
+
+	// with an Index every operation of User is checked against the ACLs and
+	// the modes in it, what User creates gets the mode without Umask
+	Index  *Index
+	User   string
+	Groups []string
+	Umask  os.FileMode
 }
 
+// NewFileSystem is a file system on the local directory basePath
 func NewFileSystem(basePath string) *FileSystem {
-	return &FileSystem{BasePath: basePath}
+	return &FileSystem{Backend: NewLocalBackend(basePath)}
+}
+
+// name maps a client supplied name into Dir, ".." can't climb out
+func (fs *FileSystem) name(fileName string) string {
+	return cleanPath(path.Join(fs.Dir, cleanPath(fileName)))
+}
+
+// Path is fileName resolved from the root of the storage, as the logs show it
+func (fs *FileSystem) Path(fileName string) string {
+	return "/" + fs.name(fileName)
+}
+
+// Sub is the directory dir of fs as a file system of its own, e.g. a home
+// directory, it's created when missing
+func (fs *FileSystem) Sub(dir string) (*FileSystem, error) {
+	name := fs.name(dir)
+	if err := mkdirAll(fs.Backend, name); err != nil {
+		return nil, err
+	}
+	sub := *fs
+	sub.Dir = name
+	return &sub, nil
+}
+
+// As is fs for one user, checked against the index
+func (fs *FileSystem) As(user string, groups []string) *FileSystem {
+	as := *fs
+	as.User, as.Groups = user, groups
+	return &as
+}
+
+// check returns ErrDenied when the ACL of the directory dir doesn't allow op
+func (fs *FileSystem) check(dir string, op Operation) error {
+	if fs.Index == nil {
+		return nil
+	}
+	allowed, err := fs.Index.Allowed(dir, fs.User, fs.Groups, op)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: no %v permission in /%v", ErrDenied, op, dir)
+	}
+	return nil
+}
+
+// CheckFile checks op on a file against the ACL of its directory and the
+// modes, the file operations do it themselves, STOR asks ahead before taking
+// the upload
+func (fs *FileSystem) CheckFile(fileName string, op Operation) error {
+	name := fs.name(fileName)
+	if reservedName(name) {
+		return fmt.Errorf("%w: names starting with %v are reserved", ErrDenied, uploadPrefix)
+	}
+	if err := fs.check(parentOf(name), op); err != nil {
+		return err
+	}
+	return fs.checkMode(name, op)
+}
+
+func (fs *FileSystem) Exists(fileName string) bool {
+	_, err := fs.Backend.Stat(fs.name(fileName))
+	return err == nil
 }
 
 func (fs *FileSystem) ListFiles() ([]string, error) {
-	files, err := os.ReadDir(fs.BasePath)
+	if err := fs.check(fs.Dir, OpList); err != nil {
+		return nil, err
+	}
+	if err := fs.needSearch(fs.Dir); err != nil {
+		return nil, err
+	}
+	if err := fs.needMode(fs.Dir, bitRead|bitExecute, "read"); err != nil {
+		return nil, err
+	}
+	files, err := fs.Backend.ReadDir(fs.Dir)
 	if err != nil {
 		return nil, err
 	}
@@ -93,10 +251,205 @@ func (fs *FileSystem) ListFiles() ([]string, error) {
 	return fileNames, nil
 }
 
+// OpenFile opens a file for reading, size is where it ends. Transfers
+// stream from it, seeking to a restart offset.
+func (fs *FileSystem) OpenFile(fileName string) (file io.ReadSeekCloser, size int64, err error) {
+	if err := fs.CheckFile(fileName, OpRead); err != nil {
+		return nil, 0, err
+	}
+	name := fs.name(fileName)
+	info, err := fs.Backend.Stat(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.IsDir() {
+		return nil, 0, fmt.Errorf("%v is a directory", fileName)
+	}
+	file, err = fs.Backend.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
 func (fs *FileSystem) ReadFile(fileName string) ([]byte, error) {
-	return os.ReadFile(filepath.Join(fs.BasePath, fileName))
+	file, _, err := fs.OpenFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
 }
 
 func (fs *FileSystem) WriteFile(fileName string, data []byte) error {
-	return os.WriteFile(filepath.Join(fs.BasePath, fileName), data, 0644)
+	return fs.write(fileName, data, 0)
+}
+
+func (fs *FileSystem) FileSize(fileName string) (int64, error) {
+	info, err := fs.Backend.Stat(fs.name(fileName))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (fs *FileSystem) AppendFile(fileName string, data []byte) error {
+	size, err := fs.FileSize(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fs.write(fileName, data, size)
+}
+
+// WriteFileAt replaces everything from offset onwards
+func (fs *FileSystem) WriteFileAt(fileName string, data []byte, offset int64) error {
+	return fs.write(fileName, data, offset)
+}
+
+func (fs *FileSystem) write(fileName string, data []byte, offset int64) error {
+	upload, err := fs.CreateFile(fileName, offset)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(data); err != nil {
+		upload.Abort()
+		return err
+	}
+	return upload.Close()
+}
+
+// Upload is a file being written, Close stores it and Abort gives up
+type Upload struct {
+	fs      *FileSystem
+	name    string
+	created bool
+	w       io.WriteCloser
+}
+
+// CreateFile starts writing fileName from offset on, the bytes before it
+// are kept (STOR after REST, APPE passes the size)
+func (fs *FileSystem) CreateFile(fileName string, offset int64) (*Upload, error) {
+	if fs.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := fs.CheckFile(fileName, OpWrite); err != nil {
+		return nil, err
+	}
+	created := !fs.Exists(fileName)
+	if offset > 0 && created {
+		return nil, fmt.Errorf("can't restart %v, it doesn't exist", fileName)
+	}
+	name := fs.name(fileName)
+	w, err := fs.Backend.Create(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{fs: fs, name: name, created: created, w: w}, nil
+}
+
+func (u *Upload) Write(p []byte) (int, error) {
+	return u.w.Write(p)
+}
+
+func (u *Upload) Close() error {
+	err := u.w.Close()
+	u.fs.record(u.name, u.created, 0666)
+	return err
+}
+
+// Abort drops the upload where the backend can, an existing file stays as it
+// was. On local disk a new file keeps what was written so far and can be
+// resumed with REST, so does a resumed one.
+func (u *Upload) Abort() error {
+	a, ok := u.w.(aborter)
+	if !ok {
+		err := u.w.Close()
+		u.fs.record(u.name, u.created, 0666)
+		return err
+	}
+	err := a.Abort()
+	if _, statErr := u.fs.Backend.Stat(u.name); statErr == nil && u.created {
+		u.fs.record(u.name, true, 0666)
+	}
+	return err
+}
+
+// MakeDir creates a directory owned by the user
+func (fs *FileSystem) MakeDir(dirName string) error {
+	if fs.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := fs.CheckFile(dirName, OpMkdir); err != nil {
+		return err
+	}
+	name := fs.name(dirName)
+	if err := fs.Backend.Mkdir(name); err != nil {
+		return err
+	}
+	fs.record(name, true, 0777)
+	return nil
+}
+
+// DeleteFile removes a single file, directories are refused
+func (fs *FileSystem) DeleteFile(fileName string) error {
+	if fs.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := fs.CheckFile(fileName, OpDelete); err != nil {
+		return err
+	}
+	name := fs.name(fileName)
+	info, err := fs.Backend.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%v is a directory", fileName)
+	}
+	if err := fs.Backend.Remove(name); err != nil {
+		return err
+	}
+	if fs.Index != nil {
+		if err := fs.Index.remove(name); err != nil {
+			slog.Warn("dropping metadata of deleted file failed", "path", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// Rename moves a file or directory, an existing file at newName is replaced
+func (fs *FileSystem) Rename(oldName string, newName string) error {
+	if fs.ReadOnly {
+		return ErrReadOnly
+	}
+	from, to := fs.name(oldName), fs.name(newName)
+	if from == fs.Dir || to == fs.Dir {
+		return errors.New("the root can't be renamed")
+	}
+	if strings.HasPrefix(to, from+"/") {
+		return fmt.Errorf("%v can't be moved into itself", oldName)
+	}
+	if err := fs.CheckFile(oldName, OpRename); err != nil {
+		return err
+	}
+	if err := fs.CheckFile(newName, OpRename); err != nil {
+		return err
+	}
+	if _, err := fs.Backend.Stat(from); err != nil {
+		return err
+	}
+	if err := fs.Backend.Rename(from, to); err != nil {
+		return err
+	}
+
+	if fs.Index != nil {
+		info, err := fs.Backend.Stat(to)
+		if err == nil {
+			err = fs.Index.rename(from, to, info)
+		}
+		if err != nil {
+			slog.Warn("moving metadata of renamed file failed", "from", from, "to", to, "error", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,237 @@
+package jfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps everything in memory and forgets it on exit, for tests
+// and trying things out
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string]*memoryFile // by name, "" is the root
+}
+
+type memoryFile struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: map[string]*memoryFile{"": {dir: true, modTime: time.Now()}}}
+}
+
+func (b *MemoryBackend) String() string {
+	return "memory"
+}
+
+func memoryError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentDir checks that the directory name goes into exists, caller holds mu
+func (b *MemoryBackend) parentDir(op string, name string) error {
+	if parent, ok := b.files[parentOf(name)]; !ok || !parent.dir {
+		return memoryError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Stat(name string) (fs.FileInfo, error) {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[name]
+	if !ok {
+		return nil, memoryError("stat", name, fs.ErrNotExist)
+	}
+	return fileInfo{name: path.Base("/" + name), size: int64(len(file.data)), dir: file.dir, modTime: file.modTime}, nil
+}
+
+func (b *MemoryBackend) Open(name string) (io.ReadSeekCloser, error) {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[name]
+	if !ok {
+		return nil, memoryError("open", name, fs.ErrNotExist)
+	}
+	if file.dir {
+		return nil, memoryError("open", name, fmt.Errorf("is a directory"))
+	}
+	// written files get new slices, this one stays as it is
+	return memoryReader{bytes.NewReader(file.data)}, nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (b *MemoryBackend) Create(name string, offset int64) (io.WriteCloser, error) {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.parentDir("create", name); err != nil {
+		return nil, err
+	}
+
+	file, ok := b.files[name]
+	switch {
+	case ok && file.dir:
+		return nil, memoryError("create", name, fmt.Errorf("is a directory"))
+	case !ok && offset > 0:
+		return nil, memoryError("create", name, fs.ErrNotExist)
+	case ok && offset > int64(len(file.data)):
+		return nil, fmt.Errorf("offset %d is beyond end of file (%d bytes)", offset, len(file.data))
+	case !ok:
+		file = &memoryFile{modTime: time.Now()}
+		b.files[name] = file
+	}
+	return &memoryWriter{backend: b, name: name, file: file, created: !ok, buf: bytes.NewBuffer(bytes.Clone(file.data[:offset]))}, nil
+}
+
+// memoryWriter collects what's written and stores it on Close, the file
+// stays as it was until then
+type memoryWriter struct {
+	backend *MemoryBackend
+	name    string
+	file    *memoryFile
+	created bool
+	buf     *bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+	file, ok := w.backend.files[w.name]
+	if !ok || file.dir {
+		return memoryError("close", w.name, fs.ErrNotExist) // removed while written
+	}
+	file.data, file.modTime = w.buf.Bytes(), time.Now()
+	return nil
+}
+
+// Abort drops what was written, a file made for it goes again
+func (w *memoryWriter) Abort() error {
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+	if w.created && w.backend.files[w.name] == w.file {
+		delete(w.backend.files, w.name)
+	}
+	return nil
+}
+
+// children returns the names below dir, caller holds mu
+func (b *MemoryBackend) children(dir string) []string {
+	var names []string
+	for name := range b.files {
+		if name != "" && (dir == "" || strings.HasPrefix(name, dir+"/")) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (b *MemoryBackend) Remove(name string) error {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[name]
+	if !ok || name == "" {
+		return memoryError("remove", name, fs.ErrNotExist)
+	}
+	if file.dir && len(b.children(name)) > 0 {
+		return memoryError("remove", name, fmt.Errorf("directory not empty"))
+	}
+	delete(b.files, name)
+	return nil
+}
+
+func (b *MemoryBackend) Rename(oldName string, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[oldName]
+	if !ok || oldName == "" {
+		return memoryError("rename", oldName, fs.ErrNotExist)
+	}
+	if err := b.parentDir("rename", newName); err != nil {
+		return err
+	}
+	if existing, ok := b.files[newName]; ok && (existing.dir || file.dir) {
+		return memoryError("rename", newName, fs.ErrExist)
+	}
+
+	for _, child := range b.children(oldName) {
+		b.files[newName+child[len(oldName):]] = b.files[child]
+		delete(b.files, child)
+	}
+	delete(b.files, oldName)
+	b.files[newName] = file
+	return nil
+}
+
+func (b *MemoryBackend) Mkdir(name string) error {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[name]; ok {
+		return memoryError("mkdir", name, fs.ErrExist)
+	}
+	if err := b.parentDir("mkdir", name); err != nil {
+		return err
+	}
+	b.files[name] = &memoryFile{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dir, ok := b.files[name]; !ok || !dir.dir {
+		return nil, memoryError("readdir", name, fs.ErrNotExist)
+	}
+
+	var entries []fs.DirEntry
+	for _, child := range b.children(name) {
+		if parentOf(child) != name {
+			continue
+		}
+		file := b.files[child]
+		info := fileInfo{name: path.Base(child), size: int64(len(file.data)), dir: file.dir, modTime: file.modTime}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (b *MemoryBackend) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	name = cleanPath(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	file, ok := b.files[name]
+	if !ok {
+		return memoryError("chtimes", name, fs.ErrNotExist)
+	}
+	file.modTime = mtime
+	return nil
+}
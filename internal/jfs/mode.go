@@ -0,0 +1,243 @@
+package jfs
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// NOTE: unix style owner, group and mode, kept as "owner", "group" and
+// "permissions" on the entries of filesystem.json. Files without an owner
+// (e.g. copied in by hand) are not checked.
+
+// Attributes are the owner, group and rwx bits of a file or directory
+type Attributes struct {
+	Owner string      `json:"owner"`
+	Group string      `json:"group,omitempty"`
+	Mode  os.FileMode `json:"mode"`
+}
+
+// the bits checked against Attributes.Mode, shifted into the owner, group or other class
+const (
+	bitRead    os.FileMode = 4
+	bitWrite   os.FileMode = 2
+	bitExecute os.FileMode = 1
+)
+
+// Allows checks bits for a user, the owner class if it's the owner, the group
+// class if it's in the group and the other class otherwise
+func (a Attributes) Allows(user string, groups []string, bits os.FileMode) bool {
+	if a.Owner == "" {
+		return true
+	}
+	var shift uint
+	switch {
+	case user == a.Owner:
+		shift = 6
+	case a.Group != "" && slices.Contains(groups, a.Group):
+		shift = 3
+	}
+	return (a.Mode>>shift)&bits == bits
+}
+
+// ParseMode reads an octal mode like 750 or 0640
+func ParseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, use octal like 644", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (x *Index) attributes(name string) (Attributes, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return Attributes{}, false, err
+	}
+	node := x.node(name)
+	if node == nil || node.Owner == "" {
+		return Attributes{}, false, nil
+	}
+	return node.attributes(), true, nil
+}
+
+func (m *FileMetadata) attributes() Attributes {
+	return Attributes{Owner: m.Owner, Group: m.Group, Mode: m.Permissions.Perm()}
+}
+
+// searchable returns the first directory from the root down to dir the user
+// lacks x on, "" with ok when there is none
+func (x *Index) searchable(dir string, user string, groups []string) (denied string, ok bool, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return "", false, err
+	}
+	parts := strings.Split(dir, "/")
+	for i, node := range x.lookup(dir) {
+		if node.Owner == "" {
+			continue
+		}
+		if !node.attributes().Allows(user, groups, bitExecute) {
+			return strings.Join(parts[:i], "/"), false, nil
+		}
+	}
+	return "", true, nil
+}
+
+// Attributes returns owner, group and mode of name (relative to the root)
+func (x *Index) Attributes(name string) (Attributes, bool, error) {
+	return x.attributes(cleanPath(name))
+}
+
+// SetAttributes records owner, group and mode of name (relative to the root),
+// an empty owner removes them. It's saved right away.
+func (x *Index) SetAttributes(name string, attrs Attributes) error {
+	name = cleanPath(name)
+	info, err := x.backend.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+	node := x.ensure(name, info.IsDir(), info.ModTime())
+	x.account(node, -1)
+	node.Owner, node.Group, node.Permissions = attrs.Owner, attrs.Group, attrs.Mode.Perm()
+	if attrs.Owner == "" {
+		node.Group, node.Permissions = "", 0
+	}
+	if !info.IsDir() {
+		node.Size = info.Size()
+	}
+	x.account(node, 1)
+	return x.save()
+}
+
+// needMode returns ErrDenied when the user lacks bits on name
+func (fs *FileSystem) needMode(name string, bits os.FileMode, what string) error {
+	if fs.Index == nil {
+		return nil
+	}
+	attrs, _, err := fs.Index.attributes(name)
+	if err != nil {
+		return err
+	}
+	if !attrs.Allows(fs.User, fs.Groups, bits) {
+		return fmt.Errorf("%w: no %v permission on /%v", ErrDenied, what, name)
+	}
+	return nil
+}
+
+// needSearch returns ErrDenied when the user lacks x on a directory from the
+// root down to dir, the same for every operation: Dir is reached through
+// the ones above it too
+func (fs *FileSystem) needSearch(dir string) error {
+	if fs.Index == nil {
+		return nil
+	}
+	denied, ok, err := fs.Index.searchable(dir, fs.User, fs.Groups)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: no execute permission on /%v", ErrDenied, denied)
+	}
+	return nil
+}
+
+// checkMode checks the mode bits for op on the file name, every directory
+// from the root down to its own needs x, creating or removing something in it
+// also w
+func (fs *FileSystem) checkMode(name string, op Operation) error {
+	dir := parentOf(name)
+	if err := fs.needSearch(dir); err != nil {
+		return err
+	}
+
+	switch op {
+	case OpRead:
+		return fs.needMode(name, bitRead, "read")
+	case OpWrite:
+		if _, err := fs.Backend.Stat(name); err == nil {
+			return fs.needMode(name, bitWrite, "write")
+		}
+		return fs.needMode(dir, bitWrite, "write")
+	case OpDelete, OpMkdir, OpRename:
+		return fs.needMode(dir, bitWrite, "write")
+	}
+	return nil
+}
+
+// Attributes returns owner, group and mode of a file, found is false for
+// files nobody owns
+func (fs *FileSystem) Attributes(fileName string) (attrs Attributes, found bool, err error) {
+	if fs.Index == nil {
+		return Attributes{}, false, nil
+	}
+	return fs.Index.attributes(fs.name(fileName))
+}
+
+// Chmod changes the mode, only the owner can
+func (fs *FileSystem) Chmod(fileName string, mode os.FileMode) error {
+	attrs, err := fs.ownAttributes(fileName, OpChmod)
+	if err != nil {
+		return err
+	}
+	attrs.Mode = mode.Perm()
+	return fs.setAttributes(fileName, attrs)
+}
+
+// Chown changes owner and group, the owner can hand the group over to one of
+// its own groups but giving the file to another user is left to the administrator
+func (fs *FileSystem) Chown(fileName string, owner string, group string) error {
+	attrs, err := fs.ownAttributes(fileName, OpChmod)
+	if err != nil {
+		return err
+	}
+	if owner != "" && owner != attrs.Owner {
+		return fmt.Errorf("%w: only the administrator can change the owner", ErrDenied)
+	}
+	if group != "" && !slices.Contains(fs.Groups, group) {
+		return fmt.Errorf("%w: you are not in group %v", ErrDenied, group)
+	}
+	if group != "" {
+		attrs.Group = group
+	}
+	return fs.setAttributes(fileName, attrs)
+}
+
+func (fs *FileSystem) ownAttributes(fileName string, op Operation) (Attributes, error) {
+	if fs.ReadOnly {
+		return Attributes{}, ErrReadOnly
+	}
+	name := fs.name(fileName)
+	if _, err := fs.Backend.Stat(name); err != nil {
+		return Attributes{}, err
+	}
+	if err := fs.check(parentOf(name), op); err != nil {
+		return Attributes{}, err
+	}
+
+	attrs, found, err := fs.Attributes(fileName)
+	if err != nil {
+		return Attributes{}, err
+	}
+	if !found {
+		return Attributes{}, fmt.Errorf("%w: %v has no owner, ask the administrator", ErrDenied, fileName)
+	}
+	if attrs.Owner != fs.User {
+		return Attributes{}, fmt.Errorf("%w: only the owner %v can change %v", ErrDenied, attrs.Owner, fileName)
+	}
+	return attrs, nil
+}
+
+func (fs *FileSystem) setAttributes(fileName string, attrs Attributes) error {
+	return fs.Index.SetAttributes(fs.name(fileName), attrs)
+}
@@ -0,0 +1,143 @@
+package jfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		attrs  Attributes
+		user   string
+		groups []string
+		bits   os.FileMode
+		want   bool
+	}{
+		{"no owner", Attributes{Mode: 0}, "bob", nil, bitWrite, true},
+		{"owner", Attributes{Owner: "alice", Mode: 0600}, "alice", nil, bitRead | bitWrite, true},
+		{"owner lacks x", Attributes{Owner: "alice", Mode: 0677}, "alice", nil, bitExecute, false},
+		{"owner class only", Attributes{Owner: "alice", Group: "staff", Mode: 0070}, "alice", []string{"staff"}, bitRead, false},
+		{"group", Attributes{Owner: "alice", Group: "staff", Mode: 0750}, "bob", []string{"dev", "staff"}, bitRead | bitExecute, true},
+		{"group lacks w", Attributes{Owner: "alice", Group: "staff", Mode: 0757}, "bob", []string{"staff"}, bitWrite, false},
+		{"other", Attributes{Owner: "alice", Group: "staff", Mode: 0704}, "bob", []string{"dev"}, bitRead, true},
+		{"other without a group", Attributes{Owner: "alice", Mode: 0770}, "bob", []string{""}, bitRead, false},
+		{"all bits needed", Attributes{Owner: "alice", Mode: 0604}, "bob", nil, bitRead | bitExecute, false},
+	}
+	for _, tt := range tests {
+		if got := tt.attrs.Allows(tt.user, tt.groups, tt.bits); got != tt.want {
+			t.Errorf("%v: Allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  os.FileMode
+		err   bool
+	}{
+		{"750", 0750, false},
+		{"0640", 0640, false},
+		{"0", 0, false},
+		{"7777", 0, true},
+		{"8", 0, true},
+		{"rwx", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMode(tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseMode(%q) = %o, %v, want %o (error %v)", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	backend := NewMemoryBackend()
+	for _, dir := range []string{"home", "home/alice", "home/alice/a", "home/alice/a/b", "home/alice/a/b/c"} {
+		backend.Mkdir(dir)
+	}
+	w, _ := backend.Create("home/alice/a/b/c/file", 0)
+	w.Close()
+	x := NewIndex(backend, filepath.Join(t.TempDir(), "filesystem.json"))
+
+	set := func(name string, mode os.FileMode) {
+		if err := x.SetAttributes(name, Attributes{Owner: "alice", Group: "staff", Mode: mode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("home/alice/a/b/c/file", 0644)
+	set("home/alice/a/b/c", 0755)
+	// b two levels up is closed to the others, they used to get through
+	set("home/alice/a/b", 0700)
+
+	home := &FileSystem{Backend: backend, Dir: "home/alice", Index: x}
+	tests := []struct {
+		user string
+		op   Operation
+		name string
+		ok   bool
+	}{
+		{"alice", OpRead, "a/b/c/file", true},
+		{"bob", OpRead, "a/b/c/file", false},
+		{"bob", OpWrite, "a/b/c/new", false},
+		{"bob", OpRead, "a/other", true},
+	}
+	for _, tt := range tests {
+		err := home.As(tt.user, []string{"dev"}).CheckFile(tt.name, tt.op)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, ErrDenied) {
+			t.Errorf("%v %v %v: %v", tt.user, tt.op, tt.name, err)
+		}
+	}
+
+	// the directories above Dir count for its listing
+	deep := &FileSystem{Backend: backend, Dir: "home/alice/a/b/c", Index: x}
+	if _, err := deep.As("bob", nil).ListFiles(); !errors.Is(err, ErrDenied) {
+		t.Errorf("bob listed below a closed directory: %v", err)
+	}
+	if files, err := deep.As("alice", nil).ListFiles(); err != nil || len(files) != 1 {
+		t.Errorf("alice listing = %v, %v", files, err)
+	}
+}
+
+func TestSearchAboveHome(t *testing.T) {
+	backend := NewMemoryBackend()
+	for _, dir := range []string{"srv", "srv/closed", "srv/closed/carol"} {
+		backend.Mkdir(dir)
+	}
+	w, _ := backend.Create("srv/closed/carol/notes", 0)
+	w.Close()
+	x := NewIndex(backend, filepath.Join(t.TempDir(), "filesystem.json"))
+	x.SetAttributes("srv/closed", Attributes{Owner: "admin", Group: "admin", Mode: 0700})
+	x.SetAttributes("srv/closed/carol", Attributes{Owner: "carol", Group: "staff", Mode: 0755})
+	x.SetAttributes("srv/closed/carol/notes", Attributes{Owner: "carol", Group: "staff", Mode: 0644})
+
+	// carol's home is below a directory she can't search, what she may do
+	// there is the same for every operation
+	home := &FileSystem{Backend: backend, Dir: "srv/closed/carol", Index: x}
+	tests := []struct {
+		user string
+		op   Operation
+		name string
+		ok   bool
+	}{
+		{"carol", OpRead, "notes", false},
+		{"carol", OpWrite, "new", false},
+		{"carol", OpDelete, "notes", false},
+		{"carol", OpRename, "notes", false},
+		{"carol", OpMkdir, "sub", false},
+		{"admin", OpRead, "notes", true},
+		{"admin", OpWrite, "new", false},
+	}
+	for _, tt := range tests {
+		err := home.As(tt.user, nil).CheckFile(tt.name, tt.op)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, ErrDenied) {
+			t.Errorf("%v %v %v: %v", tt.user, tt.op, tt.name, err)
+		}
+	}
+	if _, err := home.As("carol", nil).ListFiles(); !errors.Is(err, ErrDenied) {
+		t.Errorf("carol listed: %v", err)
+	}
+}
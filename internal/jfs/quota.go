@@ -0,0 +1,117 @@
+package jfs
+
+import (
+	"log/slog"
+	"os"
+)
+
+// NOTE: disk usage for quotas, summed up from the owned files in the index
+// when it's loaded and kept up to date with every change after that. Files
+// nobody owns count for nobody.
+
+// Usage is what the files of an owner or a group take up
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// account adds (sign 1) or takes away (-1) node and everything below it
+// from the usage of the owners and groups, caller holds mu
+func (x *Index) account(node *FileMetadata, sign int64) {
+	if node.IsDir() {
+		for _, child := range node.Children {
+			x.account(child, sign)
+		}
+		return
+	}
+	if node.Owner == "" {
+		return
+	}
+	x.charge(node.Owner, sign*node.Size, sign)
+	if node.Group != "" {
+		x.charge("@"+node.Group, sign*node.Size, sign)
+	}
+}
+
+func (x *Index) charge(who string, bytes int64, files int64) {
+	usage := x.usage[who]
+	usage.Bytes += bytes
+	usage.Files += files
+	x.usage[who] = usage
+}
+
+// recount sums up the usage from scratch, caller holds mu
+func (x *Index) recount() {
+	x.usage = make(map[string]Usage)
+	x.account(x.tree, 1)
+}
+
+// Usage returns the usage of a login or a "@group"
+func (x *Index) Usage(who string) (Usage, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return Usage{}, err
+	}
+	return x.usage[who], nil
+}
+
+// record puts size and modification time of name into the index, the owner
+// too for something the user just created or wrote to while nobody owned it
+func (fs *FileSystem) record(rel string, created bool, base os.FileMode) {
+	if fs.Index == nil {
+		return
+	}
+	info, err := fs.Backend.Stat(rel)
+	if err != nil {
+		slog.Warn("recording file failed", "path", rel, "error", err)
+		return
+	}
+
+	x := fs.Index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		slog.Warn("recording file failed", "path", rel, "error", err)
+		return
+	}
+
+	node := x.ensure(rel, info.IsDir(), info.ModTime())
+	x.account(node, -1)
+	node.LastModified = info.ModTime()
+	if !info.IsDir() {
+		node.Size = info.Size()
+	}
+	if (created || node.Owner == "") && fs.User != "" {
+		node.Owner, node.Group, node.Permissions = fs.User, "", (base &^ fs.Umask).Perm()
+		if len(fs.Groups) > 0 {
+			node.Group = fs.Groups[0]
+		}
+	}
+	x.account(node, 1)
+	x.dirty = true
+}
+
+// Charged tells whose quota a write to fileName counts against: the owner and
+// group of an existing file, the user and its first group for a new one or
+// one nobody owns, which the upload makes theirs. size is what the file has
+// now, owned whether it's already counted. owner is empty when nobody is
+// charged.
+func (fs *FileSystem) Charged(fileName string) (owner string, group string, size int64, owned bool, err error) {
+	if len(fs.Groups) > 0 {
+		group = fs.Groups[0]
+	}
+	info, statErr := fs.Backend.Stat(fs.name(fileName))
+	if statErr != nil {
+		return fs.User, group, 0, false, nil
+	}
+
+	attrs, found, err := fs.Attributes(fileName)
+	if err != nil {
+		return "", "", 0, false, err
+	}
+	if !found {
+		return fs.User, group, info.Size(), false, nil
+	}
+	return attrs.Owner, attrs.Group, info.Size(), true, nil
+}
@@ -0,0 +1,364 @@
+package jfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"jamserver/internal/s3"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NOTE: files as objects of an S3 bucket, the key of a file is its name
+// under the prefix. Directories are key prefixes, each with an empty
+// "name/" marker object (like the AWS console makes) so empty ones stay.
+// Renaming a directory copies and deletes every object below it, it's not
+// atomic.
+
+// s3PartSize is how much of an upload is buffered before it goes out as one
+// part of a multipart upload
+const s3PartSize = 8 << 20
+
+type S3Backend struct {
+	client *s3.Client
+	prefix string // "" or ending in "/"
+}
+
+// NewS3Backend keeps the files in the bucket of client, below prefix
+func NewS3Backend(client *s3.Client, prefix string) *S3Backend {
+	prefix = cleanPath(prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Backend{client: client, prefix: prefix}
+}
+
+func (b *S3Backend) String() string {
+	return b.client.String() + "/" + b.prefix
+}
+
+func (b *S3Backend) key(name string) string {
+	return b.prefix + cleanPath(name)
+}
+
+// dirKey is the marker of directory name and the prefix of what's in it
+func (b *S3Backend) dirKey(name string) string {
+	if name = cleanPath(name); name == "" {
+		return b.prefix
+	}
+	return b.prefix + name + "/"
+}
+
+func s3Error(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (b *S3Backend) Stat(name string) (fs.FileInfo, error) {
+	name = cleanPath(name)
+	if name == "" {
+		// the root is the bucket, a missing one is made by Mkdir("")
+		if err := b.client.HeadBucket(); err != nil {
+			return nil, s3Error("stat", name, err)
+		}
+		return fileInfo{name: "/", dir: true}, nil
+	}
+
+	object, err := b.client.HeadObject(b.key(name))
+	if err == nil {
+		return fileInfo{name: path.Base(name), size: object.Size, modTime: object.LastModified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, s3Error("stat", name, err)
+	}
+
+	// the marker comes first, it has the time the directory was made
+	listing, err := b.client.List(b.dirKey(name), "", 1)
+	if err != nil {
+		return nil, s3Error("stat", name, err)
+	}
+	if len(listing.Objects) == 0 {
+		return nil, s3Error("stat", name, fs.ErrNotExist)
+	}
+	return fileInfo{name: path.Base(name), dir: true, modTime: listing.Objects[0].LastModified}, nil
+}
+
+// needDir fails op on name unless the directory dir exists
+func (b *S3Backend) needDir(op string, name string, dir string) error {
+	info, err := b.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return s3Error(op, name, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (b *S3Backend) Open(name string) (io.ReadSeekCloser, error) {
+	object, err := b.client.HeadObject(b.key(name))
+	if err != nil {
+		return nil, s3Error("open", name, err)
+	}
+	return &s3Reader{client: b.client, key: object.Key, size: object.Size}, nil
+}
+
+// s3Reader gets the object on the first Read, from where Seek put it with a
+// range request
+type s3Reader struct {
+	client *s3.Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		body, err := r.client.GetObject(r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+func (b *S3Backend) Create(name string, offset int64) (io.WriteCloser, error) {
+	name = cleanPath(name)
+	if err := b.needDir("create", name, parentOf(name)); err != nil {
+		return nil, err
+	}
+
+	w := &s3Writer{client: b.client, key: b.key(name)}
+	if offset == 0 {
+		return w, nil
+	}
+
+	// objects can't be changed, the kept start is uploaded again
+	object, err := b.client.HeadObject(w.key)
+	if err != nil {
+		return nil, s3Error("create", name, err)
+	}
+	if offset > object.Size {
+		return nil, fmt.Errorf("offset %d is beyond end of file (%d bytes)", offset, object.Size)
+	}
+	body, err := b.client.GetObject(w.key, 0)
+	if err != nil {
+		return nil, s3Error("create", name, err)
+	}
+	defer body.Close()
+	if _, err := io.Copy(w, io.LimitReader(body, offset)); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// s3Writer uploads in one PutObject on Close, or as a multipart upload once
+// there is more than a part. Nothing shows up in the bucket before Close.
+type s3Writer struct {
+	client   *s3.Client
+	key      string
+	buf      []byte
+	uploadID string
+	etags    []string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize {
+		if err := w.sendPart(w.buf[:s3PartSize]); err != nil {
+			return 0, err
+		}
+		w.buf = slices.Delete(w.buf, 0, s3PartSize)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) sendPart(part []byte) error {
+	if w.uploadID == "" {
+		uploadID, err := w.client.CreateMultipartUpload(w.key)
+		if err != nil {
+			return err
+		}
+		w.uploadID = uploadID
+	}
+	etag, err := w.client.UploadPart(w.key, w.uploadID, len(w.etags)+1, part)
+	if err != nil {
+		return err
+	}
+	w.etags = append(w.etags, etag)
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" {
+		return w.client.PutObject(w.key, w.buf)
+	}
+	if len(w.buf) > 0 {
+		if err := w.sendPart(w.buf); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.client.CompleteMultipartUpload(w.key, w.uploadID, w.etags); err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+// Abort throws the parts away, the object stays as it was
+func (w *s3Writer) Abort() error {
+	w.buf = nil
+	if w.uploadID == "" {
+		return nil
+	}
+	uploadID := w.uploadID
+	w.uploadID = ""
+	return w.client.AbortMultipartUpload(w.key, uploadID)
+}
+
+func (b *S3Backend) Remove(name string) error {
+	name = cleanPath(name)
+	if name == "" {
+		return s3Error("remove", name, fs.ErrPermission)
+	}
+	if _, err := b.client.HeadObject(b.key(name)); err == nil {
+		return b.client.DeleteObject(b.key(name))
+	}
+
+	listing, err := b.client.List(b.dirKey(name), "", 2)
+	if err != nil {
+		return s3Error("remove", name, err)
+	}
+	switch {
+	case len(listing.Objects) == 0:
+		return s3Error("remove", name, fs.ErrNotExist)
+	case len(listing.Objects) > 1 || listing.Objects[0].Key != b.dirKey(name):
+		return s3Error("remove", name, fmt.Errorf("directory not empty"))
+	}
+	return b.client.DeleteObject(b.dirKey(name))
+}
+
+func (b *S3Backend) Rename(oldName string, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	info, err := b.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	if oldName == "" || newName == "" || strings.HasPrefix(newName, oldName+"/") {
+		return s3Error("rename", oldName, fs.ErrInvalid)
+	}
+	if err := b.needDir("rename", newName, parentOf(newName)); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if err := b.client.CopyObject(b.key(oldName), b.key(newName)); err != nil {
+			return err
+		}
+		return b.client.DeleteObject(b.key(oldName))
+	}
+
+	if _, err := b.Stat(newName); err == nil {
+		return s3Error("rename", newName, fs.ErrExist)
+	}
+	listing, err := b.client.List(b.dirKey(oldName), "", 0)
+	if err != nil {
+		return err
+	}
+	for _, object := range listing.Objects {
+		to := b.dirKey(newName) + strings.TrimPrefix(object.Key, b.dirKey(oldName))
+		if err := b.client.CopyObject(object.Key, to); err != nil {
+			return err
+		}
+	}
+	for _, object := range listing.Objects {
+		if err := b.client.DeleteObject(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) Mkdir(name string) error {
+	name = cleanPath(name)
+	if name == "" {
+		return b.client.CreateBucket()
+	}
+	if _, err := b.Stat(name); err == nil {
+		return s3Error("mkdir", name, fs.ErrExist)
+	}
+	if err := b.needDir("mkdir", name, parentOf(name)); err != nil {
+		return err
+	}
+	return b.client.PutObject(b.dirKey(name), nil)
+}
+
+func (b *S3Backend) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = cleanPath(name)
+	listing, err := b.client.List(b.dirKey(name), "/", 0)
+	if err != nil {
+		return nil, s3Error("readdir", name, err)
+	}
+	if name != "" && len(listing.Objects) == 0 && len(listing.Prefixes) == 0 {
+		return nil, s3Error("readdir", name, fs.ErrNotExist)
+	}
+
+	var entries []fs.DirEntry
+	for _, object := range listing.Objects {
+		base := strings.TrimPrefix(object.Key, b.dirKey(name))
+		if base == "" || strings.Contains(base, "/") {
+			continue // the marker, or a marker below some stores don't roll up
+		}
+		info := fileInfo{name: base, size: object.Size, modTime: object.LastModified}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	for _, prefix := range listing.Prefixes {
+		info := fileInfo{name: path.Base(prefix), dir: true}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// Chtimes can't be done, objects get the time they were written
+func (b *S3Backend) Chtimes(name string, _ time.Time, _ time.Time) error {
+	return s3Error("chtimes", name, errors.ErrUnsupported)
+}
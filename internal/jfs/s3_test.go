@@ -0,0 +1,166 @@
+package jfs
+
+import (
+	"bytes"
+	"io"
+	"jamserver/internal/s3"
+	"jamserver/internal/s3/s3test"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func init() {
+	testBackends["s3"] = func(t *testing.T) Backend {
+		b, _ := newTestS3(t)
+		return b
+	}
+}
+
+func newTestS3(t *testing.T) (*S3Backend, *s3test.Server) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	client, err := s3.New(server.URL, "", "bucket", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewS3Backend(client, "files")
+	if err := b.Mkdir(""); err != nil {
+		t.Fatal(err)
+	}
+	return b, server
+}
+
+func TestS3Multipart(t *testing.T) {
+	b, server := newTestS3(t)
+	data := make([]byte, 2*s3PartSize+1000)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+
+	w, err := b.Create("big", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd writes, the parts are cut at s3PartSize all the same
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 3<<20+7)
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Requests("PUT multipart"); got != 3 {
+		t.Errorf("%d parts uploaded, want 3", got)
+	}
+	if got := readFile(t, b, "big"); !bytes.Equal([]byte(got), data) {
+		t.Errorf("read back %d bytes, want %d", len(got), len(data))
+	}
+
+	// REST in the second part: the kept start goes up again
+	w, err = b.Create("big", s3PartSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "tail")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(slices.Clone(data[:s3PartSize+10]), "tail"...)
+	if got := readFile(t, b, "big"); !bytes.Equal([]byte(got), want) {
+		t.Errorf("after REST %d bytes, want %d", len(got), len(want))
+	}
+
+	// an aborted upload leaves no parts behind
+	w, _ = b.Create("big", 0)
+	w.Write(data)
+	w.(aborter).Abort()
+	if server.Uploads() != 0 {
+		t.Errorf("%d multipart uploads left open", server.Uploads())
+	}
+	if info, err := b.Stat("big"); err != nil || info.Size() != int64(len(want)) {
+		t.Errorf("big after the abort: %v, %v", info, err)
+	}
+}
+
+func TestS3RangeRead(t *testing.T) {
+	b, _ := newTestS3(t)
+	writeFile(t, b, "f", "0123456789")
+
+	r, err := b.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tests := []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{4, io.SeekStart, "456789"},
+		{-3, io.SeekEnd, "789"},
+		{0, io.SeekEnd, ""},
+		{1, io.SeekStart, "123456789"},
+	}
+	for _, tt := range tests {
+		if _, err := r.Seek(tt.offset, tt.whence); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("seek %d/%d: %q, %v, want %q", tt.offset, tt.whence, got, err, tt.want)
+		}
+	}
+}
+
+func TestS3RenameDirectory(t *testing.T) {
+	b, server := newTestS3(t)
+	b.Mkdir("a")
+	b.Mkdir("a/empty")
+	b.Mkdir("other")
+	writeFile(t, b, "a/x", "x")
+
+	if err := b.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	// the markers move along, so the empty directory stays
+	want := []string{"files/b/", "files/b/empty/", "files/b/x", "files/other/"}
+	if got := server.Keys("bucket"); !slices.Equal(got, want) {
+		t.Errorf("keys %q, want %q", got, want)
+	}
+	if err := b.Rename("b", "other"); err == nil {
+		t.Error("renamed a directory over another one")
+	}
+	if err := b.Rename("b", "b/inside"); err == nil {
+		t.Error("moved a directory into itself")
+	}
+}
+
+func TestS3Reconcile(t *testing.T) {
+	b, server := newTestS3(t)
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	server.PageSize = 2
+	for _, key := range []string{"files/a", "files/dir/", "files/dir/b", "files/dir/sub/c"} {
+		server.Put("bucket", key, []byte(key), modified)
+	}
+
+	x := NewIndex(b, filepath.Join(t.TempDir(), "filesystem.json"))
+	if err := x.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	// sizes and times come from the listing, no request per object
+	if got := server.Requests("HEAD object"); got != 0 {
+		t.Errorf("%d HEAD requests", got)
+	}
+	for name, size := range map[string]int64{"a": 7, "dir/b": 11, "dir/sub/c": 15} {
+		node := x.node(name)
+		if node == nil || node.Size != size || !node.LastModified.Equal(modified) {
+			t.Errorf("%v: %+v", name, node)
+		}
+	}
+	if node := x.node("dir/sub"); node == nil || !node.IsDir() {
+		t.Errorf("dir/sub: %+v", node)
+	}
+}
@@ -0,0 +1,100 @@
+package jfs
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// NOTE: files put into the file system next to the server (scp, a cron job,
+// another service) are picked up while it runs. On linux inotify tells about
+// them, elsewhere or when inotify fails the whole tree is rescanned every
+// now and then.
+
+// Watch keeps the index in line with changes made on disk by others, it
+// blocks for the lifetime of the server. rescan is the interval of the
+// fallback, 0 turns it off.
+func (x *Index) Watch(rescan time.Duration) {
+	if _, ok := x.backend.(indexedBackend); ok {
+		return // its names change through the index only
+	}
+	err := errors.New("no change events from this backend")
+	if local, ok := x.backend.(*LocalBackend); ok {
+		err = x.watchEvents(local.Root)
+	}
+	if rescan <= 0 {
+		slog.Warn("file system changes by others are not picked up", "backend", x.backend, "error", err)
+		return
+	}
+	slog.Warn("watching file system failed, rescanning instead", "backend", x.backend, "interval", rescan, "error", err)
+
+	for range time.Tick(rescan) {
+		if err := x.Reconcile(); err != nil {
+			slog.Error("rescanning file system failed", "backend", x.backend, "error", err)
+		}
+	}
+}
+
+// refreshPath reads name from the backend again, its node is dropped when
+// it's gone and a directory is rescanned as a whole
+func (x *Index) refreshPath(name string) error {
+	started := time.Now()
+	info, statErr := x.backend.Stat(name)
+	if statErr != nil && !errors.Is(statErr, os.ErrNotExist) {
+		return statErr
+	}
+	var tree *scanned
+	if statErr == nil && info.IsDir() {
+		var err error
+		if tree, err = scan(x.backend, name); err != nil {
+			return err
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.load(); err != nil {
+		return err
+	}
+
+	if statErr != nil {
+		if node := x.detach(name); node != nil {
+			x.account(node, -1)
+			x.dirty = true
+		}
+		return nil
+	}
+
+	node := x.ensure(name, info.IsDir(), info.ModTime())
+	x.account(node, -1)
+	defer x.account(node, 1)
+	x.dirty = true
+	node.LastModified = info.ModTime()
+	if info.IsDir() {
+		merge(node, tree, started)
+		return nil
+	}
+	node.Size = info.Size()
+	return nil
+}
+
+// movePath follows a rename done by others, owner, mode and acls go along
+func (x *Index) movePath(oldName string, newName string) error {
+	info, err := x.backend.Stat(newName)
+	if err != nil {
+		// moved on again already, both ends are read from disk
+		if err := x.refreshPath(oldName); err != nil {
+			return err
+		}
+		return x.refreshPath(newName)
+	}
+	if err := x.rename(oldName, newName, info); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// a directory the index didn't know yet has its content scanned
+		return x.refreshPath(newName)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+//go:build linux
+
+package jfs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// moveWindow is how long a MOVED_FROM waits for its MOVED_TO, the two can
+// end up in different reads
+const moveWindow = 250 * time.Millisecond
+
+// watcher has an inotify watch on every directory of the tree
+type watcher struct {
+	x     *Index
+	root  string
+	fd    int
+	dirs  map[int]string         // watch descriptor to directory name
+	moves map[uint32]pendingMove // MOVED_FROM by cookie, waiting for the MOVED_TO
+}
+
+type pendingMove struct {
+	name string
+	at   time.Time
+}
+
+// watchEvents follows inotify events on the directory root until reading
+// them fails, the server's own changes come by too but they find the index
+// up to date already
+func (x *Index) watchEvents(root string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+	// through the runtime poller, reads can time out for the pending moves
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+
+	w := &watcher{x: x, root: root, fd: fd, dirs: make(map[int]string), moves: make(map[uint32]pendingMove)}
+	if err := w.addTree(""); err != nil {
+		return err
+	}
+	slog.Info("watching file system", "path", root, "directories", len(w.dirs))
+
+	buf := make([]byte, 64*1024)
+	for {
+		if err := file.SetReadDeadline(w.movesDue()); err != nil {
+			return fmt.Errorf("reading inotify events: %w", err)
+		}
+		n, err := file.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			w.expireMoves(time.Now())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading inotify events: %w", err)
+		}
+		if n < syscall.SizeofInotifyEvent {
+			return errors.New("short inotify read")
+		}
+		w.handle(buf[:n])
+		w.expireMoves(time.Now())
+	}
+}
+
+// addTree watches name and every directory below it
+func (w *watcher) addTree(name string) error {
+	top := filepath.Join(w.root, filepath.FromSlash(name))
+	return filepath.WalkDir(top, func(fullPath string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // gone again
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, fullPath, watchMask)
+		if err != nil {
+			// ENOSPC is fs.inotify.max_user_watches
+			return fmt.Errorf("watching %v: %w", fullPath, err)
+		}
+		rel, err := filepath.Rel(w.root, fullPath)
+		if err != nil {
+			return err
+		}
+		w.dirs[wd] = cleanPath(rel)
+		return nil
+	})
+}
+
+// moveDirs follows the watches of a directory moved within the tree
+func (w *watcher) moveDirs(oldName string, newName string) {
+	for wd, dir := range w.dirs {
+		if dir == oldName || strings.HasPrefix(dir, oldName+"/") {
+			w.dirs[wd] = newName + dir[len(oldName):]
+		}
+	}
+}
+
+// dropDirs stops watching a directory moved out of the tree
+func (w *watcher) dropDirs(name string) {
+	for wd, dir := range w.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// movesDue is when the oldest pending move expires, zero when there is none
+func (w *watcher) movesDue() time.Time {
+	var due time.Time
+	for _, move := range w.moves {
+		if due.IsZero() || move.at.Before(due) {
+			due = move.at
+		}
+	}
+	if due.IsZero() {
+		return due
+	}
+	return due.Add(moveWindow)
+}
+
+// expireMoves takes a MOVED_FROM which found no MOVED_TO in moveWindow for a
+// move out of the tree
+func (w *watcher) expireMoves(now time.Time) {
+	for cookie, move := range w.moves {
+		if now.Sub(move.at) < moveWindow {
+			continue
+		}
+		delete(w.moves, cookie)
+		w.dropDirs(move.name)
+		w.report(w.x.refreshPath(move.name), move.name)
+	}
+}
+
+// handle works through one read of events. A move shows up as MOVED_FROM
+// and MOVED_TO with the same cookie, not always in the same read.
+func (w *watcher) handle(buf []byte) {
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+		if offset > len(buf) {
+			break
+		}
+		name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			slog.Warn("inotify queue overflow, rescanning file system", "path", w.root)
+			clear(w.moves)
+			w.report(w.addTree(""), "")
+			w.report(w.x.Reconcile(), "")
+			continue
+		}
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, int(event.Wd))
+			continue
+		}
+		dir, ok := w.dirs[int(event.Wd)]
+		if !ok || name == "" || strings.HasPrefix(name, uploadPrefix) {
+			continue // an upload shows up once it's moved in place
+		}
+		rel := path.Join(dir, name)
+		isDir := event.Mask&syscall.IN_ISDIR != 0
+
+		switch {
+		case event.Mask&syscall.IN_MOVED_FROM != 0:
+			w.moves[event.Cookie] = pendingMove{name: rel, at: time.Now()}
+		case event.Mask&syscall.IN_MOVED_TO != 0:
+			if from, ok := w.moves[event.Cookie]; ok {
+				delete(w.moves, event.Cookie)
+				w.moveDirs(from.name, rel)
+				w.report(w.x.movePath(from.name, rel), rel)
+				continue
+			}
+			if isDir {
+				w.report(w.addTree(rel), rel)
+			}
+			w.report(w.x.refreshPath(rel), rel)
+		case event.Mask&syscall.IN_CREATE != 0 && isDir:
+			// watched before the scan, so nothing put in right away is missed
+			w.report(w.addTree(rel), rel)
+			w.report(w.x.refreshPath(rel), rel)
+		default:
+			w.report(w.x.refreshPath(rel), rel)
+		}
+	}
+}
+
+func (w *watcher) report(err error, name string) {
+	if err != nil {
+		slog.Warn("updating metadata from file system event failed", "path", name, "error", err)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package jfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// inotifyEvent is one event the way read(2) returns it
+func inotifyEvent(wd int32, mask uint32, cookie uint32, name string) []byte {
+	size := (len(name) + 1 + 15) / 16 * 16
+	buf := make([]byte, syscall.SizeofInotifyEvent+size)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(wd))
+	binary.NativeEndian.PutUint32(buf[4:], mask)
+	binary.NativeEndian.PutUint32(buf[8:], cookie)
+	binary.NativeEndian.PutUint32(buf[12:], uint32(size))
+	copy(buf[syscall.SizeofInotifyEvent:], name)
+	return buf
+}
+
+func TestWatchMoveAcrossReads(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	for _, name := range []string{"f", "h"} {
+		os.WriteFile(filepath.Join(root, name), []byte("data"), 0644)
+	}
+	x := NewIndex(NewLocalBackend(root), filepath.Join(t.TempDir(), "filesystem.json"))
+	if err := x.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"f", "h"} {
+		if err := x.SetAttributes(name, Attributes{Owner: "alice", Mode: 0640}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &watcher{x: x, root: root, fd: -1, dirs: map[int]string{1: "", 2: "sub"}, moves: make(map[uint32]pendingMove)}
+
+	// f moves into sub, the two halves come in separate reads
+	os.Rename(filepath.Join(root, "f"), filepath.Join(root, "sub", "g"))
+	w.handle(inotifyEvent(1, syscall.IN_MOVED_FROM, 7, "f"))
+	if due := w.movesDue(); due.IsZero() {
+		t.Error("no deadline with a move pending")
+	}
+	w.handle(inotifyEvent(2, syscall.IN_MOVED_TO, 7, "g"))
+	if attrs, found, _ := x.Attributes("sub/g"); !found || attrs.Owner != "alice" {
+		t.Errorf("sub/g lost its owner: %+v, %v", attrs, found)
+	}
+	if len(w.moves) != 0 || !w.movesDue().IsZero() {
+		t.Errorf("moves still pending: %v", w.moves)
+	}
+
+	// h moves out of the tree, it's dropped once the window is over
+	os.Rename(filepath.Join(root, "h"), filepath.Join(t.TempDir(), "h"))
+	w.handle(inotifyEvent(1, syscall.IN_MOVED_FROM, 9, "h"))
+	w.expireMoves(time.Now())
+	if _, found, _ := x.Attributes("h"); !found {
+		t.Error("h dropped before its MOVED_TO could come")
+	}
+	w.expireMoves(time.Now().Add(moveWindow))
+	if _, found, _ := x.Attributes("h"); found || len(w.moves) != 0 {
+		t.Errorf("h still there after the window, %d moves pending", len(w.moves))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package jfs
+
+import "errors"
+
+func (x *Index) watchEvents(root string) error {
+	return errors.New("only supported on linux")
+}
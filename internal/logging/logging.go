@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"jamserver/internal/config"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const redacted = "[redacted]"
+
+// attributes with these keys never reach the log, whatever their value
+var secretKeys = []string{"password", "pass", "secret", "token", "hash"}
+
+var (
+	mu      sync.Mutex
+	level   = new(slog.LevelVar)
+	logFile *os.File
+)
+
+// Secret wraps a value which must never be written to the log
+type Secret string
+
+func (Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func redact(_ []string, attr slog.Attr) slog.Attr {
+	if slices.Contains(secretKeys, strings.ToLower(attr.Key)) {
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
+
+func parseLevel(value string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("unknown log level: %q", value)
+	}
+	return lvl, nil
+}
+
+// Setup installs the default slog logger described by cfg, calling it again
+// (config reload) swaps the logger for every later log call
+func Setup(cfg config.Log) error {
+	lvl, err := parseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if cfg.File != "" {
+		file, err = os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("opening log file error: %w", err)
+		}
+		out = file
+	}
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	case "text", "":
+		handler = slog.NewTextHandler(out, options)
+	default:
+		if file != nil {
+			file.Close()
+		}
+		return fmt.Errorf("unknown log format: %q", cfg.Format)
+	}
+
+	level.Set(lvl)
+	slog.SetDefault(slog.New(handler))
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
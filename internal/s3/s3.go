@@ -0,0 +1,337 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NOTE: just enough of the S3 REST API for a jfs backend, hand signed so
+// there is no SDK to pull in. Buckets are addressed path style
+// (endpoint/bucket/key), which MinIO and the other S3-compatible stores take.
+
+// MinPartSize is the smallest part of a multipart upload but the last one
+const MinPartSize = 5 << 20
+
+type Client struct {
+	endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	http      *http.Client
+}
+
+// New is a client for bucket at endpoint (e.g. "http://127.0.0.1:9000" or
+// "https://s3.eu-central-1.amazonaws.com"), region defaults to us-east-1
+func New(endpoint string, region string, bucket string, accessKey string, secretKey string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint error: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %v is not a http(s) URL", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// a big download may take long, only waiting for an answer is limited
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &Client{
+		endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *Client) String() string {
+	return c.endpoint.String() + "/" + c.Bucket
+}
+
+// Error is an error reply of the server, a missing key or bucket matches
+// fs.ErrNotExist
+type Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("s3: %v (%d)", e.Code, e.Status)
+	}
+	return fmt.Sprintf("s3: %v: %v (%d)", e.Code, e.Message, e.Status)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{Status: resp.StatusCode}
+	if xml.Unmarshal(body, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// errorInBody catches the error replies some calls send with status 200
+func errorInBody(body []byte) error {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(body, &root); err != nil || root.XMLName.Local != "Error" {
+		return nil
+	}
+	e := &Error{Status: http.StatusOK}
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// do sends a signed request for key ("" for the bucket), the body of a
+// successful reply is left to the caller
+func (c *Client) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+	}
+	c.sign(req, payloadHash, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// call is do for replies without a body worth reading
+func (c *Client) call(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	resp, err := c.do(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// decode reads an XML reply into v
+func (c *Client) decode(method string, key string, query url.Values, header http.Header, body []byte, v any) error {
+	resp, err := c.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := errorInBody(data); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func (c *Client) HeadBucket() error {
+	_, err := c.call(http.MethodHead, "", nil, nil, nil)
+	return err
+}
+
+func (c *Client) CreateBucket() error {
+	var body []byte
+	if c.Region != "us-east-1" {
+		body = []byte(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><LocationConstraint>` +
+			c.Region + `</LocationConstraint></CreateBucketConfiguration>`)
+	}
+	_, err := c.call(http.MethodPut, "", nil, nil, body)
+	return err
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+func (c *Client) HeadObject(key string) (Object, error) {
+	resp, err := c.call(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Object{}, err
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, LastModified: modified}, nil
+}
+
+// GetObject reads key from offset on with a range request
+func (c *Client) GetObject(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := c.do(http.MethodGet, key, nil, header, nil)
+	var e *Error
+	if offset > 0 && errors.As(err, &e) && e.Status == http.StatusRequestedRangeNotSatisfiable {
+		// offset is the end of the object, nothing left to read
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) PutObject(key string, data []byte) error {
+	_, err := c.call(http.MethodPut, key, nil, nil, data)
+	return err
+}
+
+func (c *Client) DeleteObject(key string) error {
+	_, err := c.call(http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+// CopyObject copies from to to within the bucket, the server does the work
+// (up to 5 GB)
+func (c *Client) CopyObject(from string, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+c.Bucket+"/"+uriEncode(from, false))
+	return c.decode(http.MethodPut, to, nil, header, nil, nil)
+}
+
+type Listing struct {
+	Objects  []Object
+	Prefixes []string // with delimiter, the "directories"
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the keys starting with prefix, rolled up at delimiter when
+// it's set. It stops after max keys and prefixes, 0 is all of them.
+func (c *Client) List(prefix string, delimiter string, max int) (Listing, error) {
+	var listing Listing
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			// a page can be shorter than asked for, the next one asks for the rest
+			query.Set("max-keys", strconv.Itoa(max-len(listing.Objects)-len(listing.Prefixes)))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result listResult
+		if err := c.decode(http.MethodGet, "", query, nil, nil, &result); err != nil {
+			return Listing{}, err
+		}
+		for _, object := range result.Contents {
+			listing.Objects = append(listing.Objects, Object{Key: object.Key, Size: object.Size, LastModified: object.LastModified})
+		}
+		for _, common := range result.CommonPrefixes {
+			listing.Prefixes = append(listing.Prefixes, common.Prefix)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" ||
+			(max > 0 && len(listing.Objects)+len(listing.Prefixes) >= max) {
+			return listing, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *Client) CreateMultipartUpload(key string) (uploadID string, err error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.decode(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart sends part number (from 1) of an upload, the ETag it returns
+// goes into CompleteMultipartUpload
+func (c *Client) UploadPart(key string, uploadID string, number int, data []byte) (etag string, err error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := c.call(http.MethodPut, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+// CompleteMultipartUpload puts the parts together, etags in part order
+func (c *Client) CompleteMultipartUpload(key string, uploadID string, etags []string) error {
+	complete := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, completePart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return c.decode(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, nil)
+}
+
+func (c *Client) AbortMultipartUpload(key string, uploadID string) error {
+	_, err := c.call(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
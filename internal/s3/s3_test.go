@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"jamserver/internal/s3/s3test"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (*Client, *s3test.Server) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, "", "bucket", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateBucket(); err != nil {
+		t.Fatal(err)
+	}
+	return c, server
+}
+
+func TestGetObjectRange(t *testing.T) {
+	c, _ := newTestClient(t)
+	if err := c.PutObject("dir/file", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset int64
+		want   string
+		err    bool
+	}{
+		{0, "0123456789", false},
+		{4, "456789", false},
+		{9, "9", false},
+		{10, "", false}, // 416, the end of the object
+		{11, "", false},
+	}
+	for _, tt := range tests {
+		body, err := c.GetObject("dir/file", tt.offset)
+		if (err != nil) != tt.err {
+			t.Errorf("offset %d: %v", tt.offset, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if string(got) != tt.want {
+			t.Errorf("offset %d: %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+
+	if _, err := c.GetObject("missing", 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing key: %v", err)
+	}
+	if _, err := c.HeadObject("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("head of a missing key: %v", err)
+	}
+	object, err := c.HeadObject("dir/file")
+	if err != nil || object.Size != 10 || time.Since(object.LastModified) > time.Minute {
+		t.Errorf("HeadObject = %+v, %v", object, err)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	c, server := newTestClient(t)
+	server.PageSize = 2
+	for _, key := range []string{"a/", "a/1", "a/2", "a/3", "a/sub/", "a/sub/x", "a/tub/y", "b"} {
+		if err := c.PutObject(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(listing Listing) []string {
+		var keys []string
+		for _, object := range listing.Objects {
+			keys = append(keys, object.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		max       int
+		objects   []string
+		prefixes  []string
+	}{
+		{"everything", "", "", 0, []string{"a/", "a/1", "a/2", "a/3", "a/sub/", "a/sub/x", "a/tub/y", "b"}, nil},
+		{"one directory", "a/", "/", 0, []string{"a/", "a/1", "a/2", "a/3"}, []string{"a/sub/", "a/tub/"}},
+		{"stops at max", "a/", "", 3, []string{"a/", "a/1", "a/2"}, nil},
+		{"max below a page", "a/", "", 1, []string{"a/"}, nil},
+		{"nothing", "c/", "/", 0, nil, nil},
+	}
+	for _, tt := range tests {
+		listing, err := c.List(tt.prefix, tt.delimiter, tt.max)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if !slices.Equal(keys(listing), tt.objects) || !slices.Equal(listing.Prefixes, tt.prefixes) {
+			t.Errorf("%v: objects %q prefixes %q, want %q %q", tt.name, keys(listing), listing.Prefixes, tt.objects, tt.prefixes)
+		}
+	}
+	if pages := server.Requests("GET list"); pages < 8 {
+		t.Errorf("%d list requests, the listings were not paged", pages)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	c, server := newTestClient(t)
+	parts := [][]byte{bytes.Repeat([]byte("a"), MinPartSize), bytes.Repeat([]byte("b"), MinPartSize), []byte("end")}
+
+	id, err := c.CreateMultipartUpload("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var etags []string
+	for i, part := range parts {
+		etag, err := c.UploadPart("big", id, i+1, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		etags = append(etags, etag)
+	}
+	if _, err := c.HeadObject("big"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("object there before the upload completed: %v", err)
+	}
+	if err := c.CompleteMultipartUpload("big", id, etags); err != nil {
+		t.Fatal(err)
+	}
+	object, err := c.HeadObject("big")
+	if err != nil || object.Size != int64(2*MinPartSize+3) {
+		t.Errorf("HeadObject = %+v, %v", object, err)
+	}
+
+	// parts but the last have a minimum size, S3 only says so at the end
+	id, _ = c.CreateMultipartUpload("small")
+	first, _ := c.UploadPart("small", id, 1, []byte("tiny"))
+	second, _ := c.UploadPart("small", id, 2, []byte("end"))
+	var e *Error
+	if err := c.CompleteMultipartUpload("small", id, []string{first, second}); !errors.As(err, &e) || e.Code != "EntityTooSmall" {
+		t.Errorf("complete with a small part: %v", err)
+	}
+	if err := c.AbortMultipartUpload("small", id); err != nil {
+		t.Fatal(err)
+	}
+	if server.Uploads() != 0 {
+		t.Errorf("%d uploads left open", server.Uploads())
+	}
+}
+
+func TestCopyAndDelete(t *testing.T) {
+	c, server := newTestClient(t)
+	c.PutObject("dir/my file", []byte("data"))
+
+	if err := c.CopyObject("dir/my file", "other/my file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteObject("dir/my file"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Keys("bucket"); !slices.Equal(got, []string{"other/my file"}) {
+		t.Errorf("keys %q", got)
+	}
+	if err := c.CopyObject("missing", "x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("copy of a missing key: %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+// Package s3test is an S3 server in memory for tests, it knows the calls
+// of the s3 client and keeps to the rules of S3 it relies on (range
+// requests, part sizes, paged listings).
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minPartSize is the smallest part of a multipart upload but the last one
+const minPartSize = 5 << 20
+
+type Server struct {
+	*httptest.Server
+
+	// PageSize caps the keys of one List reply below max-keys, small ones
+	// make the client page
+	PageSize int
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]object
+	uploads  map[string]*upload
+	requests map[string]int // by "METHOD action"
+	nextID   int
+}
+
+type object struct {
+	data     []byte
+	modified time.Time
+}
+
+type upload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+// NewServer starts a server without buckets, stop it with Close
+func NewServer() *Server {
+	s := &Server{
+		PageSize: 1000,
+		buckets:  make(map[string]map[string]object),
+		uploads:  make(map[string]*upload),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Requests tells how often call was made, e.g. "HEAD object" or "GET list"
+func (s *Server) Requests(call string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[call]
+}
+
+// Keys returns the keys in bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Uploads is the number of multipart uploads neither completed nor aborted
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Put stores an object behind the client's back, modified is its time
+func (s *Server) Put(bucket string, key string, data []byte, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]object)
+	}
+	s.buckets[bucket][key] = object{data: data, modified: modified.UTC().Truncate(time.Second)}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") || r.Header.Get("X-Amz-Date") == "" {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if want := r.Header.Get("X-Amz-Content-Sha256"); want != hashHex(body) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	// the reply is sent without mu, a client reading a body can make other calls meanwhile
+	reply := httptest.NewRecorder()
+	s.handle(reply, r, body)
+	for name, values := range reply.Header() {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(reply.Code)
+	w.Write(reply.Body.Bytes())
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, body []byte) {
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method+" "+action(key, query)]++
+
+	bucket, ok := s.buckets[bucketName]
+	if key == "" && r.Method == http.MethodPut {
+		if !ok {
+			s.buckets[bucketName] = make(map[string]object)
+		}
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.list(w, bucket, query)
+	case query.Has("uploads") && r.Method == http.MethodPost:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket: bucketName, key: key, parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case query.Has("uploadId"):
+		s.multipart(w, r, bucket, key, query, body)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.get(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		fromBucket, fromKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		from, ok := s.buckets[fromBucket][fromKey]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		bucket[key] = object{data: from.data, modified: now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+			ETag    string
+		}{ETag: etag(from.data)})
+	case r.Method == http.MethodPut:
+		bucket[key] = object{data: body, modified: now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// action names a request for Requests
+func action(key string, query url.Values) string {
+	switch {
+	case query.Has("uploads"), query.Has("uploadId"):
+		return "multipart"
+	case key == "" && query.Has("list-type"):
+		return "list"
+	case key == "":
+		return "bucket"
+	}
+	return "object"
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucket map[string]object, key string) {
+	object, ok := bucket[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+	w.Header().Set("ETag", etag(object.data))
+
+	data, status := object.data, http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if err != nil || !strings.HasSuffix(rangeHeader, "-") {
+			writeError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		if start >= len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		data, status = data[start:], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket map[string]object, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	limit := s.PageSize
+	if max, err := strconv.Atoi(query.Get("max-keys")); err == nil && max < limit {
+		limit = max
+	}
+
+	// keys and rolled up prefixes in one sorted run, the token is the last one sent
+	var names []string
+	for key := range bucket {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				key = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if !slices.Contains(names, key) {
+			names = append(names, key)
+		}
+	}
+	slices.Sort(names)
+	if token := query.Get("continuation-token"); token != "" {
+		names = slices.DeleteFunc(names, func(name string) bool { return name <= token })
+	}
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i, name := range names {
+		if i == limit {
+			result.IsTruncated, result.NextContinuationToken = true, names[i-1]
+			break
+		}
+		if object, ok := bucket[name]; ok && (delimiter == "" || !strings.HasSuffix(name, delimiter) || name == prefix) {
+			result.Contents = append(result.Contents, content{Key: name, Size: len(object.data), LastModified: object.modified.Format("2006-01-02T15:04:05.000Z")})
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: name})
+		}
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, bucket map[string]object, key string, query url.Values, body []byte) {
+	id := query.Get("uploadId")
+	upload, ok := s.uploads[id]
+	if !ok || upload.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 || number > 10000 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		upload.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			stored, ok := upload.parts[part.PartNumber]
+			if !ok || part.ETag != etag(stored) || (i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i < len(complete.Parts)-1 && len(stored) < minPartSize {
+				writeError(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			data = append(data, stored...)
+		}
+		delete(s.uploads, id)
+		bucket[key] = object{data: data, modified: now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+		}{Key: key})
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	data, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(append([]byte(xml.Header), data...))
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	var body bytes.Buffer
+	xml.NewEncoder(&body).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+	w.Write(body.Bytes())
+}
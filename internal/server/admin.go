@@ -0,0 +1,616 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NOTE: admin REST API, every request needs "Authorization: Bearer <token>"
+
+type sessionInfo struct {
+	ID            int           `json:"id"`
+	User          string        `json:"user,omitempty"`
+	Authenticated bool          `json:"authenticated"`
+	Remote        string        `json:"remote"`
+	ConnectedAt   time.Time     `json:"connected_at"`
+	WorkDir       string        `json:"cwd"`
+	Transfer      *transferInfo `json:"transfer,omitempty"`
+}
+
+type transferInfo struct {
+	Command string    `json:"command"`
+	File    string    `json:"file"`
+	Bytes   int64     `json:"bytes"`
+	Started time.Time `json:"started"`
+}
+
+type userInfo struct {
+	Login    string   `json:"login"`
+	Groups   []string `json:"groups"`
+	Disabled bool     `json:"disabled"`
+	Pending  bool     `json:"pending"`
+
+	Certificates []string `json:"certificates"`
+	TOTP         bool     `json:"totp"`
+
+	users.Access
+}
+
+func newUserInfo(user users.Credentials) userInfo {
+	return userInfo{
+		Login:        user.Login,
+		Groups:       user.Groups,
+		Disabled:     user.Disabled,
+		Pending:      user.Pending,
+		Certificates: user.Certificates,
+		TOTP:         user.SecondFactor(),
+		Access:       user.Access,
+	}
+}
+
+type userRequest struct {
+	Login    string   `json:"login"`
+	Password string   `json:"password"`
+	Groups   []string `json:"groups"`
+	Disabled bool     `json:"disabled"`
+
+	Certificates []string `json:"certificates"`
+}
+
+func serveAdmin(address string, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", adminListSessions)
+	mux.HandleFunc("DELETE /api/sessions/{id}", adminDisconnectSession)
+	mux.HandleFunc("GET /api/users", adminListUsers)
+	mux.HandleFunc("POST /api/users", adminAddUser)
+	mux.HandleFunc("GET /api/users/{login}", adminGetUser)
+	mux.HandleFunc("DELETE /api/users/{login}", adminDeleteUser)
+	mux.HandleFunc("PUT /api/users/{login}/password", adminSetPassword)
+	mux.HandleFunc("PUT /api/users/{login}/groups", adminSetGroups)
+	mux.HandleFunc("PUT /api/users/{login}/disabled", adminSetDisabled)
+	mux.HandleFunc("PUT /api/users/{login}/certificates", adminSetCertificates)
+	mux.HandleFunc("PUT /api/users/{login}/access", adminSetAccess)
+	mux.HandleFunc("POST /api/users/{login}/approve", adminApprove)
+	mux.HandleFunc("DELETE /api/users/{login}/totp", adminResetTOTP)
+	mux.HandleFunc("GET /api/groups", adminListGroups)
+	mux.HandleFunc("GET /api/invites", adminListInvites)
+	mux.HandleFunc("POST /api/invites", adminCreateInvite)
+	mux.HandleFunc("DELETE /api/invites/{code}", adminDeleteInvite)
+	mux.HandleFunc("GET /api/acls", adminListACLs)
+	mux.HandleFunc("PUT /api/acls/{dir...}", adminSetACL)
+	mux.HandleFunc("GET /api/bans", adminListBans)
+	mux.HandleFunc("DELETE /api/bans/{kind}/{target}", adminUnban)
+
+	slog.Info("admin API started", "address", address)
+	if err := http.ListenAndServe(address, requireToken(token, mux)); err != nil {
+		slog.Error("admin API failed", "address", address, "error", err)
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			slog.Warn("admin API request refused", "remote", r.RemoteAddr, "path", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+
+		slog.Info("admin API request", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Debug("writing admin API response failed", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// storeError maps user and invite store errors to http statuses
+func storeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, users.ErrNotFound), errors.Is(err, users.ErrInvalidInvite):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, users.ErrExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, users.ErrReservedLogin):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		slog.Error("admin API user store error", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// passwordAllowed checks a password an administrator sets against the same
+// policy as registration and SITE PASSWD, a refusal is written to w
+func passwordAllowed(w http.ResponseWriter, login string, password string) bool {
+	var policyErr policyError
+	err := checkPasswordPolicy(currentConfig().Registration.Password, login, password)
+	switch {
+	case errors.As(err, &policyErr):
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	case err != nil:
+		slog.Error("checking password policy failed", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func listSessions() []sessionInfo {
+	mu.Lock()
+	defer mu.Unlock()
+
+	sessions := make([]sessionInfo, 0, len(activeConnections))
+	for id, client := range activeConnections {
+		session := client.Session
+		if session == nil {
+			continue
+		}
+
+		session.mu.Lock()
+		info := sessionInfo{
+			ID:            id,
+			User:          session.Login,
+			Authenticated: session.Authenticated,
+			Remote:        client.Remote.String(),
+			ConnectedAt:   session.ConnectedAt,
+			WorkDir:       session.WorkDir,
+		}
+		if t := session.transfer; t != nil {
+			info.Transfer = &transferInfo{Command: t.Command, File: t.File, Bytes: t.Bytes(), Started: t.Started}
+		}
+		session.mu.Unlock()
+		sessions = append(sessions, info)
+	}
+
+	slices.SortFunc(sessions, func(a, b sessionInfo) int { return a.ID - b.ID })
+	return sessions
+}
+
+// disconnectSession kicks a client, a running transfer is cancelled first
+func disconnectSession(id int, reason string) bool {
+	// HandleDisconnect clears Session under mu, take what's needed before
+	mu.Lock()
+	client, ok := activeConnections[id]
+	var session *Session
+	var conn net.Conn
+	var logger *slog.Logger
+	if ok {
+		session, conn, logger = client.Session, client.Conn, client.log()
+	}
+	mu.Unlock()
+	if session == nil {
+		return false
+	}
+
+	if t := session.currentTransfer(); t != nil {
+		t.cancel()
+	}
+	session.closeData()
+
+	logger.Info("disconnecting session", "reason", reason)
+	fmt.Fprintf(conn, "\033[31m421  \033[0m%v, closing connection.\n\n", reason)
+	conn.Close() // read loop ends and cleans up the session
+	return true
+}
+
+// disconnectUser kicks every session logged in as login but except (0 for none)
+func disconnectUser(login string, reason string, except int) int {
+	var ids []int
+	for _, session := range listSessions() {
+		if session.Authenticated && session.User == login && session.ID != except {
+			ids = append(ids, session.ID)
+		}
+	}
+
+	kicked := 0
+	for _, id := range ids {
+		if disconnectSession(id, reason) {
+			kicked++
+		}
+	}
+	return kicked
+}
+
+func adminListSessions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, listSessions())
+}
+
+func adminDisconnectSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid session id: %q", r.PathValue("id")))
+		return
+	}
+
+	if !disconnectSession(id, "Disconnected by administrator") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no session %d", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminListUsers(w http.ResponseWriter, _ *http.Request) {
+	all, err := userStore.List()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	infos := make([]userInfo, 0, len(all))
+	for _, user := range all {
+		infos = append(infos, newUserInfo(user))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func adminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := userStore.Get(r.PathValue("login"))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserInfo(user))
+}
+
+func adminAddUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Login == "" || req.Password == "" || strings.ContainsAny(req.Login, " \t\r\n") {
+		writeError(w, http.StatusBadRequest, errors.New("login (without spaces) and password are required"))
+		return
+	}
+	if !passwordAllowed(w, req.Login, req.Password) {
+		return
+	}
+
+	hash, err := users.HashPassword(req.Password)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user := users.Credentials{Login: req.Login, Password: hash, Groups: req.Groups, Disabled: req.Disabled}
+	if err := userStore.Add(user); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("user added by administrator", "account", user)
+	writeJSON(w, http.StatusCreated, newUserInfo(user))
+}
+
+func adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	login := r.PathValue("login")
+	if err := userStore.Delete(login); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("user deleted by administrator", "login", login)
+	disconnectUser(login, "Account deleted by administrator", 0)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminSetPassword(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("password is required"))
+		return
+	}
+	if !passwordAllowed(w, r.PathValue("login"), req.Password) {
+		return
+	}
+
+	hash, err := users.HashPassword(req.Password)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	login := r.PathValue("login")
+	err = userStore.Update(login, func(user *users.Credentials) error {
+		user.Password = hash
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("password reset by administrator", "login", login)
+	if currentConfig().Login.EndSessionsOnPasswordChange {
+		disconnectUser(login, "Password changed, log in again", 0)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminSetGroups(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	login := r.PathValue("login")
+	var info userInfo
+	err := userStore.Update(login, func(user *users.Credentials) error {
+		user.Groups = req.Groups
+		info = newUserInfo(*user)
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	// logged in sessions keep their groups (and group limits) until they log in again
+	slog.Info("groups changed by administrator", "login", login, "groups", req.Groups)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func adminSetDisabled(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	login := r.PathValue("login")
+	var info userInfo
+	err := userStore.Update(login, func(user *users.Credentials) error {
+		user.Disabled = req.Disabled
+		info = newUserInfo(*user)
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("account status changed by administrator", "login", login, "disabled", req.Disabled)
+	if req.Disabled {
+		disconnectUser(login, "Account disabled by administrator", 0)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// adminSetCertificates replaces the tls client certificate entries of a user
+func adminSetCertificates(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	certificates := make([]string, 0, len(req.Certificates))
+	for _, value := range req.Certificates {
+		entry, err := users.ParseCertificateEntry(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		certificates = append(certificates, entry)
+	}
+
+	login := r.PathValue("login")
+	var info userInfo
+	err := userStore.Update(login, func(user *users.Credentials) error {
+		user.Certificates = certificates
+		info = newUserInfo(*user)
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("client certificates changed by administrator", "login", login, "certificates", certificates)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// adminSetAccess replaces permissions, home directory and expiry of a user,
+// sessions get the new rights when they log in again
+func adminSetAccess(w http.ResponseWriter, r *http.Request) {
+	var req users.Access
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	access, err := req.Clean()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	login := r.PathValue("login")
+	var info userInfo
+	err = userStore.Update(login, func(user *users.Credentials) error {
+		user.Access = access
+		info = newUserInfo(*user)
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("access changed by administrator", "login", login, "permissions", access.Permissions, "home", access.Home, "expires", access.Expires)
+	disconnectUser(login, "Access changed, log in again", 0)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func adminApprove(w http.ResponseWriter, r *http.Request) {
+	login := r.PathValue("login")
+	var info userInfo
+	err := userStore.Update(login, func(user *users.Credentials) error {
+		user.Pending = false
+		info = newUserInfo(*user)
+		return nil
+	})
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("account approved by administrator", "login", login)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// adminResetTOTP turns the second factor off for a user who lost the device
+// and the recovery codes
+func adminResetTOTP(w http.ResponseWriter, r *http.Request) {
+	login := r.PathValue("login")
+	err := userStore.DisableTOTP(login, "")
+	if errors.Is(err, users.ErrNoTOTP) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("TOTP reset by administrator", "login", login)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminListGroups(w http.ResponseWriter, _ *http.Request) {
+	groups, err := userStore.Groups()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func adminListBans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, loginGuard.Bans())
+}
+
+func adminUnban(w http.ResponseWriter, r *http.Request) {
+	kind, target := r.PathValue("kind"), r.PathValue("target")
+	found, err := loginGuard.Unban(kind, target)
+	if err != nil {
+		slog.Error("saving ban list failed", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no ban for %v %v", kind, target))
+		return
+	}
+
+	slog.Info("ban lifted by administrator", "kind", kind, "target", target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminListInvites(w http.ResponseWriter, _ *http.Request) {
+	list, err := invites().List()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if list == nil {
+		list = []users.Invite{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func adminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Groups     []string `json:"groups"`
+		ValidHours int      `json:"valid_hours"` // 0 never expires
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.ValidHours < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("valid_hours must not be negative"))
+		return
+	}
+
+	invite, err := invites().Create(req.Groups, time.Duration(req.ValidHours)*time.Hour)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("invite created by administrator", "groups", invite.Groups, "expires", invite.Expires)
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+func adminDeleteInvite(w http.ResponseWriter, r *http.Request) {
+	if err := invites().Delete(r.PathValue("code")); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	slog.Info("invite deleted by administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminListACLs(w http.ResponseWriter, _ *http.Request) {
+	lists, err := globalFileSystem.Index.ACLs()
+	if err != nil {
+		slog.Error("reading acls failed", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lists)
+}
+
+// adminSetACL replaces the access list of a directory, an empty list removes it
+func adminSetACL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Entries []jfs.ACLEntry `json:"entries"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	dir := r.PathValue("dir")
+	err := globalFileSystem.Index.SetACL(dir, req.Entries)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no directory /%v", dir))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	slog.Info("acl changed by administrator", "dir", "/"+dir, "entries", req.Entries)
+	w.WriteHeader(http.StatusNoContent)
+}
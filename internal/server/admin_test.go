@@ -0,0 +1,49 @@
+package server
+
+import (
+	"jamserver/internal/config"
+	"jamserver/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminAddUser(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.Registration.Password = config.PasswordPolicy{MinLength: 8, MinClasses: 2}
+	})
+	saved := userStore
+	userStore = users.NewStore(filepath.Join(t.TempDir(), "db.json"))
+	t.Cleanup(func() { userStore = saved })
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"ok", `{"login": "alice", "password": "Secretpass1"}`, http.StatusCreated},
+		{"taken", `{"login": "alice", "password": "Secretpass1"}`, http.StatusConflict},
+		{"anonymous", `{"login": "anonymous", "password": "Secretpass1"}`, http.StatusBadRequest},
+		{"ftp", `{"login": "Ftp", "password": "Secretpass1"}`, http.StatusBadRequest},
+		{"too short", `{"login": "bob", "password": "Short1"}`, http.StatusBadRequest},
+		{"one class", `{"login": "bob", "password": "secretpassword"}`, http.StatusBadRequest},
+		{"login in the password", `{"login": "carol", "password": "Carol12345"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		adminAddUser(w, httptest.NewRequest("POST", "/api/users", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%v: %d %v, want %d", tt.name, w.Code, strings.TrimSpace(w.Body.String()), tt.code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/api/users/alice/password", strings.NewReader(`{"password": "weak"}`))
+	r.SetPathValue("login", "alice")
+	adminSetPassword(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("weak password set with %d", w.Code)
+	}
+}
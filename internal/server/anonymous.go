@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"jamserver/internal/config"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// NOTE: anonymous ftp, rfc 1635
+
+// anonymous sessions log in under this name, whatever they sent with USER
+const anonymousLogin = "anonymous"
+
+var (
+	anonymousMu       sync.RWMutex
+	anonymousRoot     *jfs.FileSystem // nil while anonymous logins are off
+	anonymousIncoming *jfs.FileSystem // nil while anonymous uploads are off
+
+	// names in incoming an anonymous upload is writing right now
+	incomingMu      sync.Mutex
+	incomingUploads = make(map[string]bool)
+)
+
+// applyAnonymousConfig sets up the anonymous area on startup and config reload
+func applyAnonymousConfig(cfg config.Anonymous) error {
+	var root, incoming *jfs.FileSystem
+	if cfg.Enabled {
+		if err := os.MkdirAll(cfg.Root, 0755); err != nil {
+			return fmt.Errorf("creating anonymous root error: %w", err)
+		}
+		root = jfs.NewFileSystem(cfg.Root)
+		root.ReadOnly = true
+
+		if cfg.Incoming != "" {
+			if err := os.MkdirAll(cfg.Incoming, 0755); err != nil {
+				return fmt.Errorf("creating anonymous incoming error: %w", err)
+			}
+			incoming = jfs.NewFileSystem(cfg.Incoming)
+		}
+	}
+
+	anonymousMu.Lock()
+	anonymousRoot, anonymousIncoming = root, incoming
+	anonymousMu.Unlock()
+	return nil
+}
+
+func anonymousFileSystems() (root *jfs.FileSystem, incoming *jfs.FileSystem) {
+	anonymousMu.RLock()
+	defer anonymousMu.RUnlock()
+	return anonymousRoot, anonymousIncoming
+}
+
+func isAnonymousLogin(login string) bool {
+	if root, _ := anonymousFileSystems(); root == nil {
+		return false
+	}
+	return users.ReservedLogin(login)
+}
+
+// validAnonymousPassword wants something shaped like an email address, the
+// domain may be left out as plenty of clients send "user@"
+func validAnonymousPassword(password string) bool {
+	local, _, found := strings.Cut(password, "@")
+	return found && local != "" && len(password) <= 254 &&
+		strings.Count(password, "@") == 1 && !strings.ContainsAny(password, " \t")
+}
+
+// anonymousPass finishes an anonymous login, caller holds loginMu
+func anonymousPass(client *Client, password string) {
+	if !validAnonymousPassword(password) {
+		loginsTotal.Inc("failure")
+		client.log().Info("anonymous login without email address")
+		client.Conn.Write([]byte("\033[31m530  \033[0mSend your email address as password, e.g. guest@example.com.\n\n"))
+		return
+	}
+
+	root, incoming := anonymousFileSystems()
+	if root == nil {
+		// turned off by a config reload between USER and PASS
+		client.Conn.Write([]byte("\033[31m530  \033[0mAnonymous login is not allowed.\n\n"))
+		return
+	}
+
+	client.Session.Groups = nil
+	client.Session.FileSystem = root
+	client.Session.Incoming = incoming
+	client.Session.AnonymousEmail = password
+	client.Session.Permissions = []users.Permission{users.PermList, users.PermRead}
+	if incoming != nil {
+		client.Session.Permissions = append(client.Session.Permissions, users.PermWrite)
+	}
+	if limitErr := loginAnonymous(client.Session, client.ip()); limitErr != nil {
+		fmt.Fprintf(client.Conn, "\033[31m421  \033[0mService not available, %v.\n\n", limitErr)
+		client.Conn.Close() // read loop ends and cleans up the session
+		return
+	}
+
+	loginsTotal.Inc("anonymous")
+	client.log().Info("anonymous user logged in", "email", password)
+
+	client.Conn.Write([]byte("\033[32m230  \033[0mAnonymous login okay, access restrictions apply.\n\n"))
+	updateHelpConnection(client)
+}
+
+// anonymousUpload checks a STOR of an anonymous session and picks the file
+// in the drop box, refused uploads get their reply here. Nothing in incoming
+// can be overwritten, appended to or resumed, so guests can't touch each
+// other's uploads. The name stays taken until release is called, two guests
+// sending the same name at once can't both get it.
+func anonymousUpload(client *Client, command string, filename string) (fileSystem *jfs.FileSystem, name string, release func(), ok bool) {
+	incoming := client.Session.Incoming
+	if incoming == nil {
+		client.Conn.Write([]byte("\033[31m550  \033[0mAnonymous uploads are not allowed.\n\n"))
+		return nil, "", nil, false
+	}
+
+	if command == "APPE" || client.Session.RestartOffset > 0 {
+		client.Session.RestartOffset = 0
+		client.Conn.Write([]byte("\033[31m550  \033[0mAnonymous uploads can't be appended to or restarted.\n\n"))
+		return nil, "", nil, false
+	}
+
+	// the drop box is offered as incoming/, plain names land there too
+	filename = strings.TrimPrefix(strings.TrimPrefix(filename, "/"), "incoming/")
+	key := path.Clean("/" + filename)
+	if filename == "" || key == "/" {
+		client.Conn.Write([]byte("\033[31m553  \033[0mFile name not allowed.\n\n"))
+		return nil, "", nil, false
+	}
+
+	incomingMu.Lock()
+	defer incomingMu.Unlock()
+	if incomingUploads[key] || incoming.Exists(filename) {
+		fmt.Fprintf(client.Conn, "\033[31m553  \033[0mFile name not allowed, %s already exists.\n\n", filename)
+		return nil, "", nil, false
+	}
+	incomingUploads[key] = true
+
+	release = func() {
+		incomingMu.Lock()
+		defer incomingMu.Unlock()
+		delete(incomingUploads, key)
+	}
+	return incoming, filename, release, true
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"jamserver/internal/jfs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// discardConn takes the replies of a test client
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestValidAnonymousPassword(t *testing.T) {
+	tests := map[string]bool{
+		"guest@example.com":  true,
+		"guest@":             true,
+		"@example.com":       false,
+		"guest":              false,
+		"a@b@c":              false,
+		"guest @example.com": false,
+	}
+	for password, want := range tests {
+		if got := validAnonymousPassword(password); got != want {
+			t.Errorf("validAnonymousPassword(%q) = %v", password, got)
+		}
+	}
+}
+
+func TestAnonymousUploadNames(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "taken.txt"), []byte("x"), 0644)
+	guest := func() *Client {
+		return &Client{Conn: discardConn{}, Session: &Session{Anonymous: true, Incoming: jfs.NewFileSystem(dir)}}
+	}
+
+	tests := []struct {
+		command, name string
+		ok            bool
+	}{
+		{"STOR", "new.txt", true},
+		{"STOR", "/incoming/other.txt", true},
+		{"STOR", "taken.txt", false},
+		{"APPE", "more.txt", false},
+		{"STOR", "incoming/", false},
+	}
+	for _, tt := range tests {
+		_, _, release, ok := anonymousUpload(guest(), tt.command, tt.name)
+		if ok != tt.ok {
+			t.Errorf("%v %v: ok = %v, want %v", tt.command, tt.name, ok, tt.ok)
+		}
+		if ok {
+			release()
+		}
+	}
+
+	// the second guest can't have the name while the first one uploads
+	_, name, release, ok := anonymousUpload(guest(), "STOR", "same.txt")
+	if !ok || name != "same.txt" {
+		t.Fatalf("first upload refused")
+	}
+	if _, _, _, ok := anonymousUpload(guest(), "STOR", "/incoming/same.txt"); ok {
+		t.Error("second upload of the same name accepted")
+	}
+	release()
+	if _, _, release, ok := anonymousUpload(guest(), "STOR", "same.txt"); !ok {
+		t.Error("name still taken after the first upload ended")
+	} else {
+		release()
+	}
+}
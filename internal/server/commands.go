@@ -1,25 +1,39 @@
 package server
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"jamserver/internal/dtp"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"jamserver/internal/xferlog"
 	"jamserver/pkg/utils"
-	"log"
 	"net"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 func closeDTPConnection(client *Client) {
-	if client.Session.DTPConnection != nil {
-		client.Session.DTPConnection.Close()
-		client.Session.DTPConnection = nil
+	client.Session.closeData()
+}
+
+// commands which can be sent between PASV and the transfer without dropping the data connection
+var dataCommands = []string{"LIST", "RETR", "STOR", "APPE", "MODE", "REST"}
+
+// arguments of these commands hold passwords and never go to the log
+var secretCommands = []string{"PASS", "RGSR", "ACCT"}
+
+func commandArgs(command string, args []string) string {
+	if slices.Contains(secretCommands, command) {
+		return "[redacted]"
 	}
-	client.Session.Passive = false // Reset passive mode state
+	if command == "SITE" {
+		return siteArgs(args)
+	}
+	return strings.Join(args, " ")
 }
 
 // using command pattern for a while, maybe will refactor to COR when annoying
@@ -30,21 +44,46 @@ func HandleCommands(client *Client, command string, args []string) {
 		"RGSR": handleRegister,
 		"USER": handleLogin,
 		"PASS": handlePass,
+		"ACCT": handleAcct,
 		"QUIT": handleQuit,
 		"HELP": handleHelp,
 		"PASV": handlePassive,
 		"LIST": handleList,
 		"RETR": handleRetrieve,
 		"STOR": handleStore,
+		"MODE": handleMode,
+		"REST": handleRestart,
+		"ABOR": handleAbort,
+		"NOOP": handleNoop,
+		"APPE": handleAppend,
+		"DELE": handleDelete,
+		"MKD":  handleMakeDir,
+		"RNFR": handleRenameFrom,
+		"RNTO": handleRenameTo,
+		"SITE": handleSite,
+		"AUTH": handleAuth,
+		"PBSZ": handlePBSZ,
+		"PROT": handleProt,
 	}
 
+	client.log().Debug("command received", "command", command, "args", commandArgs(command, args))
+
 	if result, ok := commands[command]; ok {
-		if command != "LIST" && command != "RETR" && command != "STOR" {
+		// commands run concurrently, never pull the data connection from under a running transfer
+		if !slices.Contains(dataCommands, command) && client.Session.currentTransfer() == nil {
 			closeDTPConnection(client) // Ensure no residual DTP state
 		}
-		result(client, args)
+		reply := &replyRecorder{Conn: client.Conn}
+		commandClient := *client
+		commandClient.Conn = reply
+		result(&commandClient, args)
+		if commandClient.Conn != reply {
+			client.Conn = commandClient.Conn // AUTH put TLS on the connection
+		}
+		commandsTotal.Inc(command, reply.code())
 	} else {
 		client.Conn.Write([]byte("\033[31m502  \033[0mCommand not implemented.\n\n"))
+		commandsTotal.Inc("UNKNOWN", "502") // verbs from the wire would blow up the label set
 	}
 }
 
@@ -52,62 +91,88 @@ func handleEcho(client *Client, value []string) {
 	fmt.Fprintf(client.Conn, "\033[32m200  \033[0m%v \n\n", strings.Join(value, " "))
 }
 
+// any command resets the idle timer, NOOP is there for clients that only want that
+func handleNoop(client *Client, _ []string) {
+	client.Conn.Write([]byte("\033[32m200  \033[0mNOOP ok.\n\n"))
+}
+
 func handleHello(client *Client, _ []string) {
 	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mHello\n\n")
 }
 
-type Credentials struct {
-	Login    string `json:"login"`
-	Password string `json:"password"`
-}
+func handleRegister(client *Client, value []string) {
+	registration := currentConfig().Registration
+	mode := strings.ToLower(registration.Mode)
 
-func isLoginUnique(users []Credentials, login string) bool {
-	for _, user := range users {
-		if user.Login == login {
-			return false
-		}
+	if mode == "disabled" {
+		client.Conn.Write([]byte("\033[31m502  \033[0mRegistration is disabled, ask the administrator for an account.\n\n"))
+		return
 	}
-	return true
-}
 
-func handleRegister(client *Client, value []string) {
 	if len(value) < 2 {
 		client.Conn.Write([]byte("\033[31m501  \033[0mLack of arguments, exit.\n\n"))
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(value[1]), 10)
-	if err != nil {
-		client.Conn.Write([]byte("\033[31m451  \033[0mError generating password hash, maybe password is too long?\n\n"))
+	if mode == "invite" && len(value) < 3 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mRegistration needs an invite: rgsr <login> <password> <invite code>.\n\n"))
 		return
 	}
 
-	newUser := new(Credentials)
-	newUser.Login = value[0]
-	newUser.Password = string(hashedPassword)
+	if users.ReservedLogin(value[0]) {
+		fmt.Fprintf(client.Conn, "\033[31m501  \033[0mLogin %v is reserved, try again.\n\n", value[0])
+		return
+	}
+
+	var policyErr policyError
+	if err := checkPasswordPolicy(registration.Password, value[0], value[1]); errors.As(err, &policyErr) {
+		fmt.Fprintf(client.Conn, "\033[31m501  \033[0m%v, try again.\n\n", policyErr)
+		return
+	} else if err != nil {
+		client.log().Error("checking password policy failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+		return
+	}
 
-	users, err := utils.LoadJSON[[]Credentials]("app/db.json")
+	hashedPassword, err := users.HashPassword(value[1])
 	if err != nil {
-		log.Fatal("something went wrong with loading file. ", err)
-		client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+		client.Conn.Write([]byte("\033[31m451  \033[0mError generating password hash, maybe password is too long?\n\n"))
 		return
 	}
 
-	if !isLoginUnique(users, newUser.Login) {
+	newUser := new(users.Credentials)
+	newUser.Login = value[0]
+	newUser.Password = hashedPassword
+	newUser.Pending = mode == "approval"
+
+	if mode == "invite" {
+		err = invites().Use(value[2], func(invite users.Invite) error {
+			newUser.Groups = invite.Groups
+			return userStore.Add(*newUser)
+		})
+	} else {
+		err = userStore.Add(*newUser)
+	}
+	if errors.Is(err, users.ErrInvalidInvite) {
+		client.log().Warn("registration with invalid invite code", "login", newUser.Login)
+		client.Conn.Write([]byte("\033[31m530  \033[0mInvalid or expired invite code.\n\n"))
+		return
+	}
+	if errors.Is(err, users.ErrExists) {
 		client.Conn.Write([]byte("\033[31m530  \033[0mUsername exists, try again with different login. \n\n"))
 		return
 	}
-
-	users = append(users, *newUser)
-
-	err = utils.SaveJSON("app/db.json", users)
 	if err != nil {
-		log.Printf("Error saving file: %v\n", err)
+		client.log().Error("saving user database failed", "error", err)
 		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
 		return
 	}
 
-	fmt.Printf("New user registered: %v \n\n", newUser)
+	client.log().Info("user registered", "account", *newUser)
+	if newUser.Pending {
+		fmt.Fprintf(client.Conn, "\033[32m200  \033[0mRegistered as %v, the account can be used once the administrator approves it.\n\n", newUser.Login)
+		return
+	}
 	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mSuccessfully registered. Your login: %v \n\n", newUser.Login)
 }
 
@@ -127,28 +192,60 @@ func handleLogin(client *Client, value []string) {
 		return
 	}
 
-	users, err := utils.LoadJSON[[]Credentials]("app/db.json")
-	if err != nil {
-		log.Fatal("something went wrong with loading file. ", err)
+	login := value[0]
+	if rejectBanned(client, login) {
+		return
+	}
+
+	client.Session.setAnonymous(false)
+	if isAnonymousLogin(login) {
+		client.Session.setLogin(anonymousLogin)
+		client.Session.setAnonymous(true)
+		client.Session.SecondFactorPending = false
+		client.Conn.Write([]byte("\033[33m331  \033[0mAnonymous login okay, send your email address as password.\n\n"))
+		return
 	}
 
-	login := value[0]
 	if len(login) > 0 {
 		// preventing panic with idx out of range
-		client.Session.Login = ""
-		for _, user := range users {
-			if login == user.Login {
-				client.Session.Login = login
-				client.Conn.Write([]byte("\033[33m331  \033[0mUser okay, need password.  \n\n"))
+		client.Session.setLogin("")
+		client.Session.SecondFactorPending = false
+		user, err := userStore.Get(login)
+		if err == nil {
+			client.Session.setLogin(login)
+			// a client certificate of the account stands in for PASS, rfc 2228
+			if cert := client.Session.PeerCertificate; cert != nil && user.CertificateMatches(cert, client.Session.CertificateVerified) {
+				client.Session.loginMu.Lock()
+				defer client.Session.loginMu.Unlock()
+				if user.SecondFactor() {
+					client.Session.SecondFactorPending = true
+					client.Session.FirstFactor = "certificate"
+					client.Conn.Write([]byte("\033[33m332  \033[0mClient certificate ok, send the one-time code: acct <code>.\n\n"))
+					return
+				}
+				completeLogin(client, user, "certificate", "\033[32m232  \033[0mUser logged in, authorized by client certificate.\n\n")
 				return
 			}
+			client.Conn.Write([]byte("\033[33m331  \033[0mUser okay, need password.  \n\n"))
+			return
+		}
+		if !errors.Is(err, users.ErrNotFound) {
+			client.log().Error("loading user database failed", "error", err)
+			client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+			return
+		}
+		// an unknown login counts against the IP, probing for accounts gets
+		// the same delay and lockout as guessing passwords
+		if passwordFailed(client) {
+			fmt.Fprintf(client.Conn, "\033[33m332 \033[0mNeed account for login. \n\n")
 		}
-		fmt.Fprintf(client.Conn, "\033[33m332 \033[0mNeed account for login. \n\n")
-		client.Session.Login = ""
 	}
 }
 
 func handlePass(client *Client, value []string) {
+	client.Session.loginMu.Lock()
+	defer client.Session.loginMu.Unlock()
+
 	if client.Session.Authenticated {
 		fmt.Fprintf(client.Conn, "\033[33m435  \033[0mYou are already logged in.. \n\n")
 		return
@@ -165,37 +262,51 @@ func handlePass(client *Client, value []string) {
 	}
 
 	password := value[0]
-	if len(password) > 0 {
-		users, err := utils.LoadJSON[[]Credentials]("app/db.json")
-		if err != nil {
-			log.Fatal("something went wrong with loading file. ", err)
-		}
+	if client.Session.Anonymous {
+		anonymousPass(client, password)
+		return
+	}
 
+	if len(password) > 0 {
 		if len(client.Session.Login) > 0 {
+			if rejectBanned(client, client.Session.Login) {
+				return
+			}
 
-			idx := slices.IndexFunc(users, func(u Credentials) bool { return u.Login == client.Session.Login })
+			user, err := userStore.Get(client.Session.Login)
+			if err != nil && !errors.Is(err, users.ErrNotFound) {
+				client.log().Error("loading user database failed", "error", err)
+				client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+				return
+			}
 
-			if idx >= 0 {
-				err := bcrypt.CompareHashAndPassword([]byte(users[idx].Password), []byte(password))
-				if err != nil {
-					client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
-					return
-				} else {
-					client.Session.Authenticated = true
-
-					fmt.Fprintf(client.Conn, "\033[32m230  \033[0mUser logged in, proceed. \n\n")
-					// Update help connection with expanded commands
-					if client.Session.HelpConnection != nil {
-						availableCommands := getAvailableCommands(client) // Expanded commands after login
-						commandList := strings.Join(availableCommands, " ") + "\n"
-
-						if _, err := client.Session.HelpConnection.Write([]byte(commandList)); err != nil {
-							fmt.Printf("Error updating commands on help connection: %v\n", err)
-						}
-					}
+			if err != nil {
+				// deleted between USER and PASS
+				loginFailed(client)
+				return
+			}
+			if !user.CheckPassword(password) {
+				// clients without ACCT send the one-time code glued to the password
+				code, prefix := "", ""
+				if cut := len(password) - 6; user.SecondFactor() && cut > 0 {
+					prefix, code = password[:cut], password[cut:]
+				}
+				if code == "" || !user.CheckPassword(prefix) {
+					loginFailed(client)
 					return
 				}
+				client.Session.FirstFactor = "password"
+				checkSecondFactor(client, code)
+				return
+			}
+			if user.SecondFactor() {
+				client.Session.SecondFactorPending = true
+				client.Session.FirstFactor = "password"
+				client.Conn.Write([]byte("\033[33m332  \033[0mPassword ok, send the one-time code: acct <code>.\n\n"))
+				return
 			}
+			completeLogin(client, user, "password", "\033[32m230  \033[0mUser logged in, proceed. \n\n")
+			return
 		} else {
 			client.Conn.Write([]byte("\033[31m503  \033[0mNot user specified. \n\n"))
 			return
@@ -203,6 +314,128 @@ func handlePass(client *Client, value []string) {
 	}
 }
 
+// ACCT <code> finishes the login of an account with TOTP after PASS
+func handleAcct(client *Client, value []string) {
+	client.Session.loginMu.Lock()
+	defer client.Session.loginMu.Unlock()
+
+	if client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[32m202  \033[0mAlready logged in, ACCT not needed.\n\n"))
+		return
+	}
+	if !client.Session.SecondFactorPending {
+		client.Conn.Write([]byte("\033[31m503  \033[0mLog in with user and pass first.\n\n"))
+		return
+	}
+	if len(value) != 1 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: acct <one-time code>.\n\n"))
+		return
+	}
+
+	checkSecondFactor(client, value[0])
+}
+
+// checkSecondFactor logs in with a TOTP or recovery code once the password was
+// right, a wrong code counts as a failed login. Caller holds loginMu.
+func checkSecondFactor(client *Client, code string) {
+	login := client.Session.Login
+	err := userStore.UseSecondFactor(login, code)
+	if errors.Is(err, users.ErrInvalidCode) {
+		client.log().Info("wrong one-time code")
+		if passwordFailed(client) {
+			client.Conn.Write([]byte("\033[31m530  \033[0mWrong or already used one-time code.\n\n"))
+		}
+		return
+	}
+	if err != nil {
+		client.log().Error("checking one-time code failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+		return
+	}
+
+	user, err := userStore.Get(login)
+	if err != nil {
+		client.log().Error("loading user database failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+		return
+	}
+
+	client.Session.SecondFactorPending = false
+	if len(user.TOTP.RecoveryCodes) < 3 {
+		client.log().Info("few recovery codes left", "left", len(user.TOTP.RecoveryCodes))
+	}
+	completeLogin(client, user, client.Session.FirstFactor+"+totp", "\033[32m230  \033[0mUser logged in, proceed. \n\n")
+}
+
+// completeLogin logs the session in once the credentials of user checked out,
+// unless the account can't be used right now
+func completeLogin(client *Client, user users.Credentials, method string, reply string) {
+	if user.Pending {
+		loginsTotal.Inc("pending")
+		client.log().Info("login to pending account refused")
+		client.Conn.Write([]byte("\033[31m530  \033[0mAccount waits for approval by the administrator.\n\n"))
+		return
+	}
+	if user.Disabled {
+		loginsTotal.Inc("disabled")
+		client.log().Warn("login to disabled account refused")
+		client.Conn.Write([]byte("\033[31m530  \033[0mAccount disabled, contact the administrator.\n\n"))
+		return
+	}
+	if user.Expired(time.Now()) {
+		loginsTotal.Inc("expired")
+		client.log().Warn("login to expired account refused", "expired", user.Expires)
+		client.Conn.Write([]byte("\033[31m530  \033[0mAccount expired, contact the administrator.\n\n"))
+		return
+	}
+
+	home, err := globalFileSystem.Sub(user.Home)
+	if err != nil {
+		client.log().Error("opening home directory failed", "home", user.Home, "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+		return
+	}
+
+	client.Session.Groups = user.Groups
+	client.Session.FileSystem = home.As(user.Login, user.Groups)
+	client.Session.FileSystem.Umask = currentConfig().Files.UmaskMode()
+	client.Session.Permissions = user.Permissions
+	if limitErr := loginUser(client.Session, user.Login); limitErr != nil {
+		fmt.Fprintf(client.Conn, "\033[31m421  \033[0mService not available, %v.\n\n", limitErr)
+		client.Conn.Close() // read loop ends and cleans up the session
+		return
+	}
+
+	loginGuard.Success(client.ip(), user.Login)
+	loginsTotal.Inc("success")
+	client.log().Info("user logged in", "method", method)
+
+	client.Conn.Write([]byte(reply))
+	updateHelpConnection(client)
+}
+
+// allowed answers 550 when the session may not do p
+func allowed(client *Client, p users.Permission) bool {
+	if users.Allows(client.Session.Permissions, p) {
+		return true
+	}
+	client.log().Info("permission denied", "permission", p)
+	fmt.Fprintf(client.Conn, "\033[31m550  \033[0mPermission denied, no %v permission.\n\n", p)
+	return false
+}
+
+// updateHelpConnection sends the expanded command list after login
+func updateHelpConnection(client *Client) {
+	if client.Session.HelpConnection != nil {
+		availableCommands := getAvailableCommands(client) // Expanded commands after login
+		commandList := strings.Join(availableCommands, " ") + "\n"
+
+		if _, err := client.Session.HelpConnection.Write([]byte(commandList)); err != nil {
+			client.log().Debug("updating HELP connection failed", "error", err)
+		}
+	}
+}
+
 func handleQuit(client *Client, _ []string) {
 	if client.Session.DTPConnection != nil {
 		client.Session.DTPConnection.Close()
@@ -210,19 +443,17 @@ func handleQuit(client *Client, _ []string) {
 	client.Session.DTPConnection = nil
 
 	client.Conn.Write([]byte("\033[32m221  \033[0mConnection closed.\n\n"))
-	client.Session.Authenticated = false
-
-	client.Session.Login = ""
+	client.Session.logOut()
+	client.Session.Groups = nil
+	client.Session.FileSystem = nil
+	client.Session.Incoming = nil
+	client.Session.AnonymousEmail = ""
+	client.Session.Permissions = nil
 }
 
+// the HELP port sends the same list, see getAvailableCommands
 func handleHelp(client *Client, _ []string) {
-	if client.Session.Authenticated {
-		fmt.Fprintf(client.Conn, "\033[32m200  \033[0mAvailable commands: \n     help, echo, hllo, rgsr, user, pass, quit, pasv, list, retr, stor  \n\n")
-		return
-	} else {
-		fmt.Fprintf(client.Conn, "\033[32m200  \033[0mAvailable commands: \n     help, echo, hllo, rgsr, user, pass, quit  \n\n")
-		return
-	}
+	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mAvailable commands: \n     %v  \n\n", strings.Join(getAvailableCommands(client), ", "))
 }
 
 func handlePassive(client *Client, _ []string) {
@@ -242,9 +473,10 @@ func handlePassive(client *Client, _ []string) {
 	}
 
 	// Always create a new listener, even if already in passive mode
-	dtpListener, err := net.Listen("tcp", "0.0.0.0:0")
+	// tcp4, a dual stack listener reports [::] which can't go into the 227 reply
+	dtpListener, err := net.Listen("tcp4", "0.0.0.0:0")
 	if err != nil {
-		fmt.Printf("Error creating listener: %v\n", err)
+		client.log().Error("creating DTP listener failed", "error", err)
 		client.Conn.Write([]byte("\033[31m425  \033[0mCan't open data connection.\n\n"))
 		return
 	}
@@ -258,13 +490,21 @@ func handlePassive(client *Client, _ []string) {
 	}
 
 	// Store the listener for potential future closure
+	ready := make(chan struct{})
+	client.Session.mu.Lock()
 	client.Session.DTPListener = dtpListener
+	client.Session.dtpReady = ready
+	client.Session.mu.Unlock()
 
 	addr := dtpListener.Addr().(*net.TCPAddr)
 	port := addr.Port
 	port1 := port / 256
 	port2 := port % 256
 	ipParts := addr.IP.To4()
+	// the listener is on all interfaces, tell the client the address it already reached us on
+	if controlAddr, ok := client.Conn.LocalAddr().(*net.TCPAddr); ok && controlAddr.IP.To4() != nil {
+		ipParts = controlAddr.IP.To4()
+	}
 	if ipParts == nil {
 		client.Conn.Write([]byte("\033[31m425  \033[0mCan't open data connection.\n\n"))
 		dtpListener.Close()
@@ -275,48 +515,87 @@ func handlePassive(client *Client, _ []string) {
 		ipParts[0], ipParts[1], ipParts[2], ipParts[3], port1, port2)
 
 	go func() {
+		defer close(ready)
 		defer func() {
 			client.Session.mu.Lock()
 			defer client.Session.mu.Unlock()
-			fmt.Println("DTP Listener is being closed")
+			client.log().Debug("closing DTP listener")
 			if err := dtpListener.Close(); err != nil {
-				fmt.Printf("Error closing DTP listener: %v\n", err)
+				client.log().Debug("closing DTP listener failed", "error", err)
 			}
 			client.Session.DTPListener = nil
 		}()
 
-		// Set a timeout for accepting the connection
-		if tcpListener, ok := dtpListener.(*net.TCPListener); ok {
-			if err := tcpListener.SetDeadline(time.Now().Add(2 * time.Minute)); err != nil {
-				fmt.Printf("Error setting deadline for DTP listener: %v\n", err)
+		// Set a timeout for accepting the connection, unless it's off
+		if tcpListener, ok := dtpListener.(*net.TCPListener); !ok {
+			client.log().Warn("DTP listener is not TCP, no accept deadline")
+		} else if timeout := dataTimeout(); timeout > 0 {
+			if err := tcpListener.SetDeadline(time.Now().Add(timeout)); err != nil {
+				client.log().Error("setting DTP listener deadline failed", "error", err)
 				return
 			}
-		} else {
-			fmt.Println("Listener is not a TCP listener; skipping deadline setup.")
 		}
 
 		// Accept a connection
 		dtpConn, acceptErr := dtpListener.Accept()
 		if acceptErr != nil {
-			fmt.Printf("Error accepting DTP connection: %v\n", acceptErr)
+			client.log().Info("accepting DTP connection failed", "error", acceptErr)
 			return
 		}
 
 		// Safely update the session state with the new DTP connection
+		dataConn, protectErr := protectData(client, dtp.NewTimeoutConn(dtpConn, dataTimeout()))
+		if protectErr != nil {
+			client.log().Warn("protecting DTP connection failed", "error", protectErr)
+			dtpConn.Close()
+			return
+		}
+
 		client.Session.mu.Lock()
-		fmt.Printf("DTP connection established: %v\n", dtpConn.RemoteAddr())
-		client.Session.DTPConnection = dtpConn
+		client.log().Debug("DTP connection established", "data_remote", dtpConn.RemoteAddr().String(), "protected", client.Session.ProtectData)
+		client.Session.DTPConnection = dataConn
 		client.Session.Passive = true
 		client.Session.mu.Unlock()
 	}()
 }
 
+// dataConnection waits until the client connects to the PASV port (up to the
+// data timeout) and returns the data connection, nil if there is none
+func dataConnection(client *Client) net.Conn {
+	client.Session.mu.Lock()
+	ready := client.Session.dtpReady
+	client.Session.mu.Unlock()
+
+	if ready != nil {
+		var expired <-chan time.Time // without a data timeout wait for the client
+		if timeout := dataTimeout(); timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-ready:
+		case <-expired:
+		}
+	}
+
+	client.Session.mu.Lock()
+	defer client.Session.mu.Unlock()
+	return client.Session.DTPConnection
+}
+
 func handleList(client *Client, args []string) {
 	if !client.Session.Authenticated {
 		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
 		return
 	}
 
+	if !allowed(client, users.PermList) {
+		return
+	}
+
+	dataConnection(client)
+
 	if !client.Session.Passive {
 		client.Conn.Write([]byte("\033[31m527  \033[0mYou are not in Passive Mode.\n\n"))
 		return
@@ -329,7 +608,7 @@ func handleList(client *Client, args []string) {
 		return
 	}
 
-	files, err := globalFileSystem.ListFiles()
+	files, err := client.Session.FileSystem.ListFiles()
 	if err != nil {
 		client.Conn.Write([]byte("\033[31m550 \033[0mCould not list directory. \n\n"))
 		client.Session.DTPConnection.Close()
@@ -353,87 +632,208 @@ func handleList(client *Client, args []string) {
 	// Prepare file list for transmission
 	filesList := utils.FormatFileList(files)
 
-	// Send actual listing via DTP connection
-	_, err = client.Session.DTPConnection.Write([]byte(filesList))
+	// Send actual listing via DTP connection, ABOR cancels it like a RETR
+	ctx, _, finish := client.Session.beginTransfer("LIST", "")
+	defer finish()
+	dataWriter := dtp.NewThrottledWriter(ctx, client.Session.DTPConnection, sessionLimiters(client.Session)...)
+	sent, err := dataWriter.Write([]byte(filesList))
+	transferBytesTotal.Add(float64(sent), "out")
+	closeDTPConnection(client)
+	if ctx.Err() != nil {
+		fmt.Fprintf(client.Conn, "\033[31m426 \033[0mConnection closed; transfer aborted after %d bytes.\n\n", sent)
+		return
+	}
 	if err != nil {
 		client.Conn.Write([]byte("\033[31m426  \033[0mConnection closed due to network error.\n\n"))
-		client.Session.DTPConnection.Close()
-		client.Session.DTPConnection = nil
-		client.Session.Passive = false
 		return
 	}
 
-	// Close the DTP connection
-	client.Session.DTPConnection.Close()
-	client.Session.DTPConnection = nil
-	client.Session.Passive = false
-
 	// Send transfer complete message
 	client.Conn.Write([]byte("\033[32m226  \033[0mDirectory send OK. \n\n"))
 }
 
 func handleRetrieve(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
 	if len(args) < 1 {
 		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments.\n   Usage: RETR <filename>\n\n"))
 		return
 	}
 
+	if !allowed(client, users.PermRead) {
+		return
+	}
+
 	filename := args[0]
 
-	fileData, err := globalFileSystem.ReadFile(filename)
+	file, size, err := client.Session.FileSystem.OpenFile(filename)
 	if err != nil {
 		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mFile not found or access denied: %s\n\n", filename)
 		return
 	}
+	defer file.Close()
 
 	// Check if client is in passive mode
-	if client.Session.DTPConnection == nil {
+	dtpConn := dataConnection(client)
+	if dtpConn == nil {
 		client.Conn.Write([]byte("\033[31m425 \033[0mUse PASV first.\n\n"))
 		return
 	}
 
-	fmt.Fprintf(client.Conn, "\033[32m150 \033[0mOpening data connection for %s.\n\n", filename)
+	offset := client.Session.RestartOffset
+	client.Session.RestartOffset = 0
+	if offset > size {
+		fmt.Fprintf(client.Conn, "\033[31m554 \033[0mRestart position %d is beyond end of file.\n\n", offset)
+		return
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		client.log().Error("seeking to restart position failed", "file", filename, "offset", offset, "error", err)
+		client.Conn.Write([]byte("\033[31m451 \033[0mServer error, please try again later.\n\n"))
+		return
+	}
+
+	ctx, t, finish := client.Session.beginTransfer("RETR", filename)
+	defer finish()
+
+	started := time.Now()
+	var n int64
+	complete := false
+	defer func() {
+		transferDone(client, xferlog.DirectionOutgoing, loggedPath(client, client.Session.FileSystem, filename), n, started, complete)
+	}()
+
+	fmt.Fprintf(client.Conn, "\033[32m150 \033[0mOpening %v mode data connection for %s.\n\n", client.Session.Mode, filename)
 
-	// Write the file data to the data connection
-	n, err := client.Session.DTPConnection.Write(fileData)
+	// Write the file data to the data connection, encoded for the current transfer mode
+	dataWriter := dtp.NewThrottledWriter(ctx, t.countWrites(dtpConn), sessionLimiters(client.Session)...)
+	writer := dtp.NewWriter(dataWriter, client.Session.Mode)
+	n, err = dtp.Send(ctx, writer, file, offset)
+	if ctx.Err() != nil {
+		fmt.Fprintf(client.Conn, "\033[31m426 \033[0mConnection closed; transfer aborted after %d bytes.\n\n", n)
+		return
+	}
 	if err != nil {
 		fmt.Fprintf(client.Conn, "\033[31m426 \033[0mConnection closed; transfer aborted: %v\n\n", err)
 		return
 	}
 
+	complete = true
 	fmt.Fprintf(client.Conn, "\033[32m226 \033[0mTransfer complete. Total bytes sent: %d.\n\n", n)
+	client.log().Info("file sent", "command", "RETR", "file", filename, "bytes", n, "offset", offset)
 
 	// Close the data connection
-	client.Session.DTPConnection.Close()
-	client.Session.DTPConnection = nil
-	client.Session.Passive = false
+	closeDTPConnection(client)
 }
 
 func handleStore(client *Client, args []string) {
+	receiveFile(client, "STOR", args)
+}
+
+func handleAppend(client *Client, args []string) {
+	receiveFile(client, "APPE", args)
+}
+
+// receiveFile reads the upload from the data connection for STOR and APPE
+func receiveFile(client *Client, command string, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
 	if len(args) < 1 {
-		fmt.Fprintf(client.Conn, "\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: STOR <filename>\n\n")
+		fmt.Fprintf(client.Conn, "\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: %v <filename>\n\n", command)
+		return
+	}
+
+	if !allowed(client, users.PermWrite) {
 		return
 	}
 
 	filename := args[0]
+	fileSystem := client.Session.FileSystem
+	if client.Session.Anonymous {
+		var release func()
+		var ok bool
+		if fileSystem, filename, release, ok = anonymousUpload(client, command, filename); !ok {
+			return
+		}
+		defer release()
+	}
 
-	if client.Session.DTPConnection == nil {
+	if err := fileSystem.CheckFile(filename, jfs.OpWrite); err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not write file: %s - %v\n\n", filename, err)
+		return
+	}
+
+	allowance, err := uploadAllowance(fileSystem, filename, command, client.Session.RestartOffset)
+	var overQuota quotaError
+	if errors.As(err, &overQuota) {
+		client.log().Info("upload over quota", "file", filename, "error", err)
+		fmt.Fprintf(client.Conn, "\033[31m552 \033[0mExceeded storage allocation, %v.\n\n", overQuota)
+		return
+	} else if err != nil {
+		client.log().Error("checking quota failed", "file", filename, "error", err)
+		client.Conn.Write([]byte("\033[31m451 \033[0mServer error, please try again later.\n\n"))
+		return
+	}
+
+	dtpConn := dataConnection(client)
+	if dtpConn == nil {
 		fmt.Fprintf(client.Conn, "\033[31m425 \033[0mUse PASV first.\n\n")
 		return
 	}
 
-	fmt.Fprintf(client.Conn, "\033[32m150 \033[0mOpening data connection for %s.\n\n", filename)
+	offset := client.Session.RestartOffset
+	client.Session.RestartOffset = 0
+	if command == "APPE" {
+		offset, _ = fileSystem.FileSize(filename) // a new file starts at 0
+	}
+
+	upload, err := fileSystem.CreateFile(filename, offset)
+	if err != nil {
+		closeDTPConnection(client)
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not write file: %s - %v\n\n", filename, err)
+		return
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			upload.Abort()
+		}
+	}()
 
-	client.Session.DTPConnection.SetReadDeadline(time.Now().Add(30 * time.Second))
+	ctx, t, finish := client.Session.beginTransfer(command, filename)
+	defer finish()
 
-	// Read all data from the connection
-	var buffer bytes.Buffer
-	buf := make([]byte, 1024)
+	// the upload goes to the file system as it comes in
+	buf := make([]byte, 32*1024)
 	totalBytes := 0
 
+	started := time.Now()
+	complete := false
+	defer func() {
+		transferDone(client, xferlog.DirectionIncoming, loggedPath(client, fileSystem, filename), int64(totalBytes), started, complete)
+	}()
+
+	fmt.Fprintf(client.Conn, "\033[32m150 \033[0mOpening %v mode data connection for %s.\n\n", client.Session.Mode, filename)
+
+	dataReader := dtp.NewThrottledReader(ctx, t.countReads(dtpConn), sessionLimiters(client.Session)...)
+	reader := dtp.NewReader(dataReader, client.Session.Mode)
+	reader.OnMark = func(marker string) {
+		// tell the client where its marker landed, it can REST there after a failure
+		fmt.Fprintf(client.Conn, "\033[33m110 \033[0mMARK %s = %d\n\n", marker, offset+int64(totalBytes))
+	}
+
 	for {
-		n, err := client.Session.DTPConnection.Read(buf)
-		print(n, err)
+		n, err := reader.Read(buf)
+		if ctx.Err() != nil {
+			// ABOR closed the data connection under us, the upload is aborted
+			fmt.Fprintf(client.Conn, "\033[31m426 \033[0mConnection closed; transfer aborted after %d bytes.\n\n", totalBytes)
+			return
+		}
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				fmt.Fprintf(client.Conn, "\033[31m426 \033[0mData connection timed out.\n\n")
@@ -447,31 +847,200 @@ func handleStore(client *Client, args []string) {
 			return
 		}
 
-		// Write to buffer
-		_, writeErr := buffer.Write(buf[:n])
-		if writeErr != nil {
-			fmt.Fprintf(client.Conn, "\033[31m426 \033[0mError buffering data: %v\n\n", writeErr)
+		totalBytes += n
+		if allowance >= 0 && int64(totalBytes) > allowance {
+			// what doesn't fit is never written, the upload is aborted
+			closeDTPConnection(client)
+			client.log().Info("upload over quota", "file", filename, "bytes", totalBytes)
+			fmt.Fprintf(client.Conn, "\033[31m552 \033[0mExceeded storage allocation; transfer aborted after %d bytes.\n\n", totalBytes)
 			return
 		}
 
-		totalBytes += n
+		if _, err := upload.Write(buf[:n]); err != nil {
+			closeDTPConnection(client)
+			fmt.Fprintf(client.Conn, "\033[31m451 \033[0mCould not write file: %s - %v\n\n", filename, err)
+			return
+		}
 	}
 
-	client.Session.DTPConnection.SetReadDeadline(time.Time{})
-
-	err := globalFileSystem.WriteFile(filename, buffer.Bytes())
-	if err != nil {
+	stored = true
+	if err := upload.Close(); err != nil {
 		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not write file: %s - %v\n\n", filename, err)
 		return
 	}
 
 	// Send success response
+	complete = true
 	fmt.Fprintf(client.Conn, "\033[32m226 \033[0mTransfer complete. Total bytes received: %d.\n\n", totalBytes)
+	client.log().Info("file received", "command", command, "file", filename, "bytes", totalBytes, "offset", offset)
 
 	// Properly close the data connection
-	if client.Session.DTPConnection != nil {
-		client.Session.DTPConnection.Close()
-		client.Session.DTPConnection = nil
+	closeDTPConnection(client)
+}
+
+func handleDelete(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
+	if len(args) < 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: DELE <filename>\n\n"))
+		return
+	}
+
+	if !allowed(client, users.PermDelete) {
+		return
+	}
+
+	filename := args[0]
+	started := time.Now()
+	logged := loggedPath(client, client.Session.FileSystem, filename)
+
+	size, _ := client.Session.FileSystem.FileSize(filename)
+	if err := client.Session.FileSystem.DeleteFile(filename); err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not delete file: %s\n\n", filename)
+		transferDone(client, xferlog.DirectionDeleted, logged, 0, started, false)
+		return
 	}
-	client.Session.Passive = false
+
+	transferDone(client, xferlog.DirectionDeleted, logged, size, started, true)
+	client.log().Info("file deleted", "file", filename)
+	fmt.Fprintf(client.Conn, "\033[32m250 \033[0mFile %s deleted.\n\n", filename)
+}
+
+// MKD, rfc 959 section 4.1.3, the new directory belongs to the user
+func handleMakeDir(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
+	if len(args) < 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: MKD <directory>\n\n"))
+		return
+	}
+
+	if !allowed(client, users.PermMkdir) {
+		return
+	}
+
+	dirName := args[0]
+	if err := client.Session.FileSystem.MakeDir(dirName); err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not create directory: %s - %v\n\n", dirName, err)
+		return
+	}
+
+	client.log().Info("directory created", "dir", dirName)
+	fmt.Fprintf(client.Conn, "\033[32m257 \033[0m\"%s\" directory created.\n\n", strings.ReplaceAll(dirName, `"`, `""`))
+}
+
+// RNFR, rfc 959 section 4.1.3, names the file the following RNTO renames
+func handleRenameFrom(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
+	if len(args) < 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: RNFR <name>\n\n"))
+		return
+	}
+
+	if !allowed(client, users.PermRename) {
+		return
+	}
+
+	if !client.Session.FileSystem.Exists(args[0]) {
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mNo such file or directory: %s\n\n", args[0])
+		return
+	}
+
+	client.Session.RenameFrom = args[0]
+	client.Conn.Write([]byte("\033[33m350 \033[0mReady for RNTO.\n\n"))
+}
+
+// RNTO, rfc 959 section 4.1.3
+func handleRenameTo(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
+	from := client.Session.RenameFrom
+	client.Session.RenameFrom = ""
+	if from == "" {
+		client.Conn.Write([]byte("\033[31m503 \033[0mBad sequence of commands, send RNFR first.\n\n"))
+		return
+	}
+
+	if len(args) < 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: RNTO <name>\n\n"))
+		return
+	}
+
+	to := args[0]
+	if err := client.Session.FileSystem.Rename(from, to); err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m550 \033[0mCould not rename %s to %s - %v\n\n", from, to, err)
+		return
+	}
+
+	client.log().Info("file renamed", "from", from, "to", to)
+	fmt.Fprintf(client.Conn, "\033[32m250 \033[0m%s renamed to %s.\n\n", from, to)
+}
+
+// ABOR, rfc 959 section 4.1.3: the aborted transfer replies 426, then ABOR itself replies 226
+func handleAbort(client *Client, _ []string) {
+	t := client.Session.currentTransfer()
+	if t == nil {
+		closeDTPConnection(client)
+		client.Conn.Write([]byte("\033[32m226 \033[0mNo transfer in progress, data connection closed.\n\n"))
+		return
+	}
+
+	client.log().Info("aborting transfer")
+	t.cancel()
+	// closing the data connection unblocks a transfer stuck in read or write
+	closeDTPConnection(client)
+	<-t.done
+
+	client.Conn.Write([]byte("\033[32m226 \033[0mAbort successful.\n\n"))
+}
+
+func handleMode(client *Client, args []string) {
+	if len(args) != 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: MODE <S|B|C>\n\n"))
+		return
+	}
+
+	mode, err := dtp.ParseMode(args[0])
+	if err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m504 \033[0mCommand not implemented for that parameter: %s\n\n", args[0])
+		return
+	}
+
+	client.Session.Mode = mode
+	fmt.Fprintf(client.Conn, "\033[32m200 \033[0mMode set to %v.\n\n", mode)
+}
+
+// marker is the byte offset, either from our own restart markers (MODE B/C) or picked by the client
+func handleRestart(client *Client, args []string) {
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+		return
+	}
+
+	if len(args) != 1 {
+		client.Conn.Write([]byte("\033[31m501 \033[0mSyntax error in parameters or arguments. Usage: REST <marker>\n\n"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || offset < 0 {
+		fmt.Fprintf(client.Conn, "\033[31m501 \033[0mInvalid restart marker: %s\n\n", args[0])
+		return
+	}
+
+	client.Session.RestartOffset = offset
+	fmt.Fprintf(client.Conn, "\033[33m350 \033[0mRestarting at %d. Send RETR or STOR to initiate transfer.\n\n", offset)
 }
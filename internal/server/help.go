@@ -1,7 +1,7 @@
 package server
 
 import (
-	"fmt"
+	"log/slog"
 	"net"
 	"strings"
 	"time"
@@ -12,13 +12,13 @@ func handleHelpListener(helpListener *net.TCPListener) {
 		// Accept the help connection
 		helpConn, helpAcceptErr := helpListener.AcceptTCP()
 		if helpAcceptErr != nil {
-			fmt.Printf("HELP connection error %v\n", helpAcceptErr)
+			slog.Error("accepting HELP connection failed", "error", helpAcceptErr)
 			continue
 		}
 		// Extract IP address from helpConn
 		helpIP, _, err := net.SplitHostPort(helpConn.RemoteAddr().String())
 		if err != nil {
-			fmt.Printf("Error extracting IP from help connection: %v\n", err)
+			slog.Warn("extracting IP from HELP connection failed", "remote", helpConn.RemoteAddr().String(), "error", err)
 			helpConn.Close()
 			continue
 		}
@@ -26,11 +26,7 @@ func handleHelpListener(helpListener *net.TCPListener) {
 		var associatedClient *Client
 		mu.Lock()
 		for _, client := range activeConnections {
-			clientIP, _, err := net.SplitHostPort(client.Conn.RemoteAddr().String())
-			if err != nil {
-				continue
-			}
-			if helpIP == clientIP {
+			if client.ip() == helpIP {
 				associatedClient = client
 				break
 			}
@@ -39,7 +35,7 @@ func handleHelpListener(helpListener *net.TCPListener) {
 
 		// No matching client found
 		if associatedClient == nil {
-			fmt.Printf("No matching client session found for help connection: %v\n", helpConn.RemoteAddr().String())
+			slog.Info("no session for HELP connection", "remote", helpConn.RemoteAddr().String())
 			helpConn.Close()
 			continue
 		}
@@ -55,18 +51,18 @@ func handleHelpListener(helpListener *net.TCPListener) {
 func HandleHelpConnection(helpConn *net.TCPConn, associatedClient *Client) {
 	defer func() {
 		if err := helpConn.Close(); err != nil {
-			fmt.Printf("Error closing help connection: %v\n", err)
+			slog.Debug("closing HELP connection failed", "error", err)
 		}
 	}()
 
 	for {
 		if associatedClient == nil {
-			fmt.Println("Associated client is nil, closing help connection.")
+			slog.Debug("HELP client gone, closing HELP connection")
 			return
 		}
 
 		if associatedClient.Session == nil {
-			fmt.Println("Associated Session is nil, closing help connection.")
+			slog.Debug("HELP session gone, closing HELP connection", "session", associatedClient.ID)
 			return
 		}
 
@@ -76,7 +72,7 @@ func HandleHelpConnection(helpConn *net.TCPConn, associatedClient *Client) {
 
 		// Write commands to the help connection
 		if _, err := helpConn.Write([]byte(commandList)); err != nil {
-			fmt.Printf("Error writing commands to help connection: %v\n", err)
+			slog.Debug("writing to HELP connection failed", "session", associatedClient.ID, "error", err)
 			return
 		}
 
@@ -86,7 +82,7 @@ func HandleHelpConnection(helpConn *net.TCPConn, associatedClient *Client) {
 }
 
 func getAvailableCommands(client *Client) []string {
-	globalCommands := []string{"help", "echo", "hllo", "rgsr", "user", "pass", "quit"}
+	globalCommands := []string{"help", "echo", "hllo", "noop", "rgsr", "user", "pass", "acct", "auth", "pbsz", "prot", "quit"}
 
 	if client == nil || client.Session == nil {
 		return globalCommands
@@ -95,7 +91,7 @@ func getAvailableCommands(client *Client) []string {
 	defer client.Session.mu.Unlock()
 
 	if client.Session.Authenticated {
-		sessionCommands := []string{"pasv", "list", "retr", "stor"}
+		sessionCommands := []string{"pasv", "list", "retr", "stor", "appe", "dele", "mkd", "rnfr", "rnto", "mode", "rest", "abor", "site"}
 		return append(globalCommands, sessionCommands...)
 	}
 
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+func remoteIP(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// token bucket per source IP, refilled at perMinute tokens a minute
+type connectionRate struct {
+	mu        sync.Mutex
+	buckets   map[string]*ipBucket
+	lastPrune time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var connectionRates = &connectionRate{buckets: make(map[string]*ipBucket)}
+
+func (c *connectionRate) allow(ip string, perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(perMinute)
+	refill := func(b *ipBucket) {
+		b.tokens = min(b.tokens+now.Sub(b.last).Minutes()*capacity, capacity)
+		b.last = now
+	}
+
+	// drop buckets which are full again, they hold no state worth keeping
+	if now.Sub(c.lastPrune) > time.Minute {
+		for key, bucket := range c.buckets {
+			refill(bucket)
+			if bucket.tokens >= capacity {
+				delete(c.buckets, key)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	bucket, ok := c.buckets[ip]
+	if !ok {
+		bucket = &ipBucket{tokens: capacity, last: now}
+		c.buckets[ip] = bucket
+	}
+	refill(bucket)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// checkConnectionLimits decides if a freshly accepted connection can get a
+// session, the reason is sent to the client with 421. Caller holds mu.
+func checkConnectionLimits(conn net.Conn) error {
+	limits := currentConfig().Limits
+	ip := remoteIP(conn.RemoteAddr())
+
+	if _, banned := loginGuard.Banned(ip, ""); banned {
+		return fmt.Errorf("too many failed logins from %v, try again later", ip)
+	}
+
+	if !connectionRates.allow(ip, limits.ConnectionsPerMinute) {
+		return fmt.Errorf("too many connections from %v, slow down", ip)
+	}
+
+	if limits.MaxSessions > 0 && len(activeConnections) >= limits.MaxSessions {
+		return fmt.Errorf("too many users, try again later")
+	}
+
+	if limits.MaxSessionsPerIP > 0 {
+		fromIP := 0
+		for _, client := range activeConnections {
+			if client.ip() == ip {
+				fromIP++
+			}
+		}
+		if fromIP >= limits.MaxSessionsPerIP {
+			return fmt.Errorf("too many connections from %v", ip)
+		}
+	}
+
+	return nil
+}
+
+// loginUser logs session in as login unless that goes over the session limit
+// of the user. Counting and logging in happen under mu, so concurrent logins
+// can't both take the last slot.
+func loginUser(session *Session, login string) error {
+	limit := currentConfig().Limits.MaxSessionsPerUser
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if limit > 0 {
+		sessions := 0
+		for _, client := range activeConnections {
+			if client.Session == nil {
+				continue
+			}
+			client.Session.mu.Lock()
+			if client.Session.Authenticated && client.Session.Login == login {
+				sessions++
+			}
+			client.Session.mu.Unlock()
+		}
+		if sessions >= limit {
+			return fmt.Errorf("too many sessions for user %v", login)
+		}
+	}
+
+	session.logIn(login)
+	return nil
+}
+
+// loginAnonymous logs session in as a guest, the guests are counted apart
+// from the accounts so a crowd of them can't take the slots of real users
+func loginAnonymous(session *Session, ip string) error {
+	limits := currentConfig().Limits
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	total, fromIP := 0, 0
+	for _, client := range activeConnections {
+		if client.Session == nil {
+			continue
+		}
+		client.Session.mu.Lock()
+		guest := client.Session.Authenticated && client.Session.Anonymous
+		client.Session.mu.Unlock()
+		if !guest {
+			continue
+		}
+		total++
+		if client.ip() == ip {
+			fromIP++
+		}
+	}
+
+	if limits.MaxAnonymousSessions > 0 && total >= limits.MaxAnonymousSessions {
+		return fmt.Errorf("too many anonymous sessions")
+	}
+	if limits.MaxAnonymousSessionsPerIP > 0 && fromIP >= limits.MaxAnonymousSessionsPerIP {
+		return fmt.Errorf("too many anonymous sessions from %v", ip)
+	}
+
+	session.logIn(anonymousLogin)
+	return nil
+}
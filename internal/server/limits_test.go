@@ -0,0 +1,83 @@
+package server
+
+import (
+	"jamserver/internal/config"
+	"net"
+	"sync"
+	"testing"
+)
+
+func withLimits(t *testing.T, limits config.Limits) {
+	withConfig(t, func(cfg *config.Config) { cfg.Limits = limits })
+
+	mu.Lock()
+	savedConnections := activeConnections
+	activeConnections = make(map[int]*Client)
+	mu.Unlock()
+
+	t.Cleanup(func() {
+		mu.Lock()
+		activeConnections = savedConnections
+		mu.Unlock()
+	})
+}
+
+// connect adds a session from ip to the active connections
+func connect(ip string) *Session {
+	session := &Session{}
+	mu.Lock()
+	defer mu.Unlock()
+	id := len(activeConnections) + 1
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000 + id}
+	activeConnections[id] = &Client{ID: id, Session: session, Conn: discardConn{}, Remote: addr}
+	return session
+}
+
+func TestSessionLimits(t *testing.T) {
+	withLimits(t, config.Limits{MaxSessionsPerUser: 2, MaxAnonymousSessions: 3, MaxAnonymousSessionsPerIP: 2})
+
+	// sessions of others log in and out while the limits are counted
+	var wg sync.WaitGroup
+	busy := connect("10.0.0.9")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			busy.logIn("carol")
+			busy.logOut()
+			busy.setAnonymous(true)
+			busy.setAnonymous(false)
+		}
+	}()
+
+	tests := []struct {
+		name  string
+		login string // "" for a guest
+		ip    string
+		ok    bool
+	}{
+		{"first alice", "alice", "10.0.0.1", true},
+		{"second alice", "alice", "10.0.0.2", true},
+		{"third alice", "alice", "10.0.0.3", false},
+		{"bob", "bob", "10.0.0.1", true},
+		{"guest", "", "10.0.0.1", true},
+		{"guest from the same ip", "", "10.0.0.1", true},
+		{"third guest from the ip", "", "10.0.0.1", false},
+		{"guest from elsewhere", "", "10.0.0.2", true},
+		{"one guest too many", "", "10.0.0.3", false},
+	}
+	for _, tt := range tests {
+		session := connect(tt.ip)
+		var err error
+		if tt.login == "" {
+			session.setAnonymous(true)
+			err = loginAnonymous(session, tt.ip)
+		} else {
+			err = loginUser(session, tt.login)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"jamserver/internal/guard"
+	"time"
+)
+
+var loginGuard *guard.Guard
+
+// rejectBanned sends 421 and drops the connection when the client IP or the
+// login is locked out
+func rejectBanned(client *Client, login string) bool {
+	ban, banned := loginGuard.Banned(client.ip(), login)
+	if !banned {
+		return false
+	}
+
+	fmt.Fprintf(client.Conn, "\033[31m421  \033[0mToo many failed logins, try again later.\n\n")
+	client.log().Warn("refused banned client", "kind", ban.Kind, "target", ban.Target, "reason", ban.Reason)
+	client.Conn.Close() // read loop ends and cleans up the session
+	return true
+}
+
+// loginFailed answers a wrong password after the guard's delay and drops the
+// connection once a limit is crossed
+func loginFailed(client *Client) {
+	if passwordFailed(client) {
+		client.Conn.Write([]byte("\033[31m530  \033[0mNot logged in. \n\n"))
+	}
+}
+
+// passwordFailed counts a wrong password, waits out the delay and drops the
+// connection on a lockout. false means the connection is gone, nothing to reply.
+func passwordFailed(client *Client) bool {
+	policy := currentConfig().Login
+	ip := client.ip()
+	session := client.Session // the client may leave during the delay, which drops client.Session
+
+	delay, ban, err := loginGuard.Failure(ip, session.Login, policy)
+	if err != nil {
+		client.log().Error("saving ban list failed", "error", err)
+	}
+	loginsTotal.Inc("failure")
+	session.FailedLogins++
+	client.log().Info("login failed", "failures", session.FailedLogins, "delay", delay)
+	time.Sleep(delay)
+
+	if ban != nil {
+		client.log().Warn("login locked out", "kind", ban.Kind, "target", ban.Target, "until", ban.Until, "failures", ban.Failures)
+		fmt.Fprintf(client.Conn, "\033[31m421  \033[0mToo many failed logins, try again later.\n\n")
+		client.Conn.Close()
+		return false
+	}
+
+	if policy.MaxFailuresPerConnection > 0 && session.FailedLogins >= policy.MaxFailuresPerConnection {
+		fmt.Fprintf(client.Conn, "\033[31m421  \033[0mToo many failed logins, closing connection.\n\n")
+		client.Conn.Close()
+		return false
+	}
+
+	return true
+}
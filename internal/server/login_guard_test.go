@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"jamserver/internal/config"
+	"jamserver/internal/guard"
+	"jamserver/internal/users"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replyConn keeps the replies of a test client
+type replyConn struct {
+	discardConn
+	replies *bytes.Buffer
+}
+
+func (c replyConn) Write(p []byte) (int, error) {
+	return c.replies.Write(p)
+}
+
+func (c replyConn) Close() error {
+	return nil
+}
+
+func TestLoginFailures(t *testing.T) {
+	withConfig(t, func(cfg *config.Config) {
+		cfg.Login = config.Login{MaxFailuresPerIP: 3, FailureWindowSeconds: 60, LockoutSeconds: 60}
+	})
+	bans, err := guard.Load(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := users.NewStore(filepath.Join(t.TempDir(), "db.json"))
+	if err := store.Add(users.Credentials{Login: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	savedGuard, savedStore := loginGuard, userStore
+	loginGuard, userStore = bans, store
+	t.Cleanup(func() { loginGuard, userStore = savedGuard, savedStore })
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	tests := []struct {
+		name    string
+		handle  func(client *Client, args []string)
+		arg     string
+		prepare func()
+		reply   string
+	}{
+		{"unknown login", handleLogin, "nobody", nil, "332"},
+		{"known login", handleLogin, "alice", nil, "331"},
+		{"deleted before PASS", handlePass, "secret", func() { store.Delete("alice") }, "530"},
+		// the third failure from the IP locks it out
+		{"another unknown login", handleLogin, "root", nil, "421"},
+	}
+	client := &Client{Session: &Session{}, Remote: addr}
+	for _, tt := range tests {
+		replies := &bytes.Buffer{}
+		client.Conn = replyConn{replies: replies}
+		if tt.prepare != nil {
+			tt.prepare()
+		}
+		tt.handle(client, []string{tt.arg})
+		if !strings.Contains(replies.String(), tt.reply) {
+			t.Errorf("%v: reply %q, want %v", tt.name, replies.String(), tt.reply)
+		}
+	}
+	if _, banned := bans.Banned("10.0.0.1", ""); !banned {
+		t.Error("10.0.0.1 not banned after probing for accounts")
+	}
+}
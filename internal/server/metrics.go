@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"jamserver/internal/metrics"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	loginsTotal = metricsRegistry.NewCounter("jamserver_logins_total",
+		"Login attempts by result.", "result")
+	commandsTotal = metricsRegistry.NewCounter("jamserver_commands_total",
+		"Commands handled by verb and final reply code.", "command", "code")
+	transferBytesTotal = metricsRegistry.NewCounter("jamserver_transfer_bytes_total",
+		"Bytes moved over data connections.", "direction")
+	transferDuration = metricsRegistry.NewHistogram("jamserver_transfer_duration_seconds",
+		"Duration of RETR/STOR/APPE transfers, aborted ones included.",
+		[]float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}, "direction")
+)
+
+func init() {
+	metricsRegistry.NewGaugeFunc("jamserver_sessions_active", "Open control connections.", func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(activeConnections))
+	})
+
+	metricsRegistry.NewGaugeFunc("jamserver_passive_ports_in_use", "PASV ports held by a listener or a data connection.", func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		inUse := 0
+		for _, client := range activeConnections {
+			session := client.Session
+			if session == nil {
+				continue
+			}
+			session.mu.Lock()
+			if session.DTPListener != nil || session.DTPConnection != nil {
+				inUse++
+			}
+			session.mu.Unlock()
+		}
+		return float64(inUse)
+	})
+}
+
+func serveMetrics(address string, path string) {
+	mux := http.NewServeMux()
+	mux.Handle(path, metricsRegistry)
+
+	slog.Info("metrics endpoint started", "address", address, "path", path)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("metrics endpoint failed", "address", address, "error", err)
+	}
+}
+
+// replyRecorder is the control connection as one command sees it, it keeps
+// the code of the last reply that command wrote. Commands run concurrently,
+// the connection itself can't tell whose reply it was.
+type replyRecorder struct {
+	net.Conn
+	mu   sync.Mutex
+	last string
+}
+
+func (r *replyRecorder) Write(p []byte) (int, error) {
+	if code, ok := replyCode(p); ok {
+		r.mu.Lock()
+		r.last = code
+		r.mu.Unlock()
+	}
+	return r.Conn.Write(p)
+}
+
+// code is "none" for a command that did not reply
+func (r *replyRecorder) code() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == "" {
+		return "none"
+	}
+	return r.last
+}
+
+// replyCode reads the three digit code at the start of a reply, after the color escape
+func replyCode(p []byte) (string, bool) {
+	if bytes.HasPrefix(p, []byte("\033[")) {
+		end := bytes.IndexByte(p, 'm')
+		if end < 0 {
+			return "", false
+		}
+		p = p[end+1:]
+	}
+
+	if len(p) < 3 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(string(p[:3])); err != nil {
+		return "", false
+	}
+	return string(p[:3]), true
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		reply string
+		code  string
+		ok    bool
+	}{
+		{"\033[32m226 \033[0mTransfer complete.\n\n", "226", true},
+		{"\033[31m550  \033[0mPermission denied.\n\n", "550", true},
+		{"221 bye\n", "221", true},
+		{"Available commands: \n", "", false},
+		{"\033[32m", "", false},
+		{"12", "", false},
+	}
+	for _, tt := range tests {
+		code, ok := replyCode([]byte(tt.reply))
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("replyCode(%q) = %q, %v, want %q, %v", tt.reply, code, ok, tt.code, tt.ok)
+		}
+	}
+}
+
+func TestReplyRecorder(t *testing.T) {
+	server, peer := net.Pipe()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := peer.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// two commands on one connection each keep their own code
+	retr, noop := &replyRecorder{Conn: server}, &replyRecorder{Conn: server}
+	if retr.code() != "none" {
+		t.Errorf("code %q before any reply", retr.code())
+	}
+	retr.Write([]byte("\033[32m150 \033[0mOpening data connection.\n\n"))
+	noop.Write([]byte("\033[32m200 \033[0mOk.\n\n"))
+	retr.Write([]byte("\033[32m226 \033[0mTransfer complete.\n\n"))
+	retr.Write([]byte("listing goes on\n"))
+
+	if retr.code() != "226" || noop.code() != "200" {
+		t.Errorf("codes %q and %q, want 226 and 200", retr.code(), noop.code())
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"jamserver/internal/config"
+	"jamserver/internal/jfs"
+	"strings"
+)
+
+// NOTE: disk quotas, checked before and while STOR/APPE receive a file. The
+// usage comes from the metadata index, see jfs/quota.go. Two uploads running
+// at once can together go a bit over, each one is only held to what was
+// left when it started.
+
+// quotaError is an upload that doesn't fit, the reply is 552
+type quotaError struct {
+	who   string
+	usage jfs.Usage
+	quota config.Quota
+	files bool
+}
+
+func (e quotaError) Error() string {
+	if e.files {
+		return fmt.Sprintf("quota of %v exceeded, %d of %d files used", e.who, e.usage.Files, e.quota.MaxFiles)
+	}
+	return fmt.Sprintf("quota of %v exceeded, %d of %d bytes used", e.who, e.usage.Bytes, e.quota.MaxBytes)
+}
+
+// uploadAllowance returns how many bytes an upload to filename may bring, -1
+// is unlimited. A quotaError means nothing fits anymore.
+func uploadAllowance(fileSystem *jfs.FileSystem, filename string, command string, offset int64) (int64, error) {
+	if fileSystem.Index == nil {
+		return -1, nil
+	}
+	owner, group, size, owned, err := fileSystem.Charged(filename)
+	if err != nil || owner == "" {
+		return -1, err
+	}
+
+	// the part of the old file the upload replaces is given back, the part
+	// it keeps of a file nobody owned is counted from now on
+	var kept int64
+	switch {
+	case command == "APPE":
+		kept = size
+	case offset > 0:
+		kept = min(offset, size)
+	}
+	freed := -kept
+	if owned {
+		freed = size - kept
+	}
+
+	quotas := currentConfig().Quotas
+	allowance := int64(-1)
+	check := func(who string, name string, quota config.Quota) error {
+		if quota == (config.Quota{}) {
+			return nil
+		}
+		usage, err := fileSystem.Index.Usage(who)
+		if err != nil {
+			return err
+		}
+		if quota.MaxFiles > 0 && !owned && usage.Files >= quota.MaxFiles {
+			return quotaError{who: name, usage: usage, quota: quota, files: true}
+		}
+		if quota.MaxBytes > 0 {
+			left := quota.MaxBytes - usage.Bytes + freed
+			if left <= 0 {
+				return quotaError{who: name, usage: usage, quota: quota}
+			}
+			if allowance < 0 || left < allowance {
+				allowance = left
+			}
+		}
+		return nil
+	}
+
+	if err := check(owner, "user "+owner, quotas.User(owner)); err != nil {
+		return 0, err
+	}
+	if quota, ok := quotas.Groups[group]; ok && group != "" {
+		if err := check("@"+group, "group "+group, quota); err != nil {
+			return 0, err
+		}
+	}
+	return allowance, nil
+}
+
+// SITE QUOTA, usage of the user and its groups next to their limits
+func handleSiteQuota(client *Client, _ []string) {
+	index := client.Session.FileSystem.Index
+	if index == nil {
+		client.Conn.Write([]byte("\033[31m502  \033[0mNo quotas here.\n\n"))
+		return
+	}
+
+	quotas := currentConfig().Quotas
+	lines := make([]string, 0, len(client.Session.Groups)+1)
+	usage, err := index.Usage(client.Session.Login)
+	if err != nil {
+		client.log().Error("reading disk usage failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+		return
+	}
+	lines = append(lines, "user "+client.Session.Login+": "+formatQuota(usage, quotas.User(client.Session.Login)))
+
+	for _, group := range client.Session.Groups {
+		usage, err := index.Usage("@" + group)
+		if err != nil {
+			client.log().Error("reading disk usage failed", "error", err)
+			client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+			return
+		}
+		lines = append(lines, "group "+group+": "+formatQuota(usage, quotas.Groups[group]))
+	}
+
+	fmt.Fprintf(client.Conn, "\033[32m211  \033[0mQuota: \n     %v\n\n", strings.Join(lines, "\n     "))
+}
+
+func formatQuota(usage jfs.Usage, quota config.Quota) string {
+	bytes := fmt.Sprintf("%d bytes", usage.Bytes)
+	if quota.MaxBytes > 0 {
+		bytes = fmt.Sprintf("%d of %d bytes", usage.Bytes, quota.MaxBytes)
+	}
+	files := fmt.Sprintf("%d files", usage.Files)
+	if quota.MaxFiles > 0 {
+		files = fmt.Sprintf("%d of %d files", usage.Files, quota.MaxFiles)
+	}
+	return bytes + ", " + files
+}
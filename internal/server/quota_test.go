@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"jamserver/internal/config"
+	"jamserver/internal/jfs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withQuotas(t *testing.T, quotas config.Quotas) {
+	withConfig(t, func(cfg *config.Config) { cfg.Quotas = quotas })
+}
+
+// withConfig runs the test on the default config with change applied
+func withConfig(t *testing.T, change func(cfg *config.Config)) {
+	cfg := *config.Default()
+	change(&cfg)
+	configMu.Lock()
+	saved := globalConfig
+	globalConfig = &cfg
+	configMu.Unlock()
+	t.Cleanup(func() {
+		configMu.Lock()
+		globalConfig = saved
+		configMu.Unlock()
+	})
+}
+
+func TestUploadAllowance(t *testing.T) {
+	withQuotas(t, config.Quotas{
+		Users: map[string]config.Quota{
+			"alice": {MaxBytes: 100, MaxFiles: 3},
+			"erin":  {MaxFiles: 1},
+		},
+		Groups: map[string]config.Quota{"staff": {MaxBytes: 150}},
+	})
+
+	backend := jfs.NewMemoryBackend()
+	root := &jfs.FileSystem{Backend: backend, Index: jfs.NewIndex(backend, filepath.Join(t.TempDir(), "filesystem.json"))}
+	as := func(login string, groups ...string) *jfs.FileSystem {
+		return root.As(login, groups)
+	}
+	write := func(fs *jfs.FileSystem, name string, size int) {
+		if err := fs.WriteFile(name, []byte(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// alice 60 bytes in 2 files, staff 90 bytes, loose belongs to nobody
+	write(as("alice", "staff"), "a", 40)
+	write(as("alice", "staff"), "b", 20)
+	write(as("bob", "staff"), "c", 30)
+	write(as("erin"), "e", 5)
+	w, _ := backend.Create("loose", 0)
+	w.Write(make([]byte, 50))
+	w.Close()
+
+	tests := []struct {
+		name     string
+		fs       *jfs.FileSystem
+		file     string
+		command  string
+		offset   int64
+		want     int64
+		overFull bool // a quotaError
+	}{
+		{"new file", as("alice", "staff"), "new", "STOR", 0, 40, false},
+		{"replace own file", as("alice", "staff"), "a", "STOR", 0, 80, false},
+		{"restart", as("alice", "staff"), "a", "STOR", 10, 70, false},
+		{"restart past the end", as("alice", "staff"), "a", "STOR", 60, 40, false},
+		{"append", as("alice", "staff"), "a", "APPE", 0, 40, false},
+		{"group only", as("bob", "staff"), "new", "STOR", 0, 60, false},
+		{"someone else's file", as("bob", "staff"), "a", "STOR", 0, 80, false},
+		{"no quota", as("carol"), "new", "STOR", 0, -1, false},
+		{"nobody's file", as("alice", "staff"), "loose", "STOR", 0, 40, false},
+		{"keeping nobody's bytes", as("alice", "staff"), "loose", "APPE", 0, 0, true},
+		{"restart nobody's file", as("alice", "staff"), "loose", "STOR", 30, 10, false},
+		{"files full", as("erin"), "new", "STOR", 0, 0, true},
+		{"files full, replace", as("erin"), "e", "STOR", 0, -1, false},
+		{"files full, nobody's file", as("erin"), "loose", "STOR", 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := uploadAllowance(tt.fs, tt.file, tt.command, tt.offset)
+		if tt.overFull {
+			if !errors.As(err, &quotaError{}) {
+				t.Errorf("%v: %v, %v, want a quota error", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%v: %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// overwriting a file nobody owns makes it the uploader's
+	write(as("alice", "staff"), "loose", 10)
+	if attrs, found, _ := root.Attributes("loose"); !found || attrs.Owner != "alice" || attrs.Group != "staff" {
+		t.Errorf("loose after the upload: %+v, %v", attrs, found)
+	}
+	if usage, _ := root.Index.Usage("alice"); usage != (jfs.Usage{Bytes: 70, Files: 3}) {
+		t.Errorf("usage of alice %+v", usage)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"jamserver/internal/config"
+	"jamserver/internal/users"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// policyError is a password the policy doesn't allow, the text goes to the client
+type policyError string
+
+func (e policyError) Error() string {
+	return string(e)
+}
+
+// checkPasswordPolicy returns a policyError for a weak password, other errors
+// mean the breached list couldn't be read
+func checkPasswordPolicy(policy config.PasswordPolicy, login string, password string) error {
+	if len(password) < policy.MinLength {
+		return policyError(fmt.Sprintf("Password must be at least %d characters", policy.MinLength))
+	}
+	if len(password) > 72 {
+		return policyError("Password must be at most 72 bytes")
+	}
+
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < policy.MinClasses {
+		return policyError(fmt.Sprintf("Password must mix at least %d of lower case, upper case, digits and symbols", policy.MinClasses))
+	}
+
+	if len(login) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(login)) {
+		return policyError("Password must not contain the login")
+	}
+
+	if policy.BreachedList != "" {
+		breached, err := breachedPasswords.contains(policy.BreachedList, password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return policyError("Password is on a list of breached passwords")
+		}
+	}
+	return nil
+}
+
+// breachedList caches the breached password file, it's read again when the
+// path or the modification time changes
+type breachedList struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	entries map[string]struct{}
+}
+
+var breachedPasswords = &breachedList{}
+
+func (b *breachedList) contains(path string, password string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("reading breached password list error: %w", err)
+	}
+	if path != b.path || !info.ModTime().Equal(b.modTime) {
+		if err := b.load(path); err != nil {
+			return false, err
+		}
+		b.path, b.modTime = path, info.ModTime()
+	}
+
+	sum := sha1.Sum([]byte(password))
+	_, plain := b.entries[password]
+	_, hashed := b.entries[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return plain || hashed, nil
+}
+
+func (b *breachedList) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading breached password list error: %w", err)
+	}
+	defer file.Close()
+
+	entries := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if hash, _, found := strings.Cut(line, ":"); found && len(hash) == sha1.Size*2 {
+			line = hash // haveibeenpwned style HASH:count
+		}
+		if len(line) == sha1.Size*2 {
+			if _, err := hex.DecodeString(line); err == nil {
+				line = strings.ToUpper(line)
+			}
+		}
+		if line != "" {
+			entries[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading breached password list error: %w", err)
+	}
+
+	b.entries = entries
+	return nil
+}
+
+var (
+	invitesMu   sync.Mutex
+	inviteStore *users.InviteStore
+)
+
+// invites returns the invite store for the configured path, one store per
+// path so concurrent RGSRs share its lock
+func invites() *users.InviteStore {
+	path := currentConfig().Registration.Invites
+
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+	if inviteStore == nil || inviteStore.Path() != path {
+		inviteStore = users.NewInviteStore(path)
+	}
+	return inviteStore
+}
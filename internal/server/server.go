@@ -1,13 +1,26 @@
 package server
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"jamserver/internal/config"
+	"jamserver/internal/dtp"
+	"jamserver/internal/guard"
 	"jamserver/internal/jfs"
-	"log"
+	"jamserver/internal/logging"
+	"jamserver/internal/s3"
+	"jamserver/internal/users"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -17,15 +30,166 @@ type Session struct {
 	DTPConnection  net.Conn
 	HelpConnection net.Conn
 	DTPListener    net.Listener
+	ConnectedAt    time.Time
+	WorkDir        string // no CWD yet, every session works in the root
 	Login          string
+	Groups         []string
 	Authenticated  bool
+	FailedLogins   int
+	loginMu        sync.Mutex // one PASS at a time, so parallel guesses can't skip the delay
 	Passive        bool
+	dtpReady       chan struct{} // closed once the PASV accept is over, either way
+	Mode           dtp.Mode
+	ProtectData    bool  // PROT P, data connections use TLS too
+	RestartOffset  int64 // set by REST, consumed by the next RETR/STOR
+	transfer       *transfer
 	mu             sync.Mutex
+
+	PeerCertificate     *x509.Certificate // client certificate from AUTH TLS
+	CertificateVerified bool              // signed by the configured client CA
+	SecondFactorPending bool              // password or certificate was right, ACCT with the one-time code is next
+	FirstFactor         string            // "password" or "certificate", what SecondFactorPending follows
+
+	FileSystem     *jfs.FileSystem // what RETR/STOR/LIST/DELE work on, set at login
+	Incoming       *jfs.FileSystem // anonymous drop box, nil when uploads are off
+	Anonymous      bool
+	AnonymousEmail string             // the password of an anonymous login, goes to the xferlog
+	Permissions    []users.Permission // of the account at login, empty allows everything
+	RenameFrom     string             // set by RNFR, consumed by RNTO
+}
+
+// in-flight RETR/STOR, ABOR cancels it and waits for done
+type transfer struct {
+	Command string
+	File    string
+	Started time.Time
+	bytes   atomic.Int64
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (t *transfer) Bytes() int64 {
+	return t.bytes.Load()
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// countWrites and countReads keep the progress of the transfer up to date
+func (t *transfer) countWrites(w io.Writer) io.Writer {
+	return countingWriter{w: w, count: &t.bytes}
+}
+
+func (t *transfer) countReads(r io.Reader) io.Reader {
+	return countingReader{r: r, count: &t.bytes}
+}
+
+// beginTransfer registers a transfer on the session, finish must be called
+// once the transfer handler has sent its final reply
+func (s *Session) beginTransfer(command string, file string) (ctx context.Context, t *transfer, finish func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t = &transfer{Command: command, File: file, Started: time.Now(), cancel: cancel, done: make(chan struct{})}
+
+	s.mu.Lock()
+	s.transfer = t
+	s.mu.Unlock()
+
+	return ctx, t, func() {
+		s.mu.Lock()
+		if s.transfer == t {
+			s.transfer = nil
+		}
+		s.mu.Unlock()
+		cancel()
+		close(t.done)
+	}
+}
+
+// setLogin, setAnonymous, logIn and logOut change who the session is under
+// mu, the admin API and the session limits read that from other goroutines
+func (s *Session) setLogin(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Login = login
+}
+
+func (s *Session) setAnonymous(anonymous bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Anonymous = anonymous
+}
+
+func (s *Session) logIn(login string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Login = login
+	s.Authenticated = true
+}
+
+func (s *Session) logOut() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Login = ""
+	s.Authenticated = false
+	s.Anonymous = false
+}
+
+// closeData drops the data connection and the passive mode
+func (s *Session) closeData() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.DTPConnection != nil {
+		s.DTPConnection.Close()
+		s.DTPConnection = nil
+	}
+	s.Passive = false // Reset passive mode state
+}
+
+func (s *Session) currentTransfer() *transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transfer
 }
 
 type Client struct {
+	ID      int
 	Session *Session
-	Conn    *net.TCPConn
+	Conn    net.Conn
+	Remote  net.Addr // of the control connection, set on accept: AUTH TLS swaps Conn while others read this
+}
+
+// ip is the source IP of the client
+func (c *Client) ip() string {
+	return remoteIP(c.Remote)
+}
+
+// log returns a logger carrying the session context
+func (c *Client) log() *slog.Logger {
+	logger := slog.With("session", c.ID, "remote", c.Remote.String())
+	if session := c.Session; session != nil && session.Login != "" {
+		logger = logger.With("user", session.Login)
+	}
+	return logger
 }
 
 var (
@@ -34,8 +198,94 @@ var (
 	mu                sync.Mutex // mutex to handle concurrent connections
 
 	globalFileSystem *jfs.FileSystem
+	userStore        = users.NewStore(users.DefaultPath)
+
+	configMu     sync.RWMutex
+	globalConfig = config.Default()
 )
 
+func currentConfig() *config.Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return globalConfig
+}
+
+// reloadConfig reads the config file again and applies it to the running server
+func reloadConfig() error {
+	cfg, err := config.Load(config.DefaultPath)
+	if err != nil {
+		return err
+	}
+
+	if err := logging.Setup(cfg.Log); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	globalConfig = cfg
+	configMu.Unlock()
+
+	if err := loadTLSConfig(cfg.TLS); err != nil {
+		return err
+	}
+
+	if err := applyAnonymousConfig(cfg.Anonymous); err != nil {
+		return err
+	}
+
+	applyThrottleConfig(cfg.Throttle)
+	return openTransferLog(cfg.Xferlog)
+}
+
+// newBackend picks the storage of the file system, Validate checked the name
+func newBackend(cfg config.Storage) (jfs.Backend, error) {
+	switch cfg.Backend {
+	case "memory":
+		return jfs.NewMemoryBackend(), nil
+	case "s3":
+		accessKey, secretKey := cfg.S3.AccessKey, cfg.S3.SecretKey
+		if accessKey == "" && secretKey == "" {
+			accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		client, err := s3.New(cfg.S3.Endpoint, cfg.S3.Region, cfg.S3.Bucket, accessKey, secretKey)
+		if err != nil {
+			return nil, err
+		}
+		return jfs.NewS3Backend(client, cfg.S3.Prefix), nil
+	case "dedup":
+		return jfs.NewDedupBackend(cfg.Dedup.Blobs), nil
+	}
+	return jfs.NewLocalBackend(cfg.Root), nil
+}
+
+// SIGHUP reloads the config without dropping sessions
+func watchConfigReload() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("config reload failed", "error", err)
+			continue
+		}
+		slog.Info("config reloaded", "path", config.DefaultPath)
+	}
+}
+
+// SIGINT and SIGTERM save the file system metadata before the server goes
+func watchShutdown(index *jfs.Index) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-stop
+	slog.Info("shutting down", "signal", sig.String())
+	if err := index.Flush(); err != nil {
+		slog.Error("saving metadata failed", "error", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func Run() error {
 	IP_ADDRESS := "0.0.0.0:"
 	PORT_TCP := "2121"
@@ -44,7 +294,16 @@ func Run() error {
 	tcpAddrStr := IP_ADDRESS + PORT_TCP
 	helpAddrStr := IP_ADDRESS + PORT_HELP
 
-	BASE_PATH := "app/jam_filesystem"
+	if err := reloadConfig(); err != nil {
+		return fmt.Errorf("loading config error: %w", err)
+	}
+	go watchConfigReload()
+
+	bans, banErr := guard.Load(currentConfig().Login.BanList)
+	if banErr != nil {
+		return fmt.Errorf("loading ban list error: %w", banErr)
+	}
+	loginGuard = bans
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", tcpAddrStr)
 	if err != nil {
@@ -57,17 +316,30 @@ func Run() error {
 	}
 	defer listener.Close()
 
-	fmt.Println("jamsualFT started!")
-	fmt.Printf("Listening on %v at port %v \n", tcpAddr.IP, tcpAddr.Port)
+	slog.Info("jamsualFT started", "ip", tcpAddr.IP.String(), "port", tcpAddr.Port)
 
-	fmt.Println("File System Initialization...")
+	backend, err := newBackend(currentConfig().Storage)
+	if err != nil {
+		return fmt.Errorf("setting up storage error: %w", err)
+	}
+	slog.Info("file system initialization", "backend", currentConfig().Storage.Backend)
 
-	fErr := jfs.InitializeFS(BASE_PATH)
+	index, fErr := jfs.InitializeFS(backend, currentConfig().Storage.Metadata)
 	if fErr != nil {
-		return fmt.Errorf("initializing FS error : %v", err)
+		return fmt.Errorf("initializing FS error : %v", fErr)
 	}
 
-	globalFileSystem = jfs.NewFileSystem(BASE_PATH)
+	globalFileSystem = &jfs.FileSystem{Backend: backend, Index: index}
+	go index.Persist(time.Duration(currentConfig().Files.MetadataFlushSeconds) * time.Second)
+	rescan := currentConfig().Files.RescanSeconds
+	if currentConfig().Storage.Backend == "s3" {
+		rescan = currentConfig().Storage.S3.RescanSeconds
+	}
+	go index.Watch(time.Duration(rescan) * time.Second)
+	go watchShutdown(index)
+	if dedup, ok := backend.(*jfs.DedupBackend); ok && currentConfig().Storage.Dedup.GCSeconds > 0 {
+		go dedup.CollectGarbage(time.Duration(currentConfig().Storage.Dedup.GCSeconds) * time.Second)
+	}
 
 	helpAddr, helpErr := net.ResolveTCPAddr("tcp", helpAddrStr)
 	if helpErr != nil {
@@ -82,38 +354,55 @@ func Run() error {
 
 	go handleHelpListener(helpListener)
 
+	if metricsCfg := currentConfig().Metrics; metricsCfg.Address != "" {
+		go serveMetrics(metricsCfg.Address, metricsCfg.Path)
+	}
+
+	if adminCfg := currentConfig().Admin; adminCfg.Address != "" {
+		go serveAdmin(adminCfg.Address, adminCfg.Token)
+	}
+
 	for {
-		fmt.Print("Waiting for upcoming connections... \n\n")
 		conn, acceptErr := listener.AcceptTCP()
 		if acceptErr != nil {
-			log.Printf("connection error %v", acceptErr)
+			slog.Error("accepting connection failed", "error", acceptErr)
 			continue
 		}
 
-		client := &Client{
-			Conn:    conn,
-			Session: &Session{},
+		mu.Lock()
+		if limitErr := checkConnectionLimits(conn); limitErr != nil {
+			mu.Unlock()
+			slog.Warn("connection rejected", "remote", conn.RemoteAddr().String(), "reason", limitErr)
+			fmt.Fprintf(conn, "\033[31m421  \033[0mService not available, %v.\n\n", limitErr)
+			conn.Close()
+			continue
 		}
 
-		mu.Lock()
 		connectionCounter++
 		id := connectionCounter
+		client := &Client{
+			ID:      id,
+			Conn:    conn,
+			Remote:  conn.RemoteAddr(),
+			Session: &Session{Mode: dtp.ModeStream, ConnectedAt: time.Now(), WorkDir: "/"},
+		}
 		activeConnections[id] = client
 		mu.Unlock()
 
-		incAddr := conn.RemoteAddr().String()
-		fmt.Printf("Accepted new connection: id = %v! %v \n\n", id, incAddr)
+		client.log().Info("connection accepted")
 
 		go HandleConnection(client, id)
 	}
 }
 
 func HandleDisconnect(client *Client, id int, quitChan chan bool) {
+	logger := client.log()
+
 	mu.Lock()
 	defer mu.Unlock()
 
 	if err := client.Conn.Close(); err != nil {
-		fmt.Printf("Error closing connection %v: %v\n", id, err)
+		logger.Debug("closing connection failed", "error", err)
 	}
 
 	if client.Session != nil && client.Session.HelpConnection != nil {
@@ -121,14 +410,39 @@ func HandleDisconnect(client *Client, id int, quitChan chan bool) {
 		client.Session.HelpConnection = nil
 		err := helpConn.Close()
 		if err != nil {
-			fmt.Printf("Error closing help connection: %v\n, %v", id, err)
+			logger.Debug("closing help connection failed", "error", err)
 		}
 	}
 
 	close(quitChan)
 	client.Session = nil
 	delete(activeConnections, id)
-	fmt.Printf("Connection %v closed and removed from active list\n", id)
+	logger.Info("connection closed")
+}
+
+// controlDeadline is when the next command has to arrive, the idle timeout
+// or the login timeout, whichever comes first
+func controlDeadline(client *Client, connectedAt time.Time) time.Time {
+	timeouts := currentConfig().Timeouts
+	var deadline time.Time
+
+	if timeouts.IdleSeconds > 0 {
+		deadline = time.Now().Add(time.Duration(timeouts.IdleSeconds) * time.Second)
+	}
+
+	if timeouts.LoginSeconds > 0 && !client.Session.Authenticated {
+		loginDeadline := connectedAt.Add(time.Duration(timeouts.LoginSeconds) * time.Second)
+		if deadline.IsZero() || loginDeadline.Before(deadline) {
+			deadline = loginDeadline
+		}
+	}
+
+	return deadline
+}
+
+// dataTimeout is 0 when there is none
+func dataTimeout() time.Duration {
+	return time.Duration(currentConfig().Timeouts.DataSeconds) * time.Second
 }
 
 func HandleConnection(client *Client, id int) {
@@ -137,29 +451,49 @@ func HandleConnection(client *Client, id int) {
 
 	time.Sleep(time.Second)
 	fmt.Fprintf(client.Conn, "\033[36m220  \033[0mWelcome to jamsualFT server, user %v! \n\n", id)
-	fmt.Fprintf(client.Conn, "Available commands: \n     help, echo, hllo, rgsr, user, pass, quit  \n\n")
+	fmt.Fprintf(client.Conn, "Available commands: \n     help, echo, hllo, noop, rgsr, user, pass, auth, pbsz, prot, quit  \n\n")
+
+	connectedAt := time.Now()
 
 	for {
 		select {
 		case <-quitChan:
 			return
 		default:
+			client.Conn.SetReadDeadline(controlDeadline(client, connectedAt))
+
 			buffer := make([]byte, 1024) // request buffer
 			n, err := client.Conn.Read(buffer)
 
-			if err == io.EOF {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return // client left or the session was kicked
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if client.Session.currentTransfer() != nil {
+					continue // quiet control connection is fine while data is moving
+				}
+				client.log().Info("control connection timed out")
+				fmt.Fprintf(client.Conn, "\033[31m421  \033[0mTimeout, closing control connection.\n\n")
 				return
 			}
 
 			if err != nil {
-				fmt.Printf("Error reading from connection %v: %v\n", id, err)
+				client.log().Warn("reading from connection failed", "error", err)
 				return
 			}
 
-			str := strings.TrimSpace(string(buffer[:n]))
+			str := strings.TrimSpace(string(stripTelnet(buffer[:n])))
+			if str == "" {
+				continue // e.g. only telnet IP/Synch before ABOR
+			}
 			part := strings.Split(str, " ")
 			command := strings.ToUpper(part[0])
 			args := part[1:]
+			if command == "AUTH" {
+				HandleCommands(client, command, args) // the handshake needs the connection to itself
+				continue
+			}
 			go HandleCommands(client, command, args)
 		}
 	}
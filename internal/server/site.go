@@ -0,0 +1,284 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"jamserver/internal/jfs"
+	"jamserver/internal/users"
+	"os"
+	"slices"
+	"strings"
+)
+
+// NOTE: SITE carries the server specific commands, rfc 959 section 4.1.3
+
+var errWrongPassword = errors.New("wrong password")
+
+// arguments of these SITE commands hold passwords and never go to the log
+var secretSiteCommands = []string{"PASSWD", "TOTP"}
+
+func handleSite(client *Client, args []string) {
+	siteCommands := map[string]func(*Client, []string){
+		"CHMOD":  handleSiteChmod,
+		"CHOWN":  handleSiteChown,
+		"HELP":   handleSiteHelp,
+		"PASSWD": handleSitePasswd,
+		"QUOTA":  handleSiteQuota,
+		"TOTP":   handleSiteTOTP,
+	}
+
+	if !client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m503  \033[0mNot logged in.\n\n"))
+		return
+	}
+
+	if client.Session.Anonymous {
+		client.Conn.Write([]byte("\033[31m530  \033[0mSITE is not available to anonymous sessions.\n\n"))
+		return
+	}
+
+	if len(args) == 0 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site <command> [arguments], see site help.\n\n"))
+		return
+	}
+
+	command := strings.ToUpper(args[0])
+	if handler, ok := siteCommands[command]; ok {
+		handler(client, args[1:])
+		return
+	}
+	fmt.Fprintf(client.Conn, "\033[31m504  \033[0mSITE %v not implemented.\n\n", command)
+}
+
+func siteArgs(args []string) string {
+	if len(args) > 0 && slices.Contains(secretSiteCommands, strings.ToUpper(args[0])) {
+		return args[0] + " [redacted]"
+	}
+	return strings.Join(args, " ")
+}
+
+func handleSiteHelp(client *Client, _ []string) {
+	fmt.Fprintf(client.Conn, "\033[32m214  \033[0mSITE commands: \n     help, chmod <mode> <file>, chown [user][:group] <file>, passwd <old> <new>, quota, totp [enroll | confirm <code> | disable <code>]  \n\n")
+}
+
+// SITE PASSWD <old> <new>, the old password is checked again inside the store
+// update so two changes at once can't both win
+func handleSitePasswd(client *Client, args []string) {
+	client.Session.loginMu.Lock()
+	defer client.Session.loginMu.Unlock()
+
+	if len(args) != 2 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site passwd <old password> <new password>.\n\n"))
+		return
+	}
+	oldPassword, newPassword := args[0], args[1]
+	login := client.Session.Login
+
+	if oldPassword == newPassword {
+		client.Conn.Write([]byte("\033[31m501  \033[0mNew password is the same as the old one.\n\n"))
+		return
+	}
+
+	var policyErr policyError
+	if err := checkPasswordPolicy(currentConfig().Registration.Password, login, newPassword); errors.As(err, &policyErr) {
+		fmt.Fprintf(client.Conn, "\033[31m501  \033[0m%v, try again.\n\n", policyErr)
+		return
+	} else if err != nil {
+		client.log().Error("checking password policy failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+		return
+	}
+
+	hash, err := users.HashPassword(newPassword)
+	if err != nil {
+		client.Conn.Write([]byte("\033[31m451  \033[0mError generating password hash, maybe password is too long?\n\n"))
+		return
+	}
+
+	err = userStore.Update(login, func(user *users.Credentials) error {
+		if !user.CheckPassword(oldPassword) {
+			return errWrongPassword
+		}
+		user.Password = hash
+		return nil
+	})
+	if errors.Is(err, errWrongPassword) {
+		client.log().Warn("password change with wrong current password")
+		if passwordFailed(client) {
+			client.Conn.Write([]byte("\033[31m530  \033[0mCurrent password is wrong.\n\n"))
+		}
+		return
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		client.Conn.Write([]byte("\033[31m530  \033[0mAccount no longer exists.\n\n"))
+		return
+	}
+	if err != nil {
+		client.log().Error("saving user database failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+		return
+	}
+
+	client.log().Info("password changed")
+	kicked := 0
+	if currentConfig().Login.EndSessionsOnPasswordChange {
+		kicked = disconnectUser(login, "Password changed, log in again", client.ID)
+	}
+	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mPassword changed, %d other session(s) closed.\n\n", kicked)
+}
+
+// SITE TOTP sets up the second factor: enroll hands out a secret, confirm
+// turns it on with a first code and shows the recovery codes
+func handleSiteTOTP(client *Client, args []string) {
+	client.Session.loginMu.Lock()
+	defer client.Session.loginMu.Unlock()
+
+	login := client.Session.Login
+	user, err := userStore.Get(login)
+	if err != nil {
+		client.log().Error("loading user database failed", "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+		return
+	}
+
+	if len(args) == 0 {
+		switch {
+		case user.SecondFactor():
+			fmt.Fprintf(client.Conn, "\033[32m200  \033[0mTOTP is on, %d recovery code(s) left.\n\n", len(user.TOTP.RecoveryCodes))
+		case user.TOTP != nil:
+			client.Conn.Write([]byte("\033[32m200  \033[0mTOTP is enrolled, finish with site totp confirm <code>.\n\n"))
+		default:
+			client.Conn.Write([]byte("\033[32m200  \033[0mTOTP is off, start with site totp enroll.\n\n"))
+		}
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ENROLL":
+		totp, err := userStore.EnrollTOTP(login)
+		if errors.Is(err, users.ErrTOTPActive) || errors.Is(err, users.ErrNoTOTP) {
+			fmt.Fprintf(client.Conn, "\033[31m550  \033[0m%v.\n\n", err)
+			return
+		}
+		if err != nil {
+			client.log().Error("saving user database failed", "error", err)
+			client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+			return
+		}
+		client.log().Info("TOTP enrolment started")
+		fmt.Fprintf(client.Conn, "\033[32m200  \033[0mAdd this to your authenticator app, then site totp confirm <code>: \n     secret: %v \n     %v  \n\n",
+			totp.Secret, totp.URI("jamsualFT", login))
+	case "CONFIRM":
+		if len(args) != 2 {
+			client.Conn.Write([]byte("\033[31m501  \033[0mUse: site totp confirm <code>.\n\n"))
+			return
+		}
+		codes, err := userStore.ConfirmTOTP(login, args[1])
+		if errors.Is(err, users.ErrInvalidCode) {
+			client.Conn.Write([]byte("\033[31m530  \033[0mWrong code, check the clock of your device and try again.\n\n"))
+			return
+		}
+		if errors.Is(err, users.ErrTOTPActive) || errors.Is(err, users.ErrNoTOTP) {
+			fmt.Fprintf(client.Conn, "\033[31m550  \033[0m%v.\n\n", err)
+			return
+		}
+		if err != nil {
+			client.log().Error("saving user database failed", "error", err)
+			client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+			return
+		}
+		client.log().Info("TOTP enabled")
+		fmt.Fprintf(client.Conn, "\033[32m200  \033[0mTOTP is on. Recovery codes, each works once instead of a code, they won't be shown again: \n     %v  \n\n",
+			strings.Join(codes, " "))
+	case "DISABLE":
+		if len(args) != 2 {
+			client.Conn.Write([]byte("\033[31m501  \033[0mUse: site totp disable <code or recovery code>.\n\n"))
+			return
+		}
+		err := userStore.DisableTOTP(login, args[1])
+		if errors.Is(err, users.ErrInvalidCode) {
+			client.log().Warn("disabling TOTP with a wrong code")
+			if passwordFailed(client) {
+				client.Conn.Write([]byte("\033[31m530  \033[0mWrong or already used code.\n\n"))
+			}
+			return
+		}
+		if errors.Is(err, users.ErrTOTPActive) || errors.Is(err, users.ErrNoTOTP) {
+			fmt.Fprintf(client.Conn, "\033[31m550  \033[0m%v.\n\n", err)
+			return
+		}
+		if err != nil {
+			client.log().Error("saving user database failed", "error", err)
+			client.Conn.Write([]byte("\033[31m451  \033[0mLocal server error.\n\n"))
+			return
+		}
+		client.log().Info("TOTP disabled")
+		client.Conn.Write([]byte("\033[32m200  \033[0mTOTP is off.\n\n"))
+	default:
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site totp [enroll | confirm <code> | disable <code>].\n\n"))
+	}
+}
+
+// SITE CHMOD <mode> <file>, only the owner of a file can change its mode
+func handleSiteChmod(client *Client, args []string) {
+	if len(args) != 2 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site chmod <mode> <file>, mode is octal like 644.\n\n"))
+		return
+	}
+	if !allowed(client, users.PermChmod) {
+		return
+	}
+
+	mode, err := jfs.ParseMode(args[0])
+	if err != nil {
+		fmt.Fprintf(client.Conn, "\033[31m501  \033[0m%v.\n\n", err)
+		return
+	}
+	fileName := args[1]
+	if err := client.Session.FileSystem.Chmod(fileName, mode); err != nil {
+		siteFileError(client, fileName, err)
+		return
+	}
+
+	client.log().Info("mode changed", "file", fileName, "mode", fmt.Sprintf("%03o", mode))
+	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mMode of %s set to %03o.\n\n", fileName, mode)
+}
+
+// SITE CHOWN [user][:group] <file>, the owner can change the group to one of
+// its own, the owner itself stays as it is
+func handleSiteChown(client *Client, args []string) {
+	if len(args) != 2 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site chown [user][:group] <file>.\n\n"))
+		return
+	}
+	if !allowed(client, users.PermChmod) {
+		return
+	}
+
+	owner, group, _ := strings.Cut(args[0], ":")
+	if owner == "" && group == "" {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: site chown [user][:group] <file>.\n\n"))
+		return
+	}
+	fileName := args[1]
+	if err := client.Session.FileSystem.Chown(fileName, owner, group); err != nil {
+		siteFileError(client, fileName, err)
+		return
+	}
+
+	attrs, _, _ := client.Session.FileSystem.Attributes(fileName)
+	client.log().Info("owner changed", "file", fileName, "owner", attrs.Owner, "group", attrs.Group)
+	fmt.Fprintf(client.Conn, "\033[32m200  \033[0mOwner of %s is %v:%v.\n\n", fileName, attrs.Owner, attrs.Group)
+}
+
+func siteFileError(client *Client, fileName string, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Fprintf(client.Conn, "\033[31m550  \033[0mNo such file: %s.\n\n", fileName)
+	case errors.Is(err, jfs.ErrDenied), errors.Is(err, jfs.ErrReadOnly):
+		fmt.Fprintf(client.Conn, "\033[31m550  \033[0m%v.\n\n", err)
+	default:
+		client.log().Error("changing file attributes failed", "file", fileName, "error", err)
+		client.Conn.Write([]byte("\033[31m451  \033[0mServer error, please try again later.\n\n"))
+	}
+}
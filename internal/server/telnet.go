@@ -0,0 +1,41 @@
+package server
+
+// NOTE: telnet commands clients put in front of ABOR, rfc 959 section 4.1.3 and rfc 854
+const (
+	telnetIAC  byte = 255
+	telnetSE   byte = 240
+	telnetWILL byte = 251
+	telnetDONT byte = 254
+)
+
+// stripTelnet removes telnet command sequences (IP, Synch/DM, option
+// negotiation) from the control connection input, IAC IAC stays as a single
+// 255 byte. Linux takes the urgent DM byte out of the stream, so a lone IAC
+// followed by normal text only drops the IAC.
+func stripTelnet(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i++ {
+		if data[i] != telnetIAC {
+			out = append(out, data[i])
+			continue
+		}
+
+		if i+1 >= len(data) {
+			break
+		}
+
+		command := data[i+1]
+		switch {
+		case command == telnetIAC:
+			out = append(out, telnetIAC)
+			i++
+		case command >= telnetWILL && command <= telnetDONT:
+			i += 2 // option negotiation carries one option byte
+		case command >= telnetSE:
+			i++
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStripTelnet(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"plain", []byte("ABOR\r\n"), []byte("ABOR\r\n")},
+		{"IP and Synch", []byte{255, 244, 255, 242, 'A', 'B', 'O', 'R', '\r', '\n'}, []byte("ABOR\r\n")},
+		{"IP, urgent DM taken out", []byte{255, 244, 255, 'A', 'B', 'O', 'R'}, []byte("ABOR")},
+		{"option negotiation", []byte{255, 251, 1, 'N', 'O', 'O', 'P'}, []byte("NOOP")},
+		{"escaped IAC", []byte{'a', 255, 255, 'b'}, []byte{'a', 255, 'b'}},
+		{"IAC at the end", []byte{'a', 255}, []byte("a")},
+	}
+	for _, tt := range tests {
+		if got := stripTelnet(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("%v: stripTelnet(%v) = %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
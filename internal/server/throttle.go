@@ -0,0 +1,57 @@
+package server
+
+import (
+	"jamserver/internal/config"
+	"jamserver/internal/dtp"
+	"sync"
+)
+
+// limiters live for the whole server run and only get their rates changed,
+// so running transfers pick up new limits without reconnecting
+var (
+	throttleMu    sync.Mutex
+	globalLimiter = dtp.NewLimiter(0)
+	userLimiters  = make(map[string]*dtp.Limiter)
+	groupLimiters = make(map[string]*dtp.Limiter)
+)
+
+func applyLimits(limiters map[string]*dtp.Limiter, rates map[string]int64) {
+	for name, limiter := range limiters {
+		if _, ok := rates[name]; !ok {
+			limiter.SetRate(0)
+		}
+	}
+	for name, rate := range rates {
+		if limiter, ok := limiters[name]; ok {
+			limiter.SetRate(rate)
+		} else {
+			limiters[name] = dtp.NewLimiter(rate)
+		}
+	}
+}
+
+func applyThrottleConfig(cfg config.Throttle) {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	globalLimiter.SetRate(cfg.Global)
+	applyLimits(userLimiters, cfg.Users)
+	applyLimits(groupLimiters, cfg.Groups)
+}
+
+// sessionLimiters returns every limiter the session's transfers are held to
+func sessionLimiters(session *Session) []*dtp.Limiter {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	limiters := []*dtp.Limiter{globalLimiter}
+	if limiter, ok := userLimiters[session.Login]; ok {
+		limiters = append(limiters, limiter)
+	}
+	for _, group := range session.Groups {
+		if limiter, ok := groupLimiters[group]; ok {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
+}
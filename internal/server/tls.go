@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"jamserver/internal/config"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: FTPS, explicit TLS on the control connection, https://www.rfc-editor.org/rfc/rfc4217
+
+const handshakeTimeout = 30 * time.Second
+
+var (
+	tlsMu        sync.RWMutex
+	serverTLS    *tls.Config    // nil while TLS isn't configured
+	clientCAPool *x509.CertPool // nil without a client CA, then only pinned certificates log in
+)
+
+// loadTLSConfig reads the certificate, key and client CA, on reload too so
+// renewed certificates are picked up without a restart
+func loadTLSConfig(cfg config.TLS) error {
+	if cfg.CertFile == "" {
+		tlsMu.Lock()
+		serverTLS, clientCAPool = nil, nil
+		tlsMu.Unlock()
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate error: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if cfg.ClientCA != "" {
+		data, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("reading TLS client CA error: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in TLS client CA %v", cfg.ClientCA)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// certificates are checked when USER maps them to an account, a pinned
+		// self-signed one has to get through the handshake too
+		ClientAuth: tls.RequestClientCert,
+	}
+
+	tlsMu.Lock()
+	serverTLS, clientCAPool = tlsConfig, pool
+	tlsMu.Unlock()
+	return nil
+}
+
+func currentTLS() (*tls.Config, *x509.CertPool) {
+	tlsMu.RLock()
+	defer tlsMu.RUnlock()
+	return serverTLS, clientCAPool
+}
+
+// controlConn is the connection of client under the reply recorder of the
+// running command
+func controlConn(client *Client) net.Conn {
+	if reply, ok := client.Conn.(*replyRecorder); ok {
+		return reply.Conn
+	}
+	return client.Conn
+}
+
+// isTLS tells whether the control connection is already protected
+func isTLS(client *Client) bool {
+	_, secure := controlConn(client).(*tls.Conn)
+	return secure
+}
+
+// handleAuth runs on the read loop, not in its own goroutine, nothing else may
+// read the connection while the handshake takes it over
+func handleAuth(client *Client, args []string) {
+	if len(args) != 1 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: auth tls.\n\n"))
+		return
+	}
+
+	mechanism := strings.ToUpper(args[0])
+	if mechanism != "TLS" && mechanism != "SSL" && mechanism != "TLS-C" {
+		fmt.Fprintf(client.Conn, "\033[31m504  \033[0mAUTH %v not supported, use auth tls.\n\n", mechanism)
+		return
+	}
+
+	tlsConfig, _ := currentTLS()
+	if tlsConfig == nil {
+		client.Conn.Write([]byte("\033[31m431  \033[0mTLS is not configured on this server.\n\n"))
+		return
+	}
+
+	if isTLS(client) {
+		client.Conn.Write([]byte("\033[31m503  \033[0mAlready using TLS.\n\n"))
+		return
+	}
+
+	if client.Session.Authenticated {
+		client.Conn.Write([]byte("\033[31m503  \033[0mAUTH has to come before login.\n\n"))
+		return
+	}
+
+	fmt.Fprintf(client.Conn, "\033[32m234  \033[0mAUTH %v ok, start the handshake.\n", mechanism)
+
+	conn := controlConn(client)
+	tlsConn := tls.Server(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		client.log().Info("TLS handshake failed", "error", err)
+		conn.Close() // read loop ends and cleans up the session
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	client.Session.setLogin("") // rfc 4217, USER starts over on the protected connection
+	client.Session.setAnonymous(false)
+	if len(state.PeerCertificates) > 0 {
+		client.Session.PeerCertificate = state.PeerCertificates[0]
+		client.Session.CertificateVerified = verifyClientCertificate(state.PeerCertificates)
+	}
+	client.Conn = tlsConn
+
+	client.log().Info("TLS established", "version", tls.VersionName(state.Version),
+		"client_certificate", client.Session.PeerCertificate != nil, "verified", client.Session.CertificateVerified)
+}
+
+// verifyClientCertificate checks the chain against the configured client CA
+func verifyClientCertificate(chain []*x509.Certificate) bool {
+	_, pool := currentTLS()
+	if pool == nil {
+		return false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// PBSZ is always 0 for TLS, it only has to come before PROT
+func handlePBSZ(client *Client, _ []string) {
+	if !isTLS(client) {
+		client.Conn.Write([]byte("\033[31m503  \033[0mPBSZ needs AUTH TLS first.\n\n"))
+		return
+	}
+	client.Conn.Write([]byte("\033[32m200  \033[0mPBSZ=0\n\n"))
+}
+
+func handleProt(client *Client, args []string) {
+	if !isTLS(client) {
+		client.Conn.Write([]byte("\033[31m503  \033[0mPROT needs AUTH TLS first.\n\n"))
+		return
+	}
+	if len(args) != 1 {
+		client.Conn.Write([]byte("\033[31m501  \033[0mUse: prot c or prot p.\n\n"))
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "C":
+		client.Session.ProtectData = false
+		client.Conn.Write([]byte("\033[32m200  \033[0mData connections in the clear.\n\n"))
+	case "P":
+		client.Session.ProtectData = true
+		client.Conn.Write([]byte("\033[32m200  \033[0mData connections protected by TLS.\n\n"))
+	case "S", "E":
+		client.Conn.Write([]byte("\033[31m536  \033[0mOnly prot c and prot p are supported.\n\n"))
+	default:
+		client.Conn.Write([]byte("\033[31m504  \033[0mUnknown protection level.\n\n"))
+	}
+}
+
+// protectData wraps a data connection in TLS after PROT P, the handshake
+// happens on the first read or write
+func protectData(client *Client, conn net.Conn) (net.Conn, error) {
+	if !client.Session.ProtectData {
+		return conn, nil
+	}
+
+	tlsConfig, _ := currentTLS()
+	if tlsConfig == nil {
+		return nil, errors.New("TLS is no longer configured")
+	}
+	return tls.Server(conn, tlsConfig), nil
+}
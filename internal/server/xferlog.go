@@ -0,0 +1,78 @@
+package server
+
+import (
+	"jamserver/internal/config"
+	"jamserver/internal/jfs"
+	"jamserver/internal/xferlog"
+	"sync"
+	"time"
+)
+
+var (
+	transferLogMu sync.Mutex
+	transferLog   *xferlog.Logger // nil when the xferlog is turned off
+)
+
+// openTransferLog (re)opens the xferlog on startup and config reload
+func openTransferLog(cfg config.Xferlog) error {
+	var logger *xferlog.Logger
+	if cfg.File != "" {
+		var err error
+		logger, err = xferlog.Open(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.Keep)
+		if err != nil {
+			return err
+		}
+	}
+
+	transferLogMu.Lock()
+	previous := transferLog
+	transferLog = logger
+	transferLogMu.Unlock()
+
+	return previous.Close()
+}
+
+// loggedPath is filename as the xferlog shows it, resolved from the root of
+// the storage. Guests have a tree of their own, their drop box is /incoming.
+func loggedPath(client *Client, fileSystem *jfs.FileSystem, filename string) string {
+	if client.Session.Anonymous && fileSystem == client.Session.Incoming {
+		return "/incoming" + fileSystem.Path(filename)
+	}
+	return fileSystem.Path(filename)
+}
+
+// transferDone records a finished or aborted RETR/STOR/APPE/DELE of the file
+// at path (see loggedPath) in the xferlog and the metrics
+func transferDone(client *Client, direction byte, path string, bytes int64, started time.Time, complete bool) {
+	transferLogMu.Lock()
+	logger := transferLog
+	transferLogMu.Unlock()
+
+	entry := xferlog.Entry{
+		Time:       time.Now(),
+		Duration:   time.Since(started),
+		RemoteHost: client.ip(),
+		Bytes:      bytes,
+		Path:       path,
+		Direction:  direction,
+		AccessMode: xferlog.AccessReal,
+		User:       client.Session.Login,
+		Complete:   complete,
+	}
+	if client.Session.Anonymous {
+		entry.AccessMode = xferlog.AccessAnonymous
+		entry.User = client.Session.AnonymousEmail
+	}
+	if err := logger.Log(entry); err != nil {
+		client.log().Error("writing xferlog failed", "error", err)
+	}
+
+	switch direction {
+	case xferlog.DirectionIncoming:
+		transferBytesTotal.Add(float64(bytes), "in")
+		transferDuration.Observe(entry.Duration.Seconds(), "in")
+	case xferlog.DirectionOutgoing:
+		transferBytesTotal.Add(float64(bytes), "out")
+		transferDuration.Observe(entry.Duration.Seconds(), "out")
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"jamserver/internal/jfs"
+	"testing"
+)
+
+func TestLoggedPath(t *testing.T) {
+	storage := jfs.NewFileSystem(t.TempDir())
+	alice, err := storage.Sub("home/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := storage.Sub("home/bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := &Session{Anonymous: true, FileSystem: jfs.NewFileSystem(t.TempDir()), Incoming: jfs.NewFileSystem(t.TempDir())}
+
+	tests := []struct {
+		session    *Session
+		fileSystem *jfs.FileSystem
+		filename   string
+		want       string
+	}{
+		{&Session{FileSystem: alice}, alice, "/report.pdf", "/home/alice/report.pdf"},
+		{&Session{FileSystem: bob}, bob, "/report.pdf", "/home/bob/report.pdf"},
+		{&Session{FileSystem: alice}, alice, "../../x", "/home/alice/x"},
+		{&Session{FileSystem: alice}, alice, "//a//b", "/home/alice/a/b"},
+		{guest, guest.FileSystem, "pub/readme", "/pub/readme"},
+		{guest, guest.Incoming, "upload.zip", "/incoming/upload.zip"},
+	}
+	for _, tt := range tests {
+		client := &Client{Conn: discardConn{}, Session: tt.session}
+		if got := loggedPath(client, tt.fileSystem, tt.filename); got != tt.want {
+			t.Errorf("loggedPath(%q) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package users
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Permission is one kind of file operation an account may do
+type Permission string
+
+const (
+	PermList   Permission = "list"
+	PermRead   Permission = "read"
+	PermWrite  Permission = "write"
+	PermDelete Permission = "delete"
+	PermRename Permission = "rename"
+	PermMkdir  Permission = "mkdir"
+	PermChmod  Permission = "chmod"
+)
+
+var AllPermissions = []Permission{PermList, PermRead, PermWrite, PermDelete, PermRename, PermMkdir, PermChmod}
+
+// Access is what an account may do once logged in, it's part of Credentials
+type Access struct {
+	Permissions []Permission `json:"permissions,omitempty"` // empty allows everything, like before permissions existed
+	Home        string       `json:"home,omitempty"`        // directory in the file system the user is locked into, empty is the root
+	Expires     time.Time    `json:"expires,omitempty"`     // zero never expires
+}
+
+func (a Access) Can(p Permission) bool {
+	return Allows(a.Permissions, p)
+}
+
+func (a Access) Expired(now time.Time) bool {
+	return !a.Expires.IsZero() && now.After(a.Expires)
+}
+
+// Allows checks a permission set, empty means everything
+func Allows(permissions []Permission, p Permission) bool {
+	return len(permissions) == 0 || slices.Contains(permissions, p)
+}
+
+// ParsePermissions reads names like "list,read" (or "all"), unknown ones are an error
+func ParsePermissions(names []string) ([]Permission, error) {
+	var permissions []Permission
+	for _, name := range names {
+		p := Permission(strings.ToLower(strings.TrimSpace(name)))
+		if p == "all" {
+			return nil, nil
+		}
+		if !slices.Contains(AllPermissions, p) {
+			return nil, fmt.Errorf("unknown permission %q", name)
+		}
+		if !slices.Contains(permissions, p) {
+			permissions = append(permissions, p)
+		}
+	}
+	return permissions, nil
+}
+
+// Clean checks the permissions and brings the home directory into its stored form
+func (a Access) Clean() (Access, error) {
+	names := make([]string, 0, len(a.Permissions))
+	for _, p := range a.Permissions {
+		names = append(names, string(p))
+	}
+
+	permissions, err := ParsePermissions(names)
+	if err != nil {
+		return Access{}, err
+	}
+	a.Permissions = permissions
+	a.Home = CleanHome(a.Home)
+	return a, nil
+}
+
+// CleanHome turns a home directory into its stored form, "/" and "" are the root
+func CleanHome(dir string) string {
+	return strings.TrimPrefix(path.Clean("/"+dir), "/")
+}
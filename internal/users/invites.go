@@ -0,0 +1,131 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"jamserver/pkg/utils"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const DefaultInvitesPath = "app/invites.json"
+
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// Invite lets one person register while registration is invite only, the
+// new account gets Groups
+type Invite struct {
+	Code    string    `json:"code"`
+	Groups  []string  `json:"groups,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero never expires
+}
+
+func (i Invite) Expired(now time.Time) bool {
+	return !i.Expires.IsZero() && now.After(i.Expires)
+}
+
+// InviteStore keeps unused invites (invites.json) the same way Store keeps users
+type InviteStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewInviteStore(path string) *InviteStore {
+	return &InviteStore{path: path}
+}
+
+func (s *InviteStore) Path() string {
+	return s.path
+}
+
+func (s *InviteStore) load() ([]Invite, error) {
+	invites, err := utils.LoadJSON[[]Invite](s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading invites error: %w", err)
+	}
+	return invites, nil
+}
+
+func (s *InviteStore) List() ([]Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Create makes a new invite, validFor 0 never expires
+func (s *InviteStore) Create(groups []string, validFor time.Duration) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invites, err := s.load()
+	if err != nil {
+		return Invite{}, err
+	}
+
+	random := make([]byte, 10)
+	if _, err := rand.Read(random); err != nil {
+		return Invite{}, err
+	}
+
+	invite := Invite{
+		Code:    base32.StdEncoding.EncodeToString(random),
+		Groups:  groups,
+		Created: time.Now().UTC(),
+	}
+	if validFor > 0 {
+		invite.Expires = invite.Created.Add(validFor)
+	}
+
+	return invite, utils.SaveJSON(s.path, append(invites, invite))
+}
+
+func (s *InviteStore) Delete(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invites, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(invites, func(i Invite) bool { return i.Code == code })
+	if idx < 0 {
+		return ErrInvalidInvite
+	}
+	return utils.SaveJSON(s.path, slices.Delete(invites, idx, idx+1))
+}
+
+// Use spends an invite on register, which adds the account. The invite stays
+// when register fails (e.g. the login is taken). Expired invites are dropped
+// along the way.
+func (s *InviteStore) Use(code string, register func(Invite) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invites, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	idx := slices.IndexFunc(invites, func(i Invite) bool { return i.Code == code && !i.Expired(now) })
+	if idx < 0 {
+		return ErrInvalidInvite
+	}
+
+	if err := register(invites[idx]); err != nil {
+		return err
+	}
+
+	invites = slices.Delete(invites, idx, idx+1)
+	invites = slices.DeleteFunc(invites, func(i Invite) bool { return i.Expired(now) })
+	return utils.SaveJSON(s.path, invites)
+}
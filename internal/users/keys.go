@@ -0,0 +1,111 @@
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// NOTE: login without a password with tls client certificates. SSH keys are
+// left for an SFTP side, there is none to check them yet.
+
+// certificate entries are either "sha256:<hex of the DER certificate>", which
+// pins one certificate, or "subject:<distinguished name>", which takes any
+// certificate with that subject signed by the configured client CA
+const (
+	certFingerprint = "sha256:"
+	certSubject     = "subject:"
+)
+
+// ParseCertificateEntry accepts a "sha256:" or "subject:" entry, or a PEM
+// certificate which is turned into its fingerprint entry
+func ParseCertificateEntry(value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid certificate: %w", err)
+		}
+		return CertificateFingerprint(cert), nil
+	}
+
+	if fingerprint, ok := strings.CutPrefix(value, certFingerprint); ok {
+		fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+			return "", errors.New("sha256 fingerprint must be 64 hex digits")
+		}
+		return certFingerprint + fingerprint, nil
+	}
+
+	if subject, ok := strings.CutPrefix(value, certSubject); ok && subject != "" {
+		return value, nil
+	}
+	return "", errors.New(`certificate must be PEM, "sha256:<fingerprint>" or "subject:<distinguished name>"`)
+}
+
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return certFingerprint + hex.EncodeToString(sum[:])
+}
+
+// CertificateMatches tells whether cert belongs to the user, subjects only
+// count when the certificate was verified against the client CA
+func (c Credentials) CertificateMatches(cert *x509.Certificate, verified bool) bool {
+	fingerprint := CertificateFingerprint(cert)
+	subject := subjectAttributes(cert.Subject.String())
+
+	return slices.ContainsFunc(c.Certificates, func(entry string) bool {
+		if entry == fingerprint {
+			return true
+		}
+		name, ok := strings.CutPrefix(entry, certSubject)
+		return ok && verified && slices.Equal(subjectAttributes(name), subject)
+	})
+}
+
+// subjectAttributes splits a distinguished name into sorted attributes, openssl
+// and go print the same subject in different orders. Escaped (\, or \2C) and
+// quoted separators are part of the value, the values are compared unescaped.
+func subjectAttributes(name string) []string {
+	var attributes []string
+	var attribute []byte
+	add := func() {
+		key, value, _ := strings.Cut(string(attribute), "=")
+		attributes = append(attributes, strings.ToUpper(strings.TrimSpace(key))+"="+strings.TrimSpace(value))
+		attribute = attribute[:0]
+	}
+
+	quoted := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]):
+			decoded, _ := hex.DecodeString(name[i+1 : i+3])
+			attribute = append(attribute, decoded...)
+			i += 2
+		case c == '\\' && i+1 < len(name):
+			attribute = append(attribute, name[i+1])
+			i++
+		case c == '"':
+			quoted = !quoted
+		case (c == ',' || c == '+') && !quoted:
+			add()
+		default:
+			attribute = append(attribute, c)
+		}
+	}
+	add()
+
+	slices.Sort(attributes)
+	return attributes
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
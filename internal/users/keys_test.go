@@ -0,0 +1,101 @@
+package users
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSubjectAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"CN=alice,O=Jam", []string{"CN=alice", "O=Jam"}},
+		{"o=Jam, cn=alice", []string{"CN=alice", "O=Jam"}},
+		{`CN=alice,O=Jam\, Inc.`, []string{"CN=alice", "O=Jam, Inc."}},
+		{`CN=alice,O=Jam\2C Inc.`, []string{"CN=alice", "O=Jam, Inc."}},
+		{`CN=alice,O="Jam, Inc."`, []string{"CN=alice", "O=Jam, Inc."}},
+		{`CN=alice+UID=7,O=Jam`, []string{"CN=alice", "O=Jam", "UID=7"}},
+		{`CN=a\+b\\c`, []string{`CN=a+b\c`}},
+	}
+	for _, tt := range tests {
+		if got := subjectAttributes(tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("subjectAttributes(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testCertificate(t *testing.T, subject pkix.Name) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertificateMatches(t *testing.T) {
+	cert := testCertificate(t, pkix.Name{CommonName: "alice", Organization: []string{"Jam, Inc."}})
+	other := testCertificate(t, pkix.Name{CommonName: "alice", Organization: []string{"Jam"}})
+
+	tests := []struct {
+		name     string
+		entries  []string
+		cert     *x509.Certificate
+		verified bool
+		want     bool
+	}{
+		{"pinned", []string{CertificateFingerprint(cert)}, cert, false, true},
+		{"pinned other", []string{CertificateFingerprint(cert)}, other, true, false},
+		{"subject with comma", []string{`subject:CN=alice,O=Jam\, Inc.`}, cert, true, true},
+		{"subject in other order", []string{`subject:O=Jam\, Inc.,CN=alice`}, cert, true, true},
+		{"subject not verified", []string{`subject:CN=alice,O=Jam\, Inc.`}, cert, false, false},
+		{"subject cut at the comma", []string{`subject:CN=alice,O=Jam`}, cert, true, false},
+		{"subject of other", []string{`subject:CN=alice,O=Jam`}, other, true, true},
+	}
+	for _, tt := range tests {
+		c := Credentials{Certificates: tt.entries}
+		if got := c.CertificateMatches(tt.cert, tt.verified); got != tt.want {
+			t.Errorf("%v: CertificateMatches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseCertificateEntry(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // "" when it's refused
+	}{
+		{"sha256:AB:CD:00112233445566778899aabbccddeeff00112233445566778899aabbccdd", "sha256:abcd00112233445566778899aabbccddeeff00112233445566778899aabbccdd"},
+		{"sha256:1234", ""},
+		{"subject:CN=alice", "subject:CN=alice"},
+		{"subject:", ""},
+		{"alice", ""},
+	}
+	for _, tt := range tests {
+		got, err := ParseCertificateEntry(tt.value)
+		if (tt.want == "") != (err != nil) || got != tt.want {
+			t.Errorf("ParseCertificateEntry(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
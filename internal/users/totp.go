@@ -0,0 +1,204 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NOTE: second factor, time based one-time passwords https://www.rfc-editor.org/rfc/rfc6238
+// with the usual authenticator app settings: HMAC-SHA1, 6 digits, 30 seconds
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted either side of now, clocks drift
+
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid one-time code")
+	ErrTOTPActive  = errors.New("TOTP is already on, disable it first")
+	ErrNoTOTP      = errors.New("TOTP is not set up")
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TOTP struct {
+	Secret        string   `json:"secret"`    // base32, as typed into authenticator apps
+	Confirmed     bool     `json:"confirmed"` // enrolment finished with a valid code, only then it's asked for
+	LastStep      int64    `json:"last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // sha256 of the unused codes
+}
+
+// SecondFactor tells whether login needs a one-time code after the password
+func (c Credentials) SecondFactor() bool {
+	return c.TOTP != nil && c.TOTP.Confirmed
+}
+
+func NewTOTP() (*TOTP, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &TOTP{Secret: secretEncoding.EncodeToString(secret)}, nil
+}
+
+// URI is the otpauth:// link authenticator apps import (usually as a QR code)
+func (t *TOTP) URI(issuer string, login string) string {
+	values := url.Values{}
+	values.Set("secret", t.Secret)
+	values.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%v:%v?%v", url.PathEscape(issuer), url.PathEscape(login), values.Encode())
+}
+
+func totpCode(secret []byte, step int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verify returns the time step code belongs to, a step is only good once
+func (t *TOTP) verify(code string, now time.Time) (int64, bool) {
+	secret, err := secretEncoding.DecodeString(t.Secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns the codes to show once and their hashes to keep
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for range recoveryCodeCount {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := secretEncoding.EncodeToString(random)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// useCode accepts a current TOTP code or spends a recovery code
+func (t *TOTP) useCode(code string, now time.Time) bool {
+	if step, ok := t.verify(code, now); ok {
+		t.LastStep = step
+		return true
+	}
+
+	hash := hashRecoveryCode(code)
+	idx := slices.Index(t.RecoveryCodes, hash)
+	if idx < 0 {
+		return false
+	}
+	t.RecoveryCodes = slices.Delete(t.RecoveryCodes, idx, idx+1)
+	return true
+}
+
+// UseSecondFactor checks a one-time or recovery code of a confirmed TOTP and
+// saves the used step or the spent recovery code, so neither works twice
+func (s *Store) UseSecondFactor(login string, code string) error {
+	return s.Update(login, func(user *Credentials) error {
+		if !user.SecondFactor() || !user.TOTP.useCode(code, time.Now()) {
+			return ErrInvalidCode
+		}
+		return nil
+	})
+}
+
+// EnrollTOTP starts over with a new secret, the old one (if any) keeps
+// working until ConfirmTOTP
+func (s *Store) EnrollTOTP(login string) (*TOTP, error) {
+	totp, err := NewTOTP()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Update(login, func(user *Credentials) error {
+		if user.SecondFactor() {
+			return ErrTOTPActive
+		}
+		user.TOTP = totp
+		return nil
+	})
+	return totp, err
+}
+
+// ConfirmTOTP activates an enrolled secret once the app produced a valid code
+// and returns the recovery codes, which are only kept hashed
+func (s *Store) ConfirmTOTP(login string, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Update(login, func(user *Credentials) error {
+		if user.TOTP == nil || user.TOTP.Confirmed {
+			return ErrNoTOTP
+		}
+		step, ok := user.TOTP.verify(code, time.Now())
+		if !ok {
+			return ErrInvalidCode
+		}
+		user.TOTP.Confirmed = true
+		user.TOTP.LastStep = step
+		user.TOTP.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns the second factor off, code may be a recovery code. An
+// empty code is the administrator's reset and always works.
+func (s *Store) DisableTOTP(login string, code string) error {
+	return s.Update(login, func(user *Credentials) error {
+		if user.TOTP == nil {
+			return ErrNoTOTP
+		}
+		if code != "" && user.SecondFactor() && !user.TOTP.useCode(code, time.Now()) {
+			return ErrInvalidCode
+		}
+		user.TOTP = nil
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package users
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc 6238 appendix B, SHA1 with the 8 digit codes cut to our 6
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %v, want %v", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func rfcTOTP() *TOTP {
+	return &TOTP{Secret: secretEncoding.EncodeToString([]byte("12345678901234567890")), Confirmed: true}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		ok   bool
+	}{
+		{"now", "050471", now, true},
+		{"a step late", "050471", now.Add(30 * time.Second), true},
+		{"two steps late", "050471", now.Add(60 * time.Second), false},
+		{"a step early", "050471", now.Add(-30 * time.Second), true},
+		{"wrong", "123456", now, false},
+		{"too short", "50471", now, false},
+	}
+	for _, tt := range tests {
+		if _, ok := rfcTOTP().verify(tt.code, tt.at); ok != tt.ok {
+			t.Errorf("%v: verify = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+
+	// a code is only good once
+	totp := rfcTOTP()
+	if !totp.useCode("050471", now) {
+		t.Fatal("first use refused")
+	}
+	if totp.useCode("050471", now) {
+		t.Error("code used twice")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes, %d hashes", len(codes), len(hashes))
+	}
+
+	totp := rfcTOTP()
+	totp.RecoveryCodes = hashes
+	now := time.Now()
+
+	// typed without the dash and in lower case still counts
+	typed := strings.ToLower(strings.ReplaceAll(codes[3], "-", ""))
+	if !totp.useCode(typed, now) {
+		t.Fatalf("recovery code %v refused", typed)
+	}
+	if totp.useCode(codes[3], now) {
+		t.Error("recovery code used twice")
+	}
+	if len(totp.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("%d recovery codes left", len(totp.RecoveryCodes))
+	}
+	if totp.useCode("AAAAA-BBBBB", now) {
+		t.Error("made up recovery code accepted")
+	}
+}
+
+func TestStoreTOTP(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "db.json"))
+	if err := store.Add(Credentials{Login: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	totp, err := store.EnrollTOTP("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.Get("alice"); user.SecondFactor() {
+		t.Error("second factor asked for before it was confirmed")
+	}
+	if _, err := store.ConfirmTOTP("alice", "000000"); err != ErrInvalidCode {
+		t.Errorf("confirm with a wrong code: %v", err)
+	}
+
+	secret, _ := secretEncoding.DecodeString(totp.Secret)
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+	recovery, err := store.ConfirmTOTP("alice", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.Get("alice"); !user.SecondFactor() {
+		t.Error("second factor off after confirming")
+	}
+	// the code that confirmed can't log in
+	if err := store.UseSecondFactor("alice", code); err != ErrInvalidCode {
+		t.Errorf("confirming code used again: %v", err)
+	}
+	if _, err := store.EnrollTOTP("alice"); err != ErrTOTPActive {
+		t.Errorf("enrolling over an active TOTP: %v", err)
+	}
+
+	if err := store.DisableTOTP("alice", "nope"); err != ErrInvalidCode {
+		t.Errorf("disable with a wrong code: %v", err)
+	}
+	if err := store.DisableTOTP("alice", recovery[0]); err != nil {
+		t.Errorf("disable with a recovery code: %v", err)
+	}
+	if user, _ := store.Get("alice"); user.TOTP != nil {
+		t.Error("TOTP still set after disabling")
+	}
+}
@@ -0,0 +1,180 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"jamserver/pkg/utils"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DefaultPath = "app/db.json"
+
+const bcryptCost = 10
+
+var (
+	ErrNotFound      = errors.New("user not found")
+	ErrExists        = errors.New("username exists")
+	ErrReservedLogin = errors.New("login is reserved for anonymous ftp")
+)
+
+// ReservedLogin names can't be accounts, they belong to anonymous ftp even
+// while it's turned off, an account would be shadowed as soon as it's on
+func ReservedLogin(login string) bool {
+	return strings.EqualFold(login, "anonymous") || strings.EqualFold(login, "ftp")
+}
+
+type Credentials struct {
+	Login    string   `json:"login"`
+	Password string   `json:"password"`
+	Groups   []string `json:"groups,omitempty"`
+	Disabled bool     `json:"disabled,omitempty"` // can't log in, the account and its files stay
+	Pending  bool     `json:"pending,omitempty"`  // registered, waits for an admin to approve it
+
+	Certificates []string `json:"certificates,omitempty"` // tls client certificates, see CertificateMatches
+	TOTP         *TOTP    `json:"totp,omitempty"`         // second factor, see SecondFactor
+
+	Access
+}
+
+// LogValue keeps the password hash out of the log
+func (c Credentials) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("login", c.Login), slog.Any("groups", c.Groups), slog.Bool("disabled", c.Disabled), slog.Bool("pending", c.Pending), slog.Bool("totp", c.SecondFactor()), slog.Any("permissions", c.Permissions))
+}
+
+func (c Credentials) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(password)) == nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Store is the user database (db.json), every change is a read-modify-write
+// of the whole file under the lock, so the file can still be edited by hand
+// while the server runs
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// caller holds mu, a missing file is an empty database
+func (s *Store) load() ([]Credentials, error) {
+	users, err := utils.LoadJSON[[]Credentials](s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading user database error: %w", err)
+	}
+	return users, nil
+}
+
+func (s *Store) List() ([]Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+func (s *Store) Get(login string) (Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	idx := slices.IndexFunc(users, func(u Credentials) bool { return u.Login == login })
+	if idx < 0 {
+		return Credentials{}, ErrNotFound
+	}
+	return users[idx], nil
+}
+
+func (s *Store) Add(user Credentials) error {
+	if ReservedLogin(user.Login) {
+		return ErrReservedLogin
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(users, func(u Credentials) bool { return u.Login == user.Login }) {
+		return ErrExists
+	}
+
+	return utils.SaveJSON(s.path, append(users, user))
+}
+
+// Update changes a single user, nothing is saved when update fails
+func (s *Store) Update(login string, update func(*Credentials) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(users, func(u Credentials) bool { return u.Login == login })
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	if err := update(&users[idx]); err != nil {
+		return err
+	}
+	return utils.SaveJSON(s.path, users)
+}
+
+func (s *Store) Delete(login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(users, func(u Credentials) bool { return u.Login == login })
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	return utils.SaveJSON(s.path, slices.Delete(users, idx, idx+1))
+}
+
+// Groups maps every group to its members
+func (s *Store) Groups() (map[string][]string, error) {
+	users, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]string)
+	for _, user := range users {
+		for _, group := range user.Groups {
+			groups[group] = append(groups[group], user.Login)
+		}
+	}
+	return groups, nil
+}
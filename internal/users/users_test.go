@@ -0,0 +1,24 @@
+package users
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAddReservedLogin(t *testing.T) {
+	tests := []struct {
+		login string
+		err   error
+	}{
+		{"alice", nil},
+		{"anonymous", ErrReservedLogin},
+		{"FTP", ErrReservedLogin},
+		{"ftpuser", nil},
+	}
+	store := NewStore(filepath.Join(t.TempDir(), "db.json"))
+	for _, tt := range tests {
+		if err := store.Add(Credentials{Login: tt.login}); err != tt.err {
+			t.Errorf("Add(%v) = %v, want %v", tt.login, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package xferlog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: wu-ftpd xferlog(5) format, one line per transfer:
+// current-time transfer-time remote-host file-size filename transfer-type
+// special-action-flag direction access-mode username service-name
+// authentication-method authenticated-user-id completion-status
+
+const (
+	DirectionOutgoing = 'o'
+	DirectionIncoming = 'i'
+	DirectionDeleted  = 'd'
+
+	AccessReal      = 'r'
+	AccessAnonymous = 'a'
+	AccessGuest     = 'g'
+)
+
+type Entry struct {
+	Time       time.Time // when the transfer finished
+	Duration   time.Duration
+	RemoteHost string
+	Bytes      int64
+	Path       string
+	Direction  byte
+	AccessMode byte
+	User       string
+	Complete   bool
+}
+
+func (e Entry) String() string {
+	seconds := int64(e.Duration.Round(time.Second) / time.Second)
+	status := 'c'
+	if !e.Complete {
+		status = 'i'
+	}
+	// there is no TYPE A yet, every transfer is binary
+	return fmt.Sprintf("%s %d %s %d %s b _ %c %c %s ftp 0 * %c",
+		e.Time.Format("Mon Jan _2 15:04:05 2006"), seconds, e.RemoteHost, e.Bytes,
+		field(e.Path), e.Direction, e.AccessMode, field(e.User), status)
+}
+
+// fields are space separated, wu-ftpd puts underscores in place of spaces too
+func field(value string) string {
+	if value == "" {
+		return "*"
+	}
+	return strings.ReplaceAll(value, " ", "_")
+}
+
+// Logger appends entries to the xferlog file and rotates it once it grows past
+// maxBytes, keeping keep old files as file.1 (newest) up to file.<keep>
+type Logger struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+func Open(path string, maxBytes int64, keep int) (*Logger, error) {
+	l := &Logger{path: path, maxBytes: maxBytes, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("opening xferlog error: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening xferlog error: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the file aside before it lets go of it, when that fails the
+// logger goes on with the file it has. Caller holds mu.
+func (l *Logger) rotate() error {
+	if l.keep == 0 {
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		l.size = 0
+		return nil
+	}
+
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Log writes a single entry, a nil Logger (xferlog turned off) does nothing
+func (l *Logger) Log(entry Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line := entry.String() + "\n"
+	var rotateErr error
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			rotateErr = fmt.Errorf("rotating xferlog error: %w", err)
+		}
+	}
+
+	// the entry goes in even when rotating failed, it's tried again next time
+	n, err := l.file.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
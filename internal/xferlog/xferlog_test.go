@@ -0,0 +1,121 @@
+package xferlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func entry(path string) Entry {
+	return Entry{
+		Time:       time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+		Duration:   1500 * time.Millisecond,
+		RemoteHost: "10.0.0.1",
+		Bytes:      42,
+		Path:       path,
+		Direction:  DirectionIncoming,
+		AccessMode: AccessReal,
+		User:       "alice",
+		Complete:   true,
+	}
+}
+
+func TestEntryString(t *testing.T) {
+	e := entry("/my file.txt")
+	want := "Wed Mar  4 05:06:07 2026 2 10.0.0.1 42 /my_file.txt b _ i r alice ftp 0 * c"
+	if got := e.String(); got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+
+	e.Complete, e.User = false, ""
+	if got := e.String(); !strings.HasSuffix(got, " r * ftp 0 * i") {
+		t.Errorf("incomplete transfer without user: %q", got)
+	}
+}
+
+func lines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xferlog")
+	line := int64(len(entry("/a").String()) + 1)
+	l, err := Open(path, 2*line, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for range 7 {
+		if err := l.Log(entry("/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 lines a file, the oldest went beyond .2
+	for name, want := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if got := lines(t, name); got != want {
+			t.Errorf("%v has %d lines, want %d", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more than 2 old files")
+	}
+}
+
+func TestRotateTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xferlog")
+	line := int64(len(entry("/a").String()) + 1)
+	l, err := Open(path, line, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for range 3 {
+		if err := l.Log(entry("/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lines(t, path); got != 1 {
+		t.Errorf("%d lines, want 1", got)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xferlog")
+	line := int64(len(entry("/a").String()) + 1)
+	l, err := Open(path, line, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a directory in the way of xferlog.1 makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(entry("/a"))
+	if err := l.Log(entry("/b")); err == nil {
+		t.Fatal("rotating into a directory did not fail")
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the logger still works and rotates once it can
+	if err := l.Log(entry("/c")); err != nil {
+		t.Fatalf("Log after a failed rotation: %v", err)
+	}
+	if got := lines(t, path+".1"); got != 2 {
+		t.Errorf("rotated file has %d lines, want 2", got)
+	}
+	if got := lines(t, path); got != 1 {
+		t.Errorf("new file has %d lines, want 1", got)
+	}
+}
@@ -17,12 +17,36 @@ func LoadJSON[T any](filename string) (T, error) {
 	return data, json.Unmarshal(fileData, &data)
 }
 
+// SaveJSON writes to a temp file next to filename and renames it over, so
+// readers never see a half written file
 func SaveJSON(filename string, data interface{}) error {
 	jsonData, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, jsonData, 0644)
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+
+	if _, err := tmp.Write(jsonData); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
 func FormatFileList(files []string) string {
@@ -34,49 +58,3 @@ func FormatFileList(files []string) string {
 	}
 	return formattedList.String()
 }
-
-func ScanAndUpdateChildren(dirPath string, children map[string]interface{}) error {
-	files, err := os.ReadDir(dirPath)
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		filePath := filepath.Join(dirPath, file.Name())
-		fileInfo, err := os.Stat(filePath)
-		if err != nil {
-			return err
-		}
-
-		// prepare metadata for this file/directory
-		metadata := map[string]interface{}{
-			"type":          "file",
-			"size":          fileInfo.Size(),
-			"last_modified": fileInfo.ModTime().Unix(),
-		}
-
-		if file.IsDir() {
-			// if its a directory, create a nested children map
-			metadata["type"] = "directory"
-			metadata["children"] = make(map[string]interface{})
-
-			// recursively scan subdirectory
-			subChildren, ok := metadata["children"].(map[string]interface{})
-			if !ok {
-				return fmt.Errorf("failed to create children for directory: %s", file.Name())
-			}
-			if err := ScanAndUpdateChildren(filePath, subChildren); err != nil {
-				return err
-			}
-
-			// if no children, remove the children key
-			if len(subChildren) == 0 {
-				delete(metadata, "children")
-			}
-		}
-
-		children[file.Name()] = metadata
-	}
-
-	return nil
-}